@@ -0,0 +1,148 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/imrany/whats-email/pkg/whatsapp"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// pageParams reads the limit and cursor query parameters of a paginated
+// list, limit being 50 by default and at most 200
+func pageParams(r *http.Request) (int, string, []FieldError) {
+	limit := 50
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 200 {
+			return 0, "", []FieldError{{Field: "limit", Message: "limit must be between 1 and 200"}}
+		}
+		limit = n
+	}
+	return limit, r.URL.Query().Get("cursor"), nil
+}
+
+// chatJID parses the chat of a request, a JID such as
+// 254712345678@s.whatsapp.net or 120363025246125486@g.us, or a phone number
+// for a direct chat
+func chatJID(raw string) (types.JID, *FieldError) {
+	if !strings.Contains(raw, "@") {
+		if !phoneNumberPattern.MatchString(raw) {
+			return types.JID{}, &FieldError{Field: "jid", Message: "jid must be a chat JID or a phone number with the country code and no +"}
+		}
+		return types.NewJID(raw, types.DefaultUserServer), nil
+	}
+	jid, err := types.ParseJID(raw)
+	if err != nil || jid.User == "" {
+		return types.JID{}, &FieldError{Field: "jid", Message: "jid must be a chat JID or a phone number with the country code and no +"}
+	}
+	return jid, nil
+}
+
+// writePageError writes the response for a failed chat or message query
+func writePageError(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, whatsapp.ErrInvalidCursor) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    []FieldError{{Field: "cursor", Message: err.Error()}},
+		})
+		return
+	}
+	slog.Error(message, "error", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(Response{
+		Success: false,
+		Message: message,
+	})
+}
+
+// ListWhatsAppChats handler - GET /api/v1/whatsapp/chats - lists the chats of
+// the default session with their latest message, the latest active first.
+// GET /api/v1/whatsapp/{session}/chats lists those of that session instead.
+// Pages hold limit chats, and the next one starts from the cursor returned
+// with the previous one.
+func ListWhatsAppChats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit, cursor, errs := pageParams(r)
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	session, ok := whatsAppSession(w, chi.URLParam(r, "session"))
+	if !ok {
+		return
+	}
+
+	chats, next, err := session.Chats(r.Context(), limit, cursor)
+	if err != nil {
+		writePageError(w, "Failed to list WhatsApp chats", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "WhatsApp chats retrieved",
+		Data: map[string]any{
+			"chats":       chats,
+			"next_cursor": next,
+		},
+	})
+}
+
+// ListWhatsAppMessages handler - GET /api/v1/whatsapp/chats/{jid}/messages -
+// lists the messages sent and received in a chat of the default session,
+// newest first. GET /api/v1/whatsapp/{session}/chats/{jid}/messages lists
+// those of that session instead. Pages work as for the chats.
+func ListWhatsAppMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit, cursor, errs := pageParams(r)
+	jid, fieldErr := chatJID(chi.URLParam(r, "jid"))
+	if fieldErr != nil {
+		errs = append(errs, *fieldErr)
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	session, ok := whatsAppSession(w, chi.URLParam(r, "session"))
+	if !ok {
+		return
+	}
+
+	messages, next, err := session.Messages(r.Context(), jid, limit, cursor)
+	if err != nil {
+		writePageError(w, "Failed to list WhatsApp messages", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "WhatsApp messages retrieved",
+		Data: map[string]any{
+			"chat":        jid.ToNonAD().String(),
+			"messages":    messages,
+			"next_cursor": next,
+		},
+	})
+}
@@ -0,0 +1,183 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/imrany/whats-email/pkg/mailer"
+	"github.com/spf13/viper"
+)
+
+// MagicLinkRequest asks for a sign-in link to be emailed
+type MagicLinkRequest struct {
+	Email  string `json:"email"`
+	Locale string `json:"locale"`
+}
+
+// Validate checks the request and returns one FieldError per invalid field
+func (req MagicLinkRequest) Validate() []FieldError {
+	var errs []FieldError
+	if strings.TrimSpace(req.Email) == "" {
+		errs = append(errs, FieldError{Field: "email", Message: "email is required"})
+	} else {
+		errs = append(errs, validateAddresses("email", []string{req.Email})...)
+	}
+	errs = append(errs, validateLocale(req.Locale)...)
+	return errs
+}
+
+// MagicLinkVerifyRequest carries the token of a magic link
+type MagicLinkVerifyRequest struct {
+	Token string `json:"token"`
+}
+
+// magicLink returns MAGIC_LINK_URL with token added to its query
+func magicLink(token string) (string, error) {
+	link, err := url.Parse(viper.GetString("MAGIC_LINK_URL"))
+	if err != nil {
+		return "", fmt.Errorf("invalid MAGIC_LINK_URL: %w", err)
+	}
+	if link.Scheme != "http" && link.Scheme != "https" || link.Host == "" {
+		return "", fmt.Errorf("invalid MAGIC_LINK_URL: must be an absolute http or https URL")
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return link.String(), nil
+}
+
+// RequestMagicLink handler - POST /api/v1/magic-link/request - emails a
+// single-use sign-in link
+func RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req MagicLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	if otpService == nil || mailClient == nil || viper.GetString("MAGIC_LINK_URL") == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Magic links are not configured",
+		})
+		return
+	}
+
+	purpose := string(mailer.OtpPurposeMagicLink)
+	token, err := otpService.IssueToken(r.Context(), req.Email, purpose)
+	if err != nil {
+		writeOTPError(w, err)
+		return
+	}
+
+	if err := sendMagicLink(r.Context(), req, token.Value); err != nil {
+		slog.Error("Failed to send magic link", "error", err)
+		// The link never reached the recipient, let them ask again right away
+		if err := otpService.Invalidate(context.WithoutCancel(r.Context()), req.Email, purpose); err != nil {
+			slog.Error("Failed to invalidate undelivered magic link", "error", err)
+		}
+		status := http.StatusBadGateway
+		if r.Context().Err() != nil {
+			status = http.StatusGatewayTimeout
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Failed to send magic link",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Magic link sent successfully",
+		Data:    map[string]any{"expires_at": token.ExpiresAt.UTC()},
+	})
+}
+
+func sendMagicLink(ctx context.Context, req MagicLinkRequest, token string) error {
+	link, err := magicLink(token)
+	if err != nil {
+		return err
+	}
+	rendered, err := mailer.RenderMagicLink(link, req.Locale)
+	if err != nil {
+		return err
+	}
+	emailData := mailer.EmailData{To: []string{req.Email}}
+	rendered.Apply(&emailData)
+	_, err = mailClient.SendContext(ctx, emailData)
+	return err
+}
+
+// VerifyMagicLink handler - POST /api/v1/magic-link/verify - uses up the
+// token of a magic link and returns the email address it was sent to
+func VerifyMagicLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req MagicLinkVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if strings.TrimSpace(req.Token) == "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    []FieldError{{Field: "token", Message: "token is required"}},
+		})
+		return
+	}
+
+	if otpService == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Magic links are not configured",
+		})
+		return
+	}
+
+	identity, err := otpService.VerifyToken(r.Context(), string(mailer.OtpPurposeMagicLink), req.Token)
+	if err != nil {
+		writeOTPError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Magic link verified successfully",
+		Data: map[string]any{
+			"email":   identity.Recipient,
+			"purpose": identity.Purpose,
+		},
+	})
+}
@@ -1,8 +1,21 @@
 package v1
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
 	"net/http"
+	"net/mail"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/imrany/whats-email/pkg/mailer"
 	"github.com/spf13/viper"
@@ -14,28 +27,399 @@ type Response struct {
 	Data    any    `json:"data,omitempty"`
 }
 
+// FieldError describes a validation failure on a single request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
 type SendMailRequest struct {
-	To      []string `json:"to"`
-	Subject string   `json:"subject"`
-	Body    string   `json:"body"`
-	IsHTML  bool     `json:"is_html"`
+	To          []string            `json:"to"`
+	Cc          []string            `json:"cc"`
+	Bcc         []string            `json:"bcc"`
+	ReplyTo     string              `json:"reply_to"`
+	Subject     string              `json:"subject"`
+	Body        string              `json:"body"`
+	IsHTML      bool                `json:"is_html"`
+	TextBody    string              `json:"text_body"` // plain-text alternative, generated from an HTML body when empty
+	Attachments []AttachmentRequest `json:"attachments"`
+
+	// Inline images are referenced from the HTML body as cid:<content_id>.
+	// They replace template images with the same content_id.
+	Inline []AttachmentRequest `json:"inline"`
+
+	// Template renders subject and body from a named template instead.
+	// TemplateVersion 0 selects the latest version. Locale picks the
+	// template's language, falling back e.g. from sw-KE to sw to en.
+	Template        string         `json:"template"`
+	TemplateVersion int            `json:"template_version"`
+	Variables       map[string]any `json:"variables"`
+	Locale          string         `json:"locale"`
+}
+
+// AttachmentRequest is a file attached to a SendMailRequest. In JSON bodies
+// content is base64 encoded; multipart uploads fill in Reader instead.
+// ContentID is only used by inline images.
+type AttachmentRequest struct {
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	ContentID   string    `json:"content_id"`
+	Content     []byte    `json:"content"`
+	Reader      io.Reader `json:"-"`
+}
+
+// maxMailRequestSize caps the size of a send request, attachments included
+const maxMailRequestSize = 25 << 20 // 25 MB
+
+// mailClient is the pooled mailer shared by all handlers, set by InitMailer
+var mailClient *mailer.Client
+
+// InitMailer creates the shared mail client from the viper configuration.
+// It must run after flags and env variables are bound.
+func InitMailer() error {
+	if dir := viper.GetString("MAIL_TEMPLATES_DIR"); dir != "" {
+		if err := mailer.DefaultTemplates.Load(os.DirFS(dir)); err != nil {
+			return fmt.Errorf("failed to load mail templates: %w", err)
+		}
+	}
+
+	config, err := smtpConfig()
+	if err != nil {
+		return err
+	}
+
+	transport, err := mailer.NewTransport(mailer.TransportConfig{
+		Kind:         mailer.TransportKind(viper.GetString("MAIL_TRANSPORT")),
+		SendmailPath: viper.GetString("MAIL_SENDMAIL_PATH"),
+		Dir:          viper.GetString("MAIL_FILE_DIR"),
+		SMTP: mailer.ClientOptions{
+			MaxConnections: viper.GetInt("SMTP_POOL_SIZE"),
+			IdleTimeout:    viper.GetDuration("SMTP_POOL_IDLE_TIMEOUT"),
+		},
+	}, config)
+	if err != nil {
+		return err
+	}
+
+	client, err := mailer.NewClientWithTransport(config, transport)
+	if err != nil {
+		return err
+	}
+
+	mailClient = client
+	return nil
+}
+
+// CloseMailer closes the pooled SMTP sessions of the shared mail client
+func CloseMailer() {
+	if mailClient != nil {
+		mailClient.Close()
+	}
+}
+
+// smtpTokenSource returns the XOAUTH2 token source configured through viper,
+// or nil when OAuth2 is not configured
+func smtpTokenSource() mailer.TokenSource {
+	if refreshToken := viper.GetString("SMTP_OAUTH2_REFRESH_TOKEN"); refreshToken != "" {
+		return &mailer.OAuth2TokenSource{
+			TokenURL:     viper.GetString("SMTP_OAUTH2_TOKEN_URL"),
+			ClientID:     viper.GetString("SMTP_OAUTH2_CLIENT_ID"),
+			ClientSecret: viper.GetString("SMTP_OAUTH2_CLIENT_SECRET"),
+			RefreshToken: refreshToken,
+		}
+	}
+	if accessToken := viper.GetString("SMTP_OAUTH2_ACCESS_TOKEN"); accessToken != "" {
+		return mailer.StaticTokenSource(accessToken)
+	}
+	return nil
+}
+
+// smtpConfig reads the SMTP configuration from viper. It is validated by the
+// SMTP transport, as other transports only need the sender fields.
+func smtpConfig() (mailer.SMTPConfig, error) {
+	var dkim *mailer.DKIMSigner
+	if keyPath := viper.GetString("DKIM_PRIVATE_KEY_PATH"); keyPath != "" {
+		var err error
+		dkim, err = mailer.LoadDKIMSigner(viper.GetString("DKIM_DOMAIN"), viper.GetString("DKIM_SELECTOR"), keyPath)
+		if err != nil {
+			return mailer.SMTPConfig{}, err
+		}
+	}
+
+	config := mailer.SMTPConfig{
+		Host:     viper.GetString("SMTP_HOST"),
+		Port:     viper.GetInt("SMTP_PORT"),
+		Username: viper.GetString("SMTP_USERNAME"),
+		Password: viper.GetString("SMTP_PASSWORD"),
+		Email:    viper.GetString("SMTP_EMAIL"),
+		FromName: viper.GetString("SMTP_FROM_NAME"),
+
+		TLSMode:       mailer.TLSMode(viper.GetString("SMTP_TLS_MODE")),
+		CAFile:        viper.GetString("SMTP_CA_FILE"),
+		CertFile:      viper.GetString("SMTP_CERT_FILE"),
+		KeyFile:       viper.GetString("SMTP_KEY_FILE"),
+		MinTLSVersion: viper.GetString("SMTP_TLS_MIN_VERSION"),
+
+		AuthMechanism: mailer.AuthMechanism(strings.ToUpper(viper.GetString("SMTP_AUTH"))),
+		TokenSource:   smtpTokenSource(),
+
+		DKIM: dkim,
+
+		Timeout: viper.GetDuration("SMTP_TIMEOUT"),
+	}
+	// A send must be able to time out on its own and still answer within
+	// the request
+	if requestTimeout := viper.GetDuration("REQUEST_TIMEOUT"); requestTimeout > 0 && config.Timeout >= requestTimeout {
+		return mailer.SMTPConfig{}, fmt.Errorf("SMTP_TIMEOUT (%s) must be shorter than REQUEST_TIMEOUT (%s)", config.Timeout, requestTimeout)
+	}
+	return config, nil
+}
+
+// Validate checks the request and returns one FieldError per invalid field
+func (req SendMailRequest) Validate() []FieldError {
+	var errs []FieldError
+
+	if len(req.To) == 0 {
+		errs = append(errs, FieldError{Field: "to", Message: "at least one recipient is required"})
+	}
+	errs = append(errs, validateAddresses("to", req.To)...)
+	errs = append(errs, validateAddresses("cc", req.Cc)...)
+	errs = append(errs, validateAddresses("bcc", req.Bcc)...)
+	if req.ReplyTo != "" {
+		errs = append(errs, validateAddresses("reply_to", []string{req.ReplyTo})...)
+	}
+	if req.Template != "" {
+		// Subject and body come from the template, the subject may be overridden
+		if req.Body != "" {
+			errs = append(errs, FieldError{Field: "body", Message: "body must be empty when a template is used"})
+		}
+		if req.TextBody != "" {
+			errs = append(errs, FieldError{Field: "text_body", Message: "text_body must be empty when a template is used"})
+		}
+		if req.TemplateVersion < 0 {
+			errs = append(errs, FieldError{Field: "template_version", Message: "template_version must not be negative"})
+		}
+		errs = append(errs, validateLocale(req.Locale)...)
+	} else {
+		if strings.TrimSpace(req.Subject) == "" {
+			errs = append(errs, FieldError{Field: "subject", Message: "subject is required"})
+		}
+		if strings.TrimSpace(req.Body) == "" {
+			errs = append(errs, FieldError{Field: "body", Message: "body is required"})
+		}
+	}
+	if strings.ContainsAny(req.Subject, "\r\n") {
+		errs = append(errs, FieldError{Field: "subject", Message: "subject must not contain line breaks"})
+	}
+	for i, attachment := range req.Attachments {
+		field := fmt.Sprintf("attachments[%d]", i)
+		if attachment.Filename == "" {
+			errs = append(errs, FieldError{Field: field + ".filename", Message: "filename is required"})
+		}
+		if len(attachment.Content) == 0 && attachment.Reader == nil {
+			errs = append(errs, FieldError{Field: field + ".content", Message: "content is required"})
+		}
+	}
+	if len(req.Inline) > 0 && !req.IsHTML && req.Template == "" {
+		errs = append(errs, FieldError{Field: "inline", Message: "inline images require an HTML body or a template"})
+	}
+	seen := map[string]bool{}
+	for i, image := range req.Inline {
+		field := fmt.Sprintf("inline[%d]", i)
+		switch {
+		case !mailer.ValidContentID(image.ContentID):
+			errs = append(errs, FieldError{Field: field + ".content_id", Message: "invalid content_id: " + image.ContentID})
+		case seen[image.ContentID]:
+			errs = append(errs, FieldError{Field: field + ".content_id", Message: "duplicate content_id: " + image.ContentID})
+		}
+		seen[image.ContentID] = true
+		if len(image.Content) == 0 && image.Reader == nil {
+			errs = append(errs, FieldError{Field: field + ".content", Message: "content is required"})
+		}
+	}
+
+	return errs
+}
+
+func validateLocale(locale string) []FieldError {
+	if locale == "" {
+		return nil
+	}
+	if _, err := mailer.NormalizeLocale(locale); err != nil {
+		return []FieldError{{Field: "locale", Message: err.Error()}}
+	}
+	return nil
+}
+
+func validateAddresses(field string, addrs []string) []FieldError {
+	var errs []FieldError
+	for _, addr := range addrs {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			errs = append(errs, FieldError{Field: field, Message: "invalid email address: " + addr})
+		}
+	}
+	return errs
+}
+
+// decodeSendMailRequest reads a SendMailRequest from either a JSON body or a
+// multipart/form-data upload. The returned cleanup func releases uploaded files.
+func decodeSendMailRequest(r *http.Request) (SendMailRequest, func(), error) {
+	var req SendMailRequest
+	cleanup := func() {}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		return req, cleanup, err
+	}
+
+	if err := r.ParseMultipartForm(maxMailRequestSize); err != nil {
+		return req, cleanup, err
+	}
+	form := r.MultipartForm
+
+	req.To = formAddresses(form.Value["to"])
+	req.Cc = formAddresses(form.Value["cc"])
+	req.Bcc = formAddresses(form.Value["bcc"])
+	req.ReplyTo = r.FormValue("reply_to")
+	req.Subject = r.FormValue("subject")
+	req.Body = r.FormValue("body")
+	req.TextBody = r.FormValue("text_body")
+	if isHTML := r.FormValue("is_html"); isHTML != "" {
+		value, err := strconv.ParseBool(isHTML)
+		if err != nil {
+			return req, cleanup, fmt.Errorf("is_html: %w", err)
+		}
+		req.IsHTML = value
+	}
+	req.Template = r.FormValue("template")
+	req.Locale = r.FormValue("locale")
+	if version := r.FormValue("template_version"); version != "" {
+		value, err := strconv.Atoi(version)
+		if err != nil {
+			return req, cleanup, fmt.Errorf("template_version: %w", err)
+		}
+		req.TemplateVersion = value
+	}
+	if variables := r.FormValue("variables"); variables != "" {
+		if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+			return req, cleanup, fmt.Errorf("variables: %w", err)
+		}
+	}
+
+	var files []io.Closer
+	cleanup = func() {
+		for _, f := range files {
+			f.Close()
+		}
+		form.RemoveAll()
+	}
+	for _, header := range form.File["attachments"] {
+		file, err := header.Open()
+		if err != nil {
+			return req, cleanup, err
+		}
+		files = append(files, file)
+		req.Attachments = append(req.Attachments, AttachmentRequest{
+			Filename:    header.Filename,
+			ContentType: header.Header.Get("Content-Type"),
+			Reader:      file,
+		})
+	}
+	// Inline images are uploaded as cid:<content_id> fields
+	for _, field := range slices.Sorted(maps.Keys(form.File)) {
+		contentID, ok := strings.CutPrefix(field, "cid:")
+		if !ok {
+			continue
+		}
+		for _, header := range form.File[field] {
+			file, err := header.Open()
+			if err != nil {
+				return req, cleanup, err
+			}
+			files = append(files, file)
+			// Most clients upload files as application/octet-stream, mail
+			// clients only display images with an image type
+			contentType := header.Header.Get("Content-Type")
+			if contentType == "application/octet-stream" {
+				contentType = ""
+			}
+			req.Inline = append(req.Inline, AttachmentRequest{
+				Filename:    header.Filename,
+				ContentType: contentType,
+				ContentID:   contentID,
+				Reader:      file,
+			})
+		}
+	}
+
+	return req, cleanup, nil
 }
 
-var SMTP_Config = mailer.SMTPConfig{
-	Host:     viper.GetString("SMTP_HOST"),
-	Port:     viper.GetInt("SMTP_PORT"),
-	Username: viper.GetString("SMTP_USERNAME"),
-	Password: viper.GetString("SMTP_PASSWORD"),
-	Email:    viper.GetString("SMTP_EMAIL"),
+// formAddresses flattens repeated and comma separated address form values
+func formAddresses(values []string) []string {
+	var addrs []string
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// renderTemplate fills in the subject and body of emailData from the
+// template named in req. A subject set in req overrides the template's.
+func renderTemplate(req SendMailRequest, emailData *mailer.EmailData) *FieldError {
+	tmpl, err := mailer.DefaultTemplates.Lookup(req.Template, req.TemplateVersion)
+	if err != nil {
+		return &FieldError{Field: "template", Message: err.Error()}
+	}
+	variables := req.Variables
+	if variables == nil {
+		variables = map[string]any{}
+	}
+	rendered, err := tmpl.RenderLocale(req.Locale, variables)
+	if err != nil {
+		return &FieldError{Field: "variables", Message: err.Error()}
+	}
+
+	rendered.Apply(emailData)
+	if req.Subject != "" {
+		emailData.Subject = req.Subject
+	}
+	if strings.TrimSpace(emailData.Subject) == "" {
+		return &FieldError{Field: "subject", Message: "subject is required, the template does not define one"}
+	}
+	return nil
+}
+
+// ListMailTemplates handler - GET /api/v1/mailer/templates - lists the
+// available templates and their versions
+func ListMailTemplates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	templates := map[string][]int{}
+	for _, name := range mailer.DefaultTemplates.Names() {
+		templates[name] = mailer.DefaultTemplates.Versions(name)
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Mail templates",
+		Data:    templates,
+	})
 }
 
 // SendMail handler - POST /api/v1/mailer/send - receives send email requests
 func SendMail(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	var req SendMailRequest
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	r.Body = http.MaxBytesReader(w, r.Body, maxMailRequestSize)
+	req, cleanup, err := decodeSendMailRequest(r)
+	defer cleanup()
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(Response{
 			Success: false,
@@ -44,16 +428,82 @@ func SendMail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if errs := req.Validate(); len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	if mailClient == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Mail service is not configured",
+		})
+		return
+	}
+
 	emailData := mailer.EmailData{
 		To:      req.To,
-		Subject: "Test Email",
-		Body:    "This is a test email.",
-		IsHTML:  false,
+		Cc:      req.Cc,
+		Bcc:     req.Bcc,
+		ReplyTo: req.ReplyTo,
+		Subject: req.Subject,
+		Body:    req.Body,
+		IsHTML:  req.IsHTML,
+	}
+	if req.IsHTML {
+		emailData.TextBody = req.TextBody
+	}
+	if req.Template != "" {
+		if fieldErr := renderTemplate(req, &emailData); fieldErr != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: "Validation failed",
+				Data:    []FieldError{*fieldErr},
+			})
+			return
+		}
+	}
+	for _, attachment := range req.Attachments {
+		emailData.Attachments = append(emailData.Attachments, mailer.Attachment{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Data:        attachment.Content,
+			Reader:      attachment.Reader,
+		})
+	}
+	for _, image := range req.Inline {
+		emailData.Inline = slices.DeleteFunc(emailData.Inline, func(a mailer.Attachment) bool {
+			return a.ContentID == image.ContentID
+		})
+		emailData.Inline = append(emailData.Inline, mailer.Attachment{
+			Filename:    image.Filename,
+			ContentType: image.ContentType,
+			Data:        image.Content,
+			Reader:      image.Reader,
+			ContentID:   image.ContentID,
+		})
 	}
-	err := mailer.SendEmail(emailData, SMTP_Config)
+	messageID, err := mailClient.SendContext(r.Context(), emailData)
 
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Error("Timed out sending email", "error", err)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Timed out sending email",
+		})
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("Failed to send email", "error", err)
+		w.WriteHeader(http.StatusBadGateway)
 		json.NewEncoder(w).Encode(Response{
 			Success: false,
 			Message: "Failed to send email",
@@ -64,5 +514,249 @@ func SendMail(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(Response{
 		Success: true,
 		Message: "Email sent successfully",
+		Data:    map[string]string{"message_id": messageID},
+	})
+}
+
+// SendInviteRequest is a calendar invitation, update or cancellation.
+// Subject and body default to a description of the event.
+type SendInviteRequest struct {
+	To      []string     `json:"to"`
+	Cc      []string     `json:"cc"`
+	ReplyTo string       `json:"reply_to"`
+	Subject string       `json:"subject"`
+	Body    string       `json:"body"`
+	IsHTML  bool         `json:"is_html"`
+	Method  string       `json:"method"` // REQUEST (default) or CANCEL
+	Event   EventRequest `json:"event"`
+}
+
+// EventRequest is the event of a SendInviteRequest. Start and End are RFC
+// 3339 times, shown in TimeZone. Updates and cancellations reuse the uid
+// returned for the original invitation with a higher sequence.
+type EventRequest struct {
+	UID             string            `json:"uid"` // generated when empty
+	Sequence        int               `json:"sequence"`
+	Summary         string            `json:"summary"`
+	Description     string            `json:"description"`
+	Location        string            `json:"location"`
+	URL             string            `json:"url"`
+	Start           time.Time         `json:"start"`
+	End             time.Time         `json:"end"`
+	TimeZone        string            `json:"timezone"`  // IANA name, e.g. Africa/Nairobi, defaults to UTC
+	Organizer       *AttendeeRequest  `json:"organizer"` // defaults to the sender
+	Attendees       []AttendeeRequest `json:"attendees"` // default to the to and cc recipients
+	ReminderMinutes []int             `json:"reminder_minutes"`
+}
+
+// AttendeeRequest is an event organizer or attendee
+type AttendeeRequest struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Optional bool   `json:"optional"`
+}
+
+// Validate checks the request and returns one FieldError per invalid field
+func (req SendInviteRequest) Validate() []FieldError {
+	var errs []FieldError
+
+	if len(req.To) == 0 {
+		errs = append(errs, FieldError{Field: "to", Message: "at least one recipient is required"})
+	}
+	errs = append(errs, validateAddresses("to", req.To)...)
+	errs = append(errs, validateAddresses("cc", req.Cc)...)
+	if req.ReplyTo != "" {
+		errs = append(errs, validateAddresses("reply_to", []string{req.ReplyTo})...)
+	}
+	if strings.ContainsAny(req.Subject, "\r\n") {
+		errs = append(errs, FieldError{Field: "subject", Message: "subject must not contain line breaks"})
+	}
+	method := mailer.CalendarMethod(strings.ToUpper(req.Method))
+	switch method {
+	case "", mailer.CalendarRequest, mailer.CalendarCancel:
+	default:
+		errs = append(errs, FieldError{Field: "method", Message: "method must be REQUEST or CANCEL"})
+	}
+
+	event := req.Event
+	if method == mailer.CalendarCancel && event.UID == "" {
+		errs = append(errs, FieldError{Field: "event.uid", Message: "uid of the cancelled event is required"})
+	}
+	if event.Sequence < 0 {
+		errs = append(errs, FieldError{Field: "event.sequence", Message: "sequence must not be negative"})
+	}
+	if strings.TrimSpace(event.Summary) == "" {
+		errs = append(errs, FieldError{Field: "event.summary", Message: "summary is required"})
+	}
+	if event.Start.IsZero() {
+		errs = append(errs, FieldError{Field: "event.start", Message: "start is required"})
+	}
+	if !event.End.After(event.Start) {
+		errs = append(errs, FieldError{Field: "event.end", Message: "end must be after start"})
+	}
+	if event.TimeZone != "" {
+		if _, err := time.LoadLocation(event.TimeZone); err != nil {
+			errs = append(errs, FieldError{Field: "event.timezone", Message: "unknown time zone: " + event.TimeZone})
+		}
+	}
+	if event.Organizer != nil {
+		errs = append(errs, validateAddresses("event.organizer.email", []string{event.Organizer.Email})...)
+	}
+	for i, attendee := range event.Attendees {
+		errs = append(errs, validateAddresses(fmt.Sprintf("event.attendees[%d].email", i), []string{attendee.Email})...)
+	}
+	for _, minutes := range event.ReminderMinutes {
+		if minutes < 0 {
+			errs = append(errs, FieldError{Field: "event.reminder_minutes", Message: "reminders must not be negative"})
+			break
+		}
+	}
+
+	return errs
+}
+
+// calendar converts the request to a mailer.Calendar
+func (req SendInviteRequest) calendar() mailer.Calendar {
+	event := req.Event
+	location := time.UTC
+	if event.TimeZone != "" {
+		// Validate has checked the time zone
+		location, _ = time.LoadLocation(event.TimeZone)
+	}
+
+	calendar := mailer.Calendar{
+		Method: mailer.CalendarMethod(strings.ToUpper(req.Method)),
+		Event: mailer.Event{
+			UID:         event.UID,
+			Sequence:    event.Sequence,
+			Summary:     event.Summary,
+			Description: event.Description,
+			Location:    event.Location,
+			URL:         event.URL,
+			Start:       event.Start,
+			End:         event.End,
+			TimeZone:    location,
+		},
+	}
+	if calendar.Method == "" {
+		calendar.Method = mailer.CalendarRequest
+	}
+	if event.Organizer != nil {
+		calendar.Event.Organizer = mailer.Organizer{Name: event.Organizer.Name, Email: event.Organizer.Email}
+	}
+	for _, attendee := range event.Attendees {
+		calendar.Event.Attendees = append(calendar.Event.Attendees, mailer.Attendee{
+			Name:     attendee.Name,
+			Email:    attendee.Email,
+			Optional: attendee.Optional,
+		})
+	}
+	for _, minutes := range event.ReminderMinutes {
+		calendar.Event.Reminders = append(calendar.Event.Reminders, time.Duration(minutes)*time.Minute)
+	}
+	return calendar
+}
+
+// SendInvite handler - POST /api/v1/mailer/invite - sends a calendar
+// invitation, update or cancellation
+func SendInvite(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req SendInviteRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxMailRequestSize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	if mailClient == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Mail service is not configured",
+		})
+		return
+	}
+
+	calendar := req.calendar()
+	if calendar.Event.UID == "" {
+		uid, err := mailer.GenerateEventUID(viper.GetString("SMTP_EMAIL"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: "Failed to generate event UID",
+			})
+			return
+		}
+		calendar.Event.UID = uid
+	}
+
+	emailData := mailer.EmailData{
+		To:       req.To,
+		Cc:       req.Cc,
+		ReplyTo:  req.ReplyTo,
+		Subject:  req.Subject,
+		Body:     req.Body,
+		IsHTML:   req.IsHTML,
+		Calendar: &calendar,
+	}
+	if emailData.Subject == "" {
+		switch {
+		case calendar.Method == mailer.CalendarCancel:
+			emailData.Subject = "Cancelled: " + calendar.Event.Summary
+		case calendar.Event.Sequence > 0:
+			emailData.Subject = "Updated invitation: " + calendar.Event.Summary
+		default:
+			emailData.Subject = "Invitation: " + calendar.Event.Summary
+		}
+	}
+	if strings.TrimSpace(emailData.Body) == "" {
+		emailData.Body = calendar.Text()
+		emailData.IsHTML = false
+	}
+	messageID, err := mailClient.SendContext(r.Context(), emailData)
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Error("Timed out sending invitation", "error", err)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Timed out sending invitation",
+		})
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to send invitation", "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Failed to send invitation",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Invitation sent successfully",
+		Data: map[string]any{
+			"message_id": messageID,
+			"uid":        calendar.Event.UID,
+			"sequence":   calendar.Event.Sequence,
+		},
 	})
 }
@@ -0,0 +1,182 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imrany/whats-email/pkg/mailer"
+)
+
+// failingTransport fails every send with err
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) Send(ctx context.Context, from string, to []string, msg []byte) error {
+	return t.err
+}
+
+func (t failingTransport) Close() error {
+	return nil
+}
+
+// useMailTransport points the shared mail client at transport for the test
+func useMailTransport(t *testing.T, transport mailer.Transport) {
+	t.Helper()
+	client, err := mailer.NewClientWithTransport(mailer.SMTPConfig{Email: "sender@example.com"}, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := mailClient
+	mailClient = client
+	t.Cleanup(func() { mailClient = previous })
+}
+
+// sendMail posts body to SendMail with ctx and decodes the response
+func sendMail(t *testing.T, ctx context.Context, body string) (int, Response, []FieldError) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/mailer/send", strings.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	SendMail(w, req)
+
+	var resp struct {
+		Response
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	var fieldErrs []FieldError
+	if w.Code == http.StatusUnprocessableEntity {
+		if err := json.Unmarshal(resp.Data, &fieldErrs); err != nil {
+			t.Fatalf("failed to decode field errors %s: %v", resp.Data, err)
+		}
+	}
+	return w.Code, resp.Response, fieldErrs
+}
+
+const validMail = `{"to": ["Jane <jane@example.com>"], "cc": ["bob@example.com"], "subject": "Hello", "body": "Hi Jane"}`
+
+func TestSendMail(t *testing.T) {
+	transport := &mailer.MemoryTransport{}
+	useMailTransport(t, transport)
+
+	code, resp, _ := sendMail(t, context.Background(), validMail)
+	if code != http.StatusOK || !resp.Success {
+		t.Fatalf("SendMail = %d %+v, want 200", code, resp)
+	}
+	messages := transport.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("%d messages sent, want 1", len(messages))
+	}
+	if got := strings.Join(messages[0].To, " "); got != "jane@example.com bob@example.com" {
+		t.Errorf("recipients = %s", got)
+	}
+	if !strings.Contains(string(messages[0].Data), "Subject: Hello\r\n") {
+		t.Errorf("message does not have the subject:\n%s", messages[0].Data)
+	}
+}
+
+func TestSendMailErrors(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	tests := []struct {
+		name      string
+		transport mailer.Transport
+		ctx       context.Context
+		body      string
+		wantCode  int
+		wantField []string
+	}{
+		{
+			name:     "malformed body",
+			body:     `{"to": [`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "wrong field type",
+			body:     `{"to": "jane@example.com"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:      "missing fields",
+			body:      `{}`,
+			wantCode:  http.StatusUnprocessableEntity,
+			wantField: []string{"to", "subject", "body"},
+		},
+		{
+			name:      "invalid fields",
+			body:      `{"to": ["not an address"], "bcc": ["x@"], "subject": "Hi\r\nBcc: evil@example.com", "body": "Hi", "attachments": [{"filename": "a.txt"}]}`,
+			wantCode:  http.StatusUnprocessableEntity,
+			wantField: []string{"to", "bcc", "subject", "attachments[0].content"},
+		},
+		{
+			name:      "unknown template",
+			body:      `{"to": ["jane@example.com"], "template": "missing"}`,
+			wantCode:  http.StatusUnprocessableEntity,
+			wantField: []string{"template"},
+		},
+		{
+			name:      "transport failure",
+			transport: failingTransport{err: errors.New("535 5.7.8 authentication failed for smtp.internal.example.com")},
+			body:      validMail,
+			wantCode:  http.StatusBadGateway,
+		},
+		{
+			name:     "deadline",
+			ctx:      expired,
+			body:     validMail,
+			wantCode: http.StatusGatewayTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := tt.transport
+			if transport == nil {
+				transport = &mailer.MemoryTransport{}
+			}
+			useMailTransport(t, transport)
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			code, resp, fieldErrs := sendMail(t, ctx, tt.body)
+			if code != tt.wantCode || resp.Success {
+				t.Fatalf("SendMail = %d %+v, want %d", code, resp, tt.wantCode)
+			}
+			var fields []string
+			for _, fieldErr := range fieldErrs {
+				fields = append(fields, fieldErr.Field)
+			}
+			if got, want := strings.Join(fields, " "), strings.Join(tt.wantField, " "); got != want {
+				t.Errorf("field errors = %s, want %s", got, want)
+			}
+			// Server errors are logged, not returned to the client
+			if strings.Contains(resp.Message, "smtp.internal") {
+				t.Errorf("message leaks the transport error: %s", resp.Message)
+			}
+			if memory, ok := transport.(*mailer.MemoryTransport); ok && len(memory.Messages()) != 0 {
+				t.Errorf("%d messages sent, want none", len(memory.Messages()))
+			}
+		})
+	}
+}
+
+func TestSendMailNotConfigured(t *testing.T) {
+	previous := mailClient
+	mailClient = nil
+	t.Cleanup(func() { mailClient = previous })
+
+	if code, _, _ := sendMail(t, context.Background(), validMail); code != http.StatusServiceUnavailable {
+		t.Errorf("SendMail without a mail client = %d, want 503", code)
+	}
+}
@@ -0,0 +1,467 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imrany/whats-email/pkg/mailer"
+	"github.com/imrany/whats-email/pkg/otp"
+	"github.com/imrany/whats-email/pkg/whatsapp"
+	"github.com/spf13/viper"
+)
+
+// otpDB is the database of the OTP store, shared with the two-factor
+// store, opened by InitOTP
+var otpDB *sql.DB
+
+// otpService issues and verifies OTP codes, set by InitOTP
+var otpService *otp.Service
+
+// InitOTP opens the OTP store from the viper configuration
+func InitOTP(ctx context.Context) error {
+	policies, err := configureOTPPurposes()
+	if err != nil {
+		return fmt.Errorf("failed to initialize OTP store: %w", err)
+	}
+
+	alphabet := viper.GetString("OTP_ALPHABET")
+	switch alphabet {
+	case "digits":
+		alphabet = otp.Digits
+	case "alphanumeric":
+		alphabet = otp.Alphanumeric
+	}
+
+	db, err := otp.OpenDB(viper.GetString("DB_PATH"))
+	if err != nil {
+		return fmt.Errorf("failed to initialize OTP store: %w", err)
+	}
+
+	service, err := otp.New(ctx, db, otp.Config{
+		Length:   viper.GetInt("OTP_LENGTH"),
+		Alphabet: alphabet,
+		// Codes live as long as the OTP emails say
+		TTL: func(purpose string) time.Duration {
+			return mailer.GetOTPExpirationDuration(mailer.OtpPurpose(purpose))
+		},
+		MaxAttempts:    viper.GetInt("OTP_MAX_ATTEMPTS"),
+		Lockout:        viper.GetDuration("OTP_LOCKOUT"),
+		ResendCooldown: viper.GetDuration("OTP_RESEND_COOLDOWN"),
+		Secret:         []byte(viper.GetString("OTP_SECRET")),
+		Policies:       policies,
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to initialize OTP store: %w", err)
+	}
+	if viper.GetString("OTP_SECRET") == "" {
+		slog.Warn("OTP_SECRET is not set, OTP codes are hashed with a key stored next to them")
+	}
+
+	otpDB = db
+	otpService = service
+	return nil
+}
+
+// configureOTPPurposes registers the custom purposes listed in OTP_PURPOSES
+// and applies the per-purpose settings OTP_<PURPOSE>_EXPIRY,
+// OTP_<PURPOSE>_LENGTH and OTP_<PURPOSE>_RESEND_COOLDOWN, returning the
+// policies for the OTP store
+func configureOTPPurposes() (map[string]otp.Policy, error) {
+	for _, name := range strings.Split(viper.GetString("OTP_PURPOSES"), ",") {
+		purpose := mailer.OtpPurpose(strings.TrimSpace(name))
+		if purpose == "" || mailer.IsOTPPurpose(purpose) {
+			continue
+		}
+		if err := mailer.RegisterOTPPurpose(purpose, mailer.DefaultOTPExpiration); err != nil {
+			return nil, err
+		}
+	}
+
+	policies := map[string]otp.Policy{}
+	for _, purpose := range mailer.OTPPurposes() {
+		prefix := "OTP_" + strings.ToUpper(string(purpose)) + "_"
+
+		if value := viper.GetString(prefix + "EXPIRY"); value != "" {
+			expiry, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %sEXPIRY: %w", prefix, err)
+			}
+			if err := mailer.RegisterOTPPurpose(purpose, expiry); err != nil {
+				return nil, err
+			}
+		}
+
+		var policy otp.Policy
+		if value := viper.GetString(prefix + "LENGTH"); value != "" {
+			length, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %sLENGTH: %w", prefix, err)
+			}
+			policy.Length = length
+		}
+		if value := viper.GetString(prefix + "RESEND_COOLDOWN"); value != "" {
+			cooldown, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %sRESEND_COOLDOWN: %w", prefix, err)
+			}
+			policy.ResendCooldown = cooldown
+		}
+		if policy != (otp.Policy{}) {
+			policies[string(purpose)] = policy
+		}
+	}
+	return policies, nil
+}
+
+// CloseOTP closes the OTP and two-factor stores
+func CloseOTP() {
+	if otpDB != nil {
+		otpDB.Close()
+	}
+}
+
+// OTP delivery channels
+const (
+	otpChannelEmail    = "email"
+	otpChannelWhatsApp = "whatsapp"
+)
+
+// phoneNumberPattern matches a phone number in international format without
+// the leading +, as WhatsApp expects it
+var phoneNumberPattern = regexp.MustCompile(`^[1-9][0-9]{6,14}$`)
+
+// OTPRequest asks for a code to be sent. Channels are tried in order until
+// one delivers the code, by default email and then WhatsApp, skipping
+// channels the request has no address for.
+type OTPRequest struct {
+	Email       string   `json:"email"`
+	PhoneNumber string   `json:"phone_number"`
+	Channels    []string `json:"channels"`
+	Purpose     string   `json:"purpose"`
+	Locale      string   `json:"locale"`
+}
+
+// Validate checks the request and returns one FieldError per invalid field
+func (req OTPRequest) Validate() []FieldError {
+	errs := validateOTPRecipient(req.Email, req.PhoneNumber)
+	errs = append(errs, validateOTPPurpose(req.Purpose)...)
+	errs = append(errs, validateLocale(req.Locale)...)
+
+	seen := map[string]bool{}
+	for i, channel := range req.Channels {
+		field := fmt.Sprintf("channels[%d]", i)
+		switch {
+		case channel != otpChannelEmail && channel != otpChannelWhatsApp:
+			errs = append(errs, FieldError{Field: field, Message: "channel must be email or whatsapp"})
+		case seen[channel]:
+			errs = append(errs, FieldError{Field: field, Message: "duplicate channel: " + channel})
+		case channel == otpChannelEmail && req.Email == "":
+			errs = append(errs, FieldError{Field: "email", Message: "email is required for the email channel"})
+		case channel == otpChannelWhatsApp && req.PhoneNumber == "":
+			errs = append(errs, FieldError{Field: "phone_number", Message: "phone_number is required for the whatsapp channel"})
+		}
+		seen[channel] = true
+	}
+
+	return errs
+}
+
+// channels returns the channels to try, in order
+func (req OTPRequest) channels() []string {
+	if len(req.Channels) > 0 {
+		return req.Channels
+	}
+	var channels []string
+	if req.Email != "" {
+		channels = append(channels, otpChannelEmail)
+	}
+	if req.PhoneNumber != "" {
+		channels = append(channels, otpChannelWhatsApp)
+	}
+	return channels
+}
+
+// OTPVerifyRequest checks a code. It must give the same email and phone
+// number as the OTPRequest the code was sent for, even when only one of them
+// received it.
+type OTPVerifyRequest struct {
+	Email       string `json:"email"`
+	PhoneNumber string `json:"phone_number"`
+	Purpose     string `json:"purpose"`
+	Code        string `json:"code"`
+}
+
+// Validate checks the request and returns one FieldError per invalid field
+func (req OTPVerifyRequest) Validate() []FieldError {
+	errs := validateOTPRecipient(req.Email, req.PhoneNumber)
+	errs = append(errs, validateOTPPurpose(req.Purpose)...)
+	if strings.TrimSpace(req.Code) == "" {
+		errs = append(errs, FieldError{Field: "code", Message: "code is required"})
+	}
+
+	return errs
+}
+
+// otpRecipient returns the key codes are stored under, made of every
+// identifier given: the email address, the phone number or both. Which
+// channel delivered the code does not matter, but verifying it takes the
+// same identifiers as requesting it.
+func otpRecipient(email, phoneNumber string) string {
+	var identifiers []string
+	if email != "" {
+		identifiers = append(identifiers, email)
+	}
+	if phoneNumber != "" {
+		identifiers = append(identifiers, "whatsapp:"+phoneNumber)
+	}
+	return strings.Join(identifiers, " ")
+}
+
+func validateOTPRecipient(email, phoneNumber string) []FieldError {
+	var errs []FieldError
+	if strings.TrimSpace(email) == "" && strings.TrimSpace(phoneNumber) == "" {
+		errs = append(errs, FieldError{Field: "email", Message: "email or phone_number is required"})
+	}
+	if email != "" {
+		errs = append(errs, validateAddresses("email", []string{email})...)
+	}
+	if phoneNumber != "" && !phoneNumberPattern.MatchString(phoneNumber) {
+		errs = append(errs, FieldError{Field: "phone_number", Message: "phone_number must be digits with the country code and no +, e.g. 254712345678"})
+	}
+	return errs
+}
+
+func validateOTPPurpose(purpose string) []FieldError {
+	if purpose == "" {
+		return []FieldError{{Field: "purpose", Message: "purpose is required"}}
+	}
+	// Magic links have their own endpoints
+	if !mailer.IsOTPPurpose(mailer.OtpPurpose(purpose)) || purpose == string(mailer.OtpPurposeMagicLink) {
+		return []FieldError{{Field: "purpose", Message: "unknown purpose: " + purpose}}
+	}
+	return nil
+}
+
+// RequestOTP handler - POST /api/v1/otp/request - sends a new code by
+// email or WhatsApp
+func RequestOTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req OTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	if otpService == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "OTP service is not configured",
+		})
+		return
+	}
+
+	recipient := otpRecipient(req.Email, req.PhoneNumber)
+	code, err := otpService.Issue(r.Context(), recipient, req.Purpose)
+	if err != nil {
+		writeOTPError(w, err)
+		return
+	}
+
+	channel, failures := deliverOTP(r.Context(), req, code)
+	if channel == "" {
+		// The code never reached the recipient, let them ask again right away
+		if err := otpService.Invalidate(context.WithoutCancel(r.Context()), recipient, req.Purpose); err != nil {
+			slog.Error("Failed to invalidate undelivered OTP", "error", err)
+		}
+		status := http.StatusBadGateway
+		if r.Context().Err() != nil {
+			status = http.StatusGatewayTimeout
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Failed to send OTP",
+			Data:    map[string]any{"errors": failures},
+		})
+		return
+	}
+
+	if err := otpService.Delivered(r.Context(), recipient, req.Purpose, channel); err != nil {
+		slog.Error("Failed to record OTP delivery", "error", err)
+	}
+	slog.Info("OTP sent", "purpose", req.Purpose, "channel", channel)
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "OTP sent successfully",
+		Data: map[string]any{
+			"expires_at": code.ExpiresAt.UTC(),
+			"channel":    channel,
+		},
+	})
+}
+
+// deliverOTP tries the channels of req in order and returns the channel
+// that delivered code. Otherwise it logs the error of every channel and
+// returns a generic reason for each, safe to show to clients.
+func deliverOTP(ctx context.Context, req OTPRequest, code otp.Code) (string, map[string]string) {
+	failures := map[string]string{}
+	for _, channel := range req.channels() {
+		if ctx.Err() != nil {
+			break
+		}
+
+		var err error
+		switch channel {
+		case otpChannelEmail:
+			err = sendOTPEmail(ctx, req, code)
+		case otpChannelWhatsApp:
+			err = sendOTPWhatsApp(ctx, req, code)
+		}
+		if err == nil {
+			return channel, nil
+		}
+		slog.Warn("OTP delivery failed", "channel", channel, "error", err)
+		failures[channel] = "delivery failed"
+		if errors.Is(err, context.DeadlineExceeded) {
+			failures[channel] = "timed out"
+		}
+	}
+	return "", failures
+}
+
+func sendOTPEmail(ctx context.Context, req OTPRequest, code otp.Code) error {
+	if mailClient == nil {
+		return fmt.Errorf("mail service is not configured")
+	}
+	rendered, err := mailer.RenderOTP(code.Value, mailer.OtpPurpose(req.Purpose), req.Locale)
+	if err != nil {
+		return err
+	}
+	emailData := mailer.EmailData{To: []string{req.Email}}
+	rendered.Apply(&emailData)
+	_, err = mailClient.SendContext(ctx, emailData)
+	return err
+}
+
+func sendOTPWhatsApp(ctx context.Context, req OTPRequest, code otp.Code) error {
+	if !whatsapp.IsConnected() {
+		return fmt.Errorf("whatsapp client is not connected")
+	}
+	message, err := mailer.RenderWhatsAppOTP(code.Value, mailer.OtpPurpose(req.Purpose), req.Locale)
+	if err != nil {
+		return err
+	}
+	return whatsapp.SendMessage(ctx, req.PhoneNumber, message)
+}
+
+// VerifyOTP handler - POST /api/v1/otp/verify - checks and uses up a code
+func VerifyOTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req OTPVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	if otpService == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "OTP service is not configured",
+		})
+		return
+	}
+
+	if err := otpService.Verify(r.Context(), otpRecipient(req.Email, req.PhoneNumber), req.Purpose, req.Code); err != nil {
+		writeOTPError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "OTP verified successfully",
+	})
+}
+
+// writeOTPError writes the response for an error of the OTP or two-factor
+// service: 401 for a wrong, expired, reused or missing code, 429 for
+// cooldowns and lockouts, with a Retry-After header, and 404 or 409 when
+// two-factor authentication is not or already enabled
+func writeOTPError(w http.ResponseWriter, err error) {
+	var otpErr *otp.Error
+	if !errors.As(err, &otpErr) {
+		slog.Error("OTP service failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "OTP service failed",
+		})
+		return
+	}
+
+	data := map[string]any{"error": otpErr.Error()}
+	status := http.StatusUnauthorized
+	switch {
+	case errors.Is(err, otp.ErrLocked), errors.Is(err, otp.ErrCooldown):
+		status = http.StatusTooManyRequests
+		seconds := int(math.Ceil(otpErr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		data["retry_after"] = seconds
+	case errors.Is(err, otp.ErrNotEnrolled):
+		status = http.StatusNotFound
+	case errors.Is(err, otp.ErrAlreadyEnrolled):
+		status = http.StatusConflict
+	case errors.Is(err, otp.ErrInvalidCode):
+		data["attempts_left"] = otpErr.AttemptsLeft
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Response{
+		Success: false,
+		Message: "OTP rejected",
+		Data:    data,
+	})
+}
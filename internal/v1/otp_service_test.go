@@ -0,0 +1,79 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/imrany/whats-email/pkg/mailer"
+	"github.com/imrany/whats-email/pkg/otp"
+)
+
+// useOTPService points the shared OTP service at a new database for the test
+func useOTPService(t *testing.T) {
+	t.Helper()
+	service, err := otp.Open(context.Background(), filepath.Join(t.TempDir(), "otp.db"), otp.Config{})
+	if err != nil {
+		t.Fatalf("otp.Open: %v", err)
+	}
+	previous := otpService
+	otpService = service
+	t.Cleanup(func() {
+		otpService = previous
+		service.Close()
+	})
+}
+
+// postOTP calls an OTP handler with a JSON body and returns the status
+func postOTP(t *testing.T, handler http.HandlerFunc, body any) int {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(data))))
+	return w.Code
+}
+
+// otpCodePattern finds the code on its own line in the text of an OTP email
+var otpCodePattern = regexp.MustCompile(`(?m)^ +([0-9]{6})\r?$`)
+
+func TestVerifyOTPTakesTheRequestIdentifiers(t *testing.T) {
+	transport := &mailer.MemoryTransport{}
+	useMailTransport(t, transport)
+	useOTPService(t)
+
+	// Both identifiers are given, only email delivers the code
+	request := OTPRequest{Email: "amina@example.com", PhoneNumber: "254712345678", Channels: []string{"email"}, Purpose: "login"}
+	if code := postOTP(t, RequestOTP, request); code != http.StatusOK {
+		t.Fatalf("RequestOTP = %d, want 200", code)
+	}
+	messages := transport.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("%d emails sent, want 1", len(messages))
+	}
+	match := otpCodePattern.FindSubmatch(messages[0].Data)
+	if match == nil {
+		t.Fatalf("no code in the email:\n%s", messages[0].Data)
+	}
+	code := string(match[1])
+
+	for _, verify := range []OTPVerifyRequest{
+		{Email: request.Email, Purpose: "login", Code: code},
+		{PhoneNumber: request.PhoneNumber, Purpose: "login", Code: code},
+	} {
+		if status := postOTP(t, VerifyOTP, verify); status != http.StatusUnauthorized {
+			t.Errorf("VerifyOTP with %+v = %d, want 401", verify, status)
+		}
+	}
+	verify := OTPVerifyRequest{Email: request.Email, PhoneNumber: request.PhoneNumber, Purpose: "login", Code: code}
+	if status := postOTP(t, VerifyOTP, verify); status != http.StatusOK {
+		t.Errorf("VerifyOTP with both identifiers = %d, want 200", status)
+	}
+}
@@ -0,0 +1,361 @@
+package v1
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/imrany/whats-email/pkg/whatsapp"
+	"go.mau.fi/whatsmeow"
+)
+
+// pairingCodeWait is how long starting a pairing waits for the first QR code
+const pairingCodeWait = 15 * time.Second
+
+// pairingData returns a pairing status with its QR code rendered as a PNG
+// data URI and an SVG document
+func pairingData(status whatsapp.PairingStatus) (map[string]any, error) {
+	data := map[string]any{"state": status.State}
+	if !status.UpdatedAt.IsZero() {
+		data["updated_at"] = status.UpdatedAt.UTC()
+	}
+	switch status.State {
+	case whatsapp.PairingWaiting:
+		if status.Code == "" {
+			break
+		}
+		png, err := whatsapp.QRCodePNG(status.Code)
+		if err != nil {
+			return nil, err
+		}
+		svg, err := whatsapp.QRCodeSVG(status.Code)
+		if err != nil {
+			return nil, err
+		}
+		data["code"] = status.Code
+		data["expires_at"] = status.ExpiresAt.UTC()
+		data["qr_png"] = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+		data["qr_svg"] = string(svg)
+		if status.PairingCode != "" {
+			data["pairing_code"] = status.PairingCode
+			data["phone_number"] = status.PhoneNumber
+		}
+	case whatsapp.PairingPaired:
+		data["jid"] = status.JID
+	case whatsapp.PairingFailed:
+		data["error"] = status.Error
+	}
+	return data, nil
+}
+
+// writePairingStatus writes a pairing status as a JSON response
+func writePairingStatus(w http.ResponseWriter, message string, status whatsapp.PairingStatus) {
+	data, err := pairingData(status)
+	if err != nil {
+		slog.Error("Failed to render WhatsApp QR code", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Failed to render QR code",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: message,
+		Data:    data,
+	})
+}
+
+// StartWhatsAppPairing handler - POST /api/v1/whatsapp/sessions/{session}/pair
+// - starts linking a session to a phone and returns the first QR code to scan
+func StartWhatsAppPairing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, ok := whatsAppSession(w, chi.URLParam(r, "session"))
+	if !ok {
+		return
+	}
+
+	events, stop := session.SubscribePairing()
+	defer stop()
+
+	err := session.StartPairing()
+	switch {
+	case errors.Is(err, whatsapp.ErrAlreadyPaired):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "WhatsApp session is already paired",
+		})
+		return
+	case err != nil:
+		slog.Error("Failed to start WhatsApp pairing", "session", session.ID, "error", err)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Failed to start pairing",
+		})
+		return
+	}
+
+	// The first code comes once WhatsApp answers the connection
+	if session.PairingStatus().Code == "" {
+		timer := time.NewTimer(pairingCodeWait)
+		defer timer.Stop()
+	wait:
+		for {
+			select {
+			case evt := <-events:
+				if evt.Event == whatsapp.PairingEventCode || evt.Done() {
+					break wait
+				}
+			case <-timer.C:
+				break wait
+			case <-r.Context().Done():
+				break wait
+			}
+		}
+	}
+
+	writePairingStatus(w, "Scan the QR code with WhatsApp to pair the session", session.PairingStatus())
+}
+
+// WhatsAppPhonePairingRequest asks for a pairing code for a phone number
+type WhatsAppPhonePairingRequest struct {
+	PhoneNumber string `json:"phone_number"`
+}
+
+// Validate checks the request and returns one FieldError per invalid field
+func (req WhatsAppPhonePairingRequest) Validate() []FieldError {
+	switch {
+	case strings.TrimSpace(req.PhoneNumber) == "":
+		return []FieldError{{Field: "phone_number", Message: "phone_number is required"}}
+	case !phoneNumberPattern.MatchString(req.PhoneNumber):
+		return []FieldError{{Field: "phone_number", Message: "phone_number must be digits with the country code and no +, e.g. 254712345678"}}
+	}
+	return nil
+}
+
+// PairWhatsAppPhone handler - POST /api/v1/whatsapp/sessions/{session}/pair/phone
+// - links a session to a phone with an 8-character code typed into the phone
+// instead of a QR code
+func PairWhatsAppPhone(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req WhatsAppPhonePairingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	session, ok := whatsAppSession(w, chi.URLParam(r, "session"))
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), pairingCodeWait)
+	defer cancel()
+	code, err := session.PairPhone(ctx, req.PhoneNumber)
+	switch {
+	case errors.Is(err, whatsapp.ErrAlreadyPaired):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "WhatsApp session is already paired",
+		})
+		return
+	case errors.Is(err, whatsmeow.ErrPhoneNumberTooShort), errors.Is(err, whatsmeow.ErrPhoneNumberIsNotInternational):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    []FieldError{{Field: "phone_number", Message: err.Error()}},
+		})
+		return
+	case err != nil:
+		slog.Error("Failed to get WhatsApp pairing code", "session", session.ID, "error", err)
+		status := http.StatusBadGateway
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Failed to get pairing code",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Enter the pairing code on the phone under Linked Devices → Link with phone number instead",
+		Data: map[string]any{
+			"pairing_code": code,
+			"phone_number": req.PhoneNumber,
+		},
+	})
+}
+
+// GetWhatsAppPairing handler - GET /api/v1/whatsapp/sessions/{session}/pair -
+// returns where the pairing of a session stands, with the current QR code
+func GetWhatsAppPairing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, ok := whatsAppSession(w, chi.URLParam(r, "session"))
+	if !ok {
+		return
+	}
+
+	writePairingStatus(w, "WhatsApp pairing status retrieved", session.PairingStatus())
+}
+
+// GetWhatsAppPairingQR handler - GET /api/v1/whatsapp/sessions/{session}/pair/qr
+// - returns the current QR code as an image. format is png, the default, svg
+// or text for the raw code.
+func GetWhatsAppPairingQR(w http.ResponseWriter, r *http.Request) {
+	session, ok := whatsAppSession(w, chi.URLParam(r, "session"))
+	if !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "png" && format != "svg" && format != "text" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    []FieldError{{Field: "format", Message: "format must be png, svg or text"}},
+		})
+		return
+	}
+
+	status := session.PairingStatus()
+	if status.State != whatsapp.PairingWaiting || status.Code == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "No QR code to scan, start a pairing first",
+			Data:    map[string]any{"state": status.State},
+		})
+		return
+	}
+
+	var body []byte
+	var err error
+	switch format {
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		body, err = whatsapp.QRCodeSVG(status.Code)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		body = []byte(status.Code)
+	default:
+		w.Header().Set("Content-Type", "image/png")
+		body, err = whatsapp.QRCodePNG(status.Code)
+	}
+	if err != nil {
+		slog.Error("Failed to render WhatsApp QR code", "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Failed to render QR code",
+		})
+		return
+	}
+
+	// Codes are replaced every 20 seconds
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Expires", status.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Write(body)
+}
+
+// StreamWhatsAppPairing handler - GET /api/v1/whatsapp/sessions/{session}/pair/events
+// - streams the pairing of a session as server-sent events: the current
+// status, then a code event per QR code and a success, timeout or error event
+// that ends the stream
+func StreamWhatsAppPairing(w http.ResponseWriter, r *http.Request) {
+	session, ok := whatsAppSession(w, chi.URLParam(r, "session"))
+	if !ok {
+		return
+	}
+
+	events, stop := session.SubscribePairing()
+	defer stop()
+
+	// The stream lasts as long as the pairing, past the server write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Warn("Failed to clear write deadline for pairing events", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	status := session.PairingStatus()
+	if !writeServerEvent(w, rc, "status", status) {
+		return
+	}
+	if status.State == whatsapp.PairingPaired {
+		return
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case evt := <-events:
+			if !writeServerEvent(w, rc, evt.Event, evt) || evt.Done() {
+				return
+			}
+		}
+	}
+}
+
+// writeServerEvent writes a server-sent event with a JSON payload and
+// flushes it, reporting whether the client is still there
+func writeServerEvent(w http.ResponseWriter, rc *http.ResponseController, event string, payload any) bool {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to encode server-sent event", "event", event, "error", err)
+		return false
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return false
+	}
+	return rc.Flush() == nil
+}
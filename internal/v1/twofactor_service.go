@@ -0,0 +1,336 @@
+package v1
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/imrany/whats-email/pkg/otp"
+	"github.com/spf13/viper"
+)
+
+// twoFactor enrolls and verifies authenticator app second factors, set by
+// InitTwoFactor
+var twoFactor *otp.TwoFactor
+
+// InitTwoFactor sets up the two-factor store in the OTP database from the
+// viper configuration. It needs InitOTP to have succeeded.
+func InitTwoFactor(ctx context.Context) error {
+	if otpDB == nil {
+		return fmt.Errorf("failed to initialize two-factor store: OTP database is not open")
+	}
+
+	store, err := otp.NewTwoFactor(ctx, otpDB, otp.TwoFactorConfig{
+		Issuer:        viper.GetString("TWOFA_ISSUER"),
+		Window:        viper.GetInt("TWOFA_WINDOW"),
+		LookAhead:     viper.GetInt("TWOFA_LOOK_AHEAD"),
+		RecoveryCodes: viper.GetInt("TWOFA_RECOVERY_CODES"),
+		MaxAttempts:   viper.GetInt("OTP_MAX_ATTEMPTS"),
+		Lockout:       viper.GetDuration("OTP_LOCKOUT"),
+		EncryptionKey: []byte(viper.GetString("TWOFA_ENCRYPTION_KEY")),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize two-factor store: %w", err)
+	}
+	if viper.GetString("TWOFA_ENCRYPTION_KEY") == "" {
+		slog.Warn("TWOFA_ENCRYPTION_KEY is not set, two-factor secrets are encrypted with a key stored next to them")
+	}
+
+	twoFactor = store
+	return nil
+}
+
+// TwoFactorEnrollRequest starts an enrollment. Type is totp, the default,
+// or hotp. Account is the name shown in the authenticator app, the user ID
+// when empty.
+type TwoFactorEnrollRequest struct {
+	User    string `json:"user"`
+	Type    string `json:"type"`
+	Account string `json:"account"`
+}
+
+// Validate checks the request and returns one FieldError per invalid field
+func (req TwoFactorEnrollRequest) Validate() []FieldError {
+	errs := validateTwoFactorUser(req.User)
+	if req.Type != "" && req.Type != string(otp.TOTP) && req.Type != string(otp.HOTP) {
+		errs = append(errs, FieldError{Field: "type", Message: "type must be totp or hotp"})
+	}
+	if strings.Contains(req.Account, ":") {
+		errs = append(errs, FieldError{Field: "account", Message: "account must not contain a colon"})
+	}
+	return errs
+}
+
+// TwoFactorCodeRequest carries a code from the authenticator app of a user.
+// Verification also accepts a recovery code instead.
+type TwoFactorCodeRequest struct {
+	User         string `json:"user"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// Validate checks the request and returns one FieldError per invalid field.
+// recovery tells whether a recovery code may be given instead of a code.
+func (req TwoFactorCodeRequest) Validate(recovery bool) []FieldError {
+	errs := validateTwoFactorUser(req.User)
+	code, recoveryCode := strings.TrimSpace(req.Code), strings.TrimSpace(req.RecoveryCode)
+	switch {
+	case !recovery && recoveryCode != "":
+		errs = append(errs, FieldError{Field: "recovery_code", Message: "recovery_code is not accepted here"})
+	case code != "" && recoveryCode != "":
+		errs = append(errs, FieldError{Field: "recovery_code", Message: "recovery_code must be empty when a code is given"})
+	case code == "" && recoveryCode == "" && recovery:
+		errs = append(errs, FieldError{Field: "code", Message: "code or recovery_code is required"})
+	case code == "" && recoveryCode == "":
+		errs = append(errs, FieldError{Field: "code", Message: "code is required"})
+	}
+	return errs
+}
+
+// TwoFactorUserRequest names the user of a request
+type TwoFactorUserRequest struct {
+	User string `json:"user"`
+}
+
+func validateTwoFactorUser(user string) []FieldError {
+	switch {
+	case strings.TrimSpace(user) == "":
+		return []FieldError{{Field: "user", Message: "user is required"}}
+	case len(user) > 256:
+		return []FieldError{{Field: "user", Message: "user must be at most 256 bytes"}}
+	}
+	return nil
+}
+
+// decodeTwoFactorRequest decodes and validates the body of a two-factor
+// request into req, writing the error response when it fails
+func decodeTwoFactorRequest(w http.ResponseWriter, r *http.Request, req any, validate func() []FieldError) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return false
+	}
+
+	if errs := validate(); len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return false
+	}
+
+	return twoFactorAvailable(w)
+}
+
+// twoFactorAvailable writes a 503 response when the two-factor store is
+// not configured
+func twoFactorAvailable(w http.ResponseWriter) bool {
+	if twoFactor == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Two-factor service is not configured",
+		})
+		return false
+	}
+	return true
+}
+
+// EnrollTwoFactor handler - POST /api/v1/2fa/enroll - generates an
+// authenticator key and returns it as an otpauth:// URI and QR code
+func EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req TwoFactorEnrollRequest
+	if !decodeTwoFactorRequest(w, r, &req, func() []FieldError { return req.Validate() }) {
+		return
+	}
+
+	keyType := otp.TOTP
+	if req.Type != "" {
+		keyType = otp.KeyType(req.Type)
+	}
+	key, err := twoFactor.Enroll(r.Context(), req.User, keyType, req.Account)
+	if err != nil {
+		writeOTPError(w, err)
+		return
+	}
+	png, err := key.QRCode()
+	if err != nil {
+		slog.Error("Failed to render two-factor QR code", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Failed to render QR code",
+		})
+		return
+	}
+
+	data := map[string]any{
+		"type":      key.Type,
+		"secret":    key.EncodedSecret(),
+		"uri":       key.URI(),
+		"qr_code":   "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		"algorithm": key.Algorithm,
+		"digits":    key.Digits,
+	}
+	if key.Type == otp.TOTP {
+		data["period"] = int(key.Period.Seconds())
+	} else {
+		data["counter"] = key.Counter
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Scan the QR code and confirm with a code to enable two-factor authentication",
+		Data:    data,
+	})
+}
+
+// ConfirmTwoFactor handler - POST /api/v1/2fa/confirm - enables an enrolled
+// key with a first code and returns the recovery codes
+func ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req TwoFactorCodeRequest
+	if !decodeTwoFactorRequest(w, r, &req, func() []FieldError { return req.Validate(false) }) {
+		return
+	}
+
+	codes, err := twoFactor.Confirm(r.Context(), req.User, req.Code)
+	if err != nil {
+		writeOTPError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Two-factor authentication enabled",
+		Data:    map[string]any{"recovery_codes": codes},
+	})
+}
+
+// VerifyTwoFactor handler - POST /api/v1/2fa/verify - checks a code from
+// the authenticator app, or uses up a recovery code
+func VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req TwoFactorCodeRequest
+	if !decodeTwoFactorRequest(w, r, &req, func() []FieldError { return req.Validate(true) }) {
+		return
+	}
+
+	if req.RecoveryCode != "" {
+		left, err := twoFactor.UseRecoveryCode(r.Context(), req.User, req.RecoveryCode)
+		if err != nil {
+			writeOTPError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(Response{
+			Success: true,
+			Message: "Recovery code accepted",
+			Data: map[string]any{
+				"method":              "recovery_code",
+				"recovery_codes_left": left,
+			},
+		})
+		return
+	}
+
+	if err := twoFactor.Verify(r.Context(), req.User, req.Code); err != nil {
+		writeOTPError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Code verified successfully",
+		Data:    map[string]any{"method": "code"},
+	})
+}
+
+// RegenerateRecoveryCodes handler - POST /api/v1/2fa/recovery-codes -
+// replaces the recovery codes of a user
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req TwoFactorUserRequest
+	if !decodeTwoFactorRequest(w, r, &req, func() []FieldError { return validateTwoFactorUser(req.User) }) {
+		return
+	}
+
+	codes, err := twoFactor.RegenerateRecoveryCodes(r.Context(), req.User)
+	if err != nil {
+		writeOTPError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Recovery codes replaced",
+		Data:    map[string]any{"recovery_codes": codes},
+	})
+}
+
+// GetTwoFactorStatus handler - GET /api/v1/2fa/{user} - tells whether a
+// user has two-factor authentication enabled
+func GetTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !twoFactorAvailable(w) {
+		return
+	}
+
+	status, err := twoFactor.Status(r.Context(), chi.URLParam(r, "user"))
+	if err != nil {
+		writeOTPError(w, err)
+		return
+	}
+
+	data := map[string]any{
+		"enabled": status.Enabled,
+		"pending": status.Pending,
+	}
+	if status.Type != "" {
+		data["type"] = status.Type
+	}
+	if status.Enabled {
+		data["enabled_at"] = status.EnabledAt.UTC()
+		data["recovery_codes_left"] = status.RecoveryCodesLeft
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Two-factor status retrieved",
+		Data:    data,
+	})
+}
+
+// DisableTwoFactor handler - DELETE /api/v1/2fa/{user} - removes the key
+// and recovery codes of a user
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !twoFactorAvailable(w) {
+		return
+	}
+
+	if err := twoFactor.Disable(r.Context(), chi.URLParam(r, "user")); err != nil {
+		writeOTPError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Two-factor authentication disabled",
+	})
+}
@@ -0,0 +1,339 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/imrany/whats-email/pkg/webhook"
+	"github.com/imrany/whats-email/pkg/whatsapp"
+	"github.com/spf13/viper"
+)
+
+// webhooks delivers WhatsApp events to the registered webhooks, set by
+// InitWebhooks
+var webhooks *webhook.Dispatcher
+
+// InitWebhooks sets up the webhook store in the OTP database from the viper
+// configuration and forwards the events of the WhatsApp sessions to it. It
+// needs InitOTP to have succeeded, and whatsapp.Init for the events.
+func InitWebhooks(ctx context.Context) error {
+	if otpDB == nil {
+		return fmt.Errorf("failed to initialize webhooks: OTP database is not open")
+	}
+
+	dispatcher, err := webhook.New(ctx, otpDB, webhook.Config{
+		MaxAttempts:    viper.GetInt("WEBHOOK_MAX_ATTEMPTS"),
+		InitialBackoff: viper.GetDuration("WEBHOOK_BACKOFF"),
+		MaxBackoff:     viper.GetDuration("WEBHOOK_MAX_BACKOFF"),
+		Timeout:        viper.GetDuration("WEBHOOK_TIMEOUT"),
+		Retention:      viper.GetDuration("WEBHOOK_RETENTION"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize webhooks: %w", err)
+	}
+	webhooks = dispatcher
+
+	manager := whatsapp.GetManager()
+	if manager == nil {
+		slog.Warn("WhatsApp is not configured, webhooks will not receive WhatsApp events")
+		return nil
+	}
+	// Handlers run on the event loop of the session, which must not wait
+	// for the database
+	manager.AddEventHandler(func(evt whatsapp.Event) {
+		if !dispatcher.Enqueue(evt.Type, evt.Data) {
+			slog.Warn("Webhook event queue is full, dropping event", "event", evt.Type)
+		}
+	})
+	return nil
+}
+
+// CloseWebhooks stops delivering webhooks once the queued events are stored.
+// Pending deliveries resume on the next start. It must run before CloseOTP.
+func CloseWebhooks() {
+	if webhooks != nil {
+		webhooks.Close()
+	}
+}
+
+// WebhookRequest registers a webhook. Events lists the event types it
+// receives, all when empty. Secret signs the payloads, generated when empty.
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// Validate checks the request and returns one FieldError per invalid field
+func (req WebhookRequest) Validate() []FieldError {
+	var errs []FieldError
+
+	if strings.TrimSpace(req.URL) == "" {
+		errs = append(errs, FieldError{Field: "url", Message: "url is required"})
+	} else if err := webhook.ValidateURL(req.URL); err != nil {
+		errs = append(errs, FieldError{Field: "url", Message: "url must be an absolute http or https URL"})
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(whatsapp.EventTypes, event) {
+			errs = append(errs, FieldError{
+				Field:   "events",
+				Message: fmt.Sprintf("unknown event %q, events must be among %s", event, strings.Join(whatsapp.EventTypes, ", ")),
+			})
+			break
+		}
+	}
+	if req.Secret != "" && len(req.Secret) < 16 {
+		errs = append(errs, FieldError{Field: "secret", Message: "secret must be at least 16 characters"})
+	}
+
+	return errs
+}
+
+// webhooksAvailable writes a 503 response when webhooks are not configured
+func webhooksAvailable(w http.ResponseWriter) bool {
+	if webhooks == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Webhooks are not configured",
+		})
+		return false
+	}
+	return true
+}
+
+// writeWebhookError writes the response for a failed webhook store call
+func writeWebhookError(w http.ResponseWriter, message string, err error) {
+	switch {
+	case errors.Is(err, webhook.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Webhook not found",
+		})
+	case errors.Is(err, webhook.ErrDeliveryNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Delivery not found",
+		})
+	default:
+		slog.Error(message, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: message,
+		})
+	}
+}
+
+// CreateWebhook handler - POST /api/v1/webhooks - registers a webhook and
+// returns it with its signing secret, which is not shown again
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	if !webhooksAvailable(w) {
+		return
+	}
+
+	hook, err := webhooks.Create(r.Context(), req.URL, req.Events, req.Secret)
+	if err != nil {
+		writeWebhookError(w, "Failed to create webhook", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Webhook created, store the secret to verify signatures",
+		Data: map[string]any{
+			"webhook": hook,
+			"secret":  hook.Secret,
+		},
+	})
+}
+
+// ListWebhooks handler - GET /api/v1/webhooks - lists the webhooks
+func ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !webhooksAvailable(w) {
+		return
+	}
+
+	hooks, err := webhooks.List(r.Context())
+	if err != nil {
+		writeWebhookError(w, "Failed to list webhooks", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Webhooks retrieved",
+		Data:    hooks,
+	})
+}
+
+// GetWebhook handler - GET /api/v1/webhooks/{id} - returns a webhook
+func GetWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !webhooksAvailable(w) {
+		return
+	}
+
+	hook, err := webhooks.Get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeWebhookError(w, "Failed to get webhook", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Webhook retrieved",
+		Data:    hook,
+	})
+}
+
+// DeleteWebhook handler - DELETE /api/v1/webhooks/{id} - removes a webhook
+// with its pending and past deliveries
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !webhooksAvailable(w) {
+		return
+	}
+
+	if err := webhooks.Delete(r.Context(), chi.URLParam(r, "id")); err != nil {
+		writeWebhookError(w, "Failed to delete webhook", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Webhook deleted",
+	})
+}
+
+// ListWebhookDeliveries handler - GET /api/v1/webhooks/{id}/deliveries -
+// lists the latest deliveries of a webhook, newest first. status filters
+// them by pending, delivered or failed, and limit caps them, 50 by default
+// and at most 200.
+func ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var errs []FieldError
+	status := webhook.DeliveryStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", webhook.StatusPending, webhook.StatusDelivered, webhook.StatusFailed:
+	default:
+		errs = append(errs, FieldError{Field: "status", Message: "status must be pending, delivered or failed"})
+	}
+	limit := 50
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 200 {
+			errs = append(errs, FieldError{Field: "limit", Message: "limit must be between 1 and 200"})
+		}
+		limit = n
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	if !webhooksAvailable(w) {
+		return
+	}
+
+	deliveries, err := webhooks.Deliveries(r.Context(), chi.URLParam(r, "id"), status, limit)
+	if err != nil {
+		writeWebhookError(w, "Failed to list deliveries", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Deliveries retrieved",
+		Data:    deliveries,
+	})
+}
+
+// GetWebhookDelivery handler - GET /api/v1/webhooks/{id}/deliveries/{delivery}
+// - returns a delivery with its payload and every attempt made
+func GetWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !webhooksAvailable(w) {
+		return
+	}
+
+	delivery, attempts, err := webhooks.Delivery(r.Context(), chi.URLParam(r, "id"), chi.URLParam(r, "delivery"))
+	if err != nil {
+		writeWebhookError(w, "Failed to get delivery", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Delivery retrieved",
+		Data: map[string]any{
+			"delivery": delivery,
+			"attempts": attempts,
+		},
+	})
+}
+
+// RetryWebhookDelivery handler - POST /api/v1/webhooks/{id}/deliveries/{delivery}/retry
+// - attempts a delivery again right away, giving a failed one one more attempt
+func RetryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !webhooksAvailable(w) {
+		return
+	}
+
+	if err := webhooks.Retry(r.Context(), chi.URLParam(r, "id"), chi.URLParam(r, "delivery")); err != nil {
+		writeWebhookError(w, "Failed to retry delivery", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Delivery queued",
+	})
+}
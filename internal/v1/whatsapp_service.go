@@ -2,18 +2,70 @@ package v1
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
+	"strings"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/imrany/whats-email/pkg/mailer"
 	"github.com/imrany/whats-email/pkg/whatsapp"
 )
 
 type WhatsAppRequest struct {
 	PhoneNumber string `json:"phone_number"`
 	Message     string `json:"message"`
+
+	// Template renders the message from the text body of a mail template
+	// instead, in Locale
+	Template        string         `json:"template"`
+	TemplateVersion int            `json:"template_version"`
+	Variables       map[string]any `json:"variables"`
+	Locale          string         `json:"locale"`
+}
+
+// Validate checks the request and returns one FieldError per invalid field
+func (req WhatsAppRequest) Validate() []FieldError {
+	var errs []FieldError
+
+	if strings.TrimSpace(req.PhoneNumber) == "" {
+		errs = append(errs, FieldError{Field: "phone_number", Message: "phone_number is required"})
+	}
+	if req.Template != "" {
+		if req.Message != "" {
+			errs = append(errs, FieldError{Field: "message", Message: "message must be empty when a template is used"})
+		}
+		errs = append(errs, validateLocale(req.Locale)...)
+	} else if strings.TrimSpace(req.Message) == "" {
+		errs = append(errs, FieldError{Field: "message", Message: "message is required"})
+	}
+
+	return errs
+}
+
+// renderMessage renders the text body of the template named in req
+func (req WhatsAppRequest) renderMessage() (string, *FieldError) {
+	tmpl, err := mailer.DefaultTemplates.Lookup(req.Template, req.TemplateVersion)
+	if err != nil {
+		return "", &FieldError{Field: "template", Message: err.Error()}
+	}
+	variables := req.Variables
+	if variables == nil {
+		variables = map[string]any{}
+	}
+	rendered, err := tmpl.RenderLocale(req.Locale, variables)
+	if err != nil {
+		return "", &FieldError{Field: "variables", Message: err.Error()}
+	}
+	if rendered.Text == "" {
+		return "", &FieldError{Field: "template", Message: "template has no text body"}
+	}
+	return strings.TrimSpace(rendered.Text), nil
 }
 
 // SendWhatsAppMessage sends a WhatsApp message using the WhatsApp API - POST /api/v1/whatsapp/send.
+// POST /api/v1/whatsapp/{session}/send sends it from the number of that session
+// instead of the default one.
 func SendWhatsAppMessage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	var req WhatsAppRequest
@@ -28,7 +80,36 @@ func SendWhatsAppMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = whatsapp.SendMessage(r.Context(), req.PhoneNumber, req.Message)
+	if errs := req.Validate(); len(errs) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    errs,
+		})
+		return
+	}
+
+	message := req.Message
+	if req.Template != "" {
+		var fieldErr *FieldError
+		if message, fieldErr = req.renderMessage(); fieldErr != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: "Validation failed",
+				Data:    []FieldError{*fieldErr},
+			})
+			return
+		}
+	}
+
+	session, ok := whatsAppSession(w, chi.URLParam(r, "session"))
+	if !ok {
+		return
+	}
+
+	err = session.SendMessage(r.Context(), req.PhoneNumber, message)
 	if err != nil {
 		slog.Error("Failed to send WhatsApp message", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -45,3 +126,200 @@ func SendWhatsAppMessage(w http.ResponseWriter, r *http.Request) {
 		Message: "WhatsApp message sent successfully",
 	})
 }
+
+// WhatsAppSessionRequest adds a WhatsApp session
+type WhatsAppSessionRequest struct {
+	ID string `json:"id"`
+}
+
+// whatsAppManager returns the WhatsApp session manager, writing a 503
+// response when WhatsApp is not configured
+func whatsAppManager(w http.ResponseWriter) (*whatsapp.Manager, bool) {
+	manager := whatsapp.GetManager()
+	if manager == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "WhatsApp is not configured",
+		})
+		return nil, false
+	}
+	return manager, true
+}
+
+// whatsAppSession returns the session with the given ID, or the default one
+// when id is empty, writing the error response when there is none
+func whatsAppSession(w http.ResponseWriter, id string) (*whatsapp.Session, bool) {
+	manager, ok := whatsAppManager(w)
+	if !ok {
+		return nil, false
+	}
+
+	var session *whatsapp.Session
+	var err error
+	if id == "" {
+		session, err = manager.Default()
+	} else {
+		session, err = manager.Get(id)
+	}
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, whatsapp.ErrSessionNotFound) && id != "" {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "WhatsApp session not found",
+			Data:    map[string]any{"session": id},
+		})
+		return nil, false
+	}
+	return session, true
+}
+
+// ListWhatsAppSessions handler - GET /api/v1/whatsapp/sessions - lists the
+// WhatsApp sessions and their state
+func ListWhatsAppSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	manager, ok := whatsAppManager(w)
+	if !ok {
+		return
+	}
+
+	sessions := manager.List()
+	infos := make([]whatsapp.SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, session.Info())
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "WhatsApp sessions retrieved",
+		Data:    infos,
+	})
+}
+
+// GetWhatsAppSession handler - GET /api/v1/whatsapp/sessions/{session} -
+// returns the state of a WhatsApp session
+func GetWhatsAppSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	session, ok := whatsAppSession(w, chi.URLParam(r, "session"))
+	if !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "WhatsApp session retrieved",
+		Data:    session.Info(),
+	})
+}
+
+// AddWhatsAppSession handler - POST /api/v1/whatsapp/sessions - adds a
+// WhatsApp session and starts pairing it. The QR codes to scan are served by
+// the pairing endpoints of the session.
+func AddWhatsAppSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req WhatsAppSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if strings.TrimSpace(req.ID) == "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    []FieldError{{Field: "id", Message: "id is required"}},
+		})
+		return
+	}
+
+	manager, ok := whatsAppManager(w)
+	if !ok {
+		return
+	}
+
+	session, err := manager.Add(r.Context(), req.ID)
+	switch {
+	case errors.Is(err, whatsapp.ErrSessionExists):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "WhatsApp session already exists",
+		})
+		return
+	case errors.Is(err, whatsapp.ErrInvalidSessionID), errors.Is(err, whatsapp.ErrReservedSessionID):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Validation failed",
+			Data:    []FieldError{{Field: "id", Message: err.Error()}},
+		})
+		return
+	case err != nil:
+		slog.Error("Failed to add WhatsApp session", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Failed to add WhatsApp session",
+		})
+		return
+	}
+
+	if err := session.StartPairing(); err != nil {
+		// The session stays, pairing can be retried with its pair endpoint
+		slog.Error("Failed to start WhatsApp pairing", "session", session.ID, "error", err)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "WhatsApp session added, scan the QR code from its pair endpoint to pair it",
+		Data:    session.Info(),
+	})
+}
+
+// RemoveWhatsAppSession handler - DELETE /api/v1/whatsapp/sessions/{session}
+// - logs a WhatsApp session out and removes it
+func RemoveWhatsAppSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	manager, ok := whatsAppManager(w)
+	if !ok {
+		return
+	}
+
+	err := manager.Remove(r.Context(), chi.URLParam(r, "session"))
+	switch {
+	case errors.Is(err, whatsapp.ErrSessionNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "WhatsApp session not found",
+		})
+		return
+	case err != nil:
+		slog.Error("Failed to remove WhatsApp session", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Failed to remove WhatsApp session",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "WhatsApp session removed",
+	})
+}
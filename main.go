@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -31,28 +32,72 @@ func createServer() *http.Server {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(customMiddleware.CorsMiddleware)
 
 	// Set a timeout value on the request context (ctx), that will signal
 	// when the request has timed out and further processing should be stopped.
-	r.Use(middleware.Timeout(60 * time.Second))
-	r.Use(customMiddleware.CorsMiddleware)
+	// Event streams are left out, they last as long as what they follow.
+	requestTimeout := viper.GetDuration("REQUEST_TIMEOUT")
+	timeout := middleware.Timeout(requestTimeout)
 
 	// Public routes
-	r.Get("/health", v1.HealthHandler)
+	r.With(timeout).Get("/health", v1.HealthHandler)
 
 	// Protected routes
 	r.Route("/api/v1", func(r chi.Router) {
 		// r.Use(middleware.AuthMiddleware) // Add your authentication middleware here
 
-		r.Post("/mailer/send", v1.SendMail)
-		r.Post("/whatsapp/send", v1.SendWhatsAppMessage)
+		r.Get("/whatsapp/sessions/{session}/pair/events", v1.StreamWhatsAppPairing)
+
+		r.Group(func(r chi.Router) {
+			r.Use(timeout)
+
+			r.Post("/mailer/send", v1.SendMail)
+			r.Post("/mailer/invite", v1.SendInvite)
+			r.Get("/mailer/templates", v1.ListMailTemplates)
+			r.Post("/whatsapp/send", v1.SendWhatsAppMessage)
+			r.Post("/whatsapp/{session}/send", v1.SendWhatsAppMessage)
+			r.Get("/whatsapp/chats", v1.ListWhatsAppChats)
+			r.Get("/whatsapp/chats/{jid}/messages", v1.ListWhatsAppMessages)
+			r.Get("/whatsapp/{session}/chats", v1.ListWhatsAppChats)
+			r.Get("/whatsapp/{session}/chats/{jid}/messages", v1.ListWhatsAppMessages)
+			r.Get("/whatsapp/sessions", v1.ListWhatsAppSessions)
+			r.Post("/whatsapp/sessions", v1.AddWhatsAppSession)
+			r.Get("/whatsapp/sessions/{session}", v1.GetWhatsAppSession)
+			r.Delete("/whatsapp/sessions/{session}", v1.RemoveWhatsAppSession)
+			r.Post("/whatsapp/sessions/{session}/pair", v1.StartWhatsAppPairing)
+			r.Get("/whatsapp/sessions/{session}/pair", v1.GetWhatsAppPairing)
+			r.Get("/whatsapp/sessions/{session}/pair/qr", v1.GetWhatsAppPairingQR)
+			r.Post("/whatsapp/sessions/{session}/pair/phone", v1.PairWhatsAppPhone)
+			r.Post("/otp/request", v1.RequestOTP)
+			r.Post("/otp/verify", v1.VerifyOTP)
+			r.Post("/magic-link/request", v1.RequestMagicLink)
+			r.Post("/magic-link/verify", v1.VerifyMagicLink)
+			r.Post("/2fa/enroll", v1.EnrollTwoFactor)
+			r.Post("/2fa/confirm", v1.ConfirmTwoFactor)
+			r.Post("/2fa/verify", v1.VerifyTwoFactor)
+			r.Post("/2fa/recovery-codes", v1.RegenerateRecoveryCodes)
+			r.Get("/2fa/{user}", v1.GetTwoFactorStatus)
+			r.Delete("/2fa/{user}", v1.DisableTwoFactor)
+			r.Post("/webhooks", v1.CreateWebhook)
+			r.Get("/webhooks", v1.ListWebhooks)
+			r.Get("/webhooks/{id}", v1.GetWebhook)
+			r.Delete("/webhooks/{id}", v1.DeleteWebhook)
+			r.Get("/webhooks/{id}/deliveries", v1.ListWebhookDeliveries)
+			r.Get("/webhooks/{id}/deliveries/{delivery}", v1.GetWebhookDelivery)
+			r.Post("/webhooks/{id}/deliveries/{delivery}/retry", v1.RetryWebhookDelivery)
+		})
 	})
 
+	// Past the request timeout, so that the error answering a request that
+	// ran out of time still reaches the client
+	writeTimeout := requestTimeout + 15*time.Second
+
 	srv := &http.Server{
 		Addr:           fmt.Sprintf("%s:%d", viper.GetString("HOST"), viper.GetInt("PORT")),
 		Handler:        r,
 		ReadTimeout:    15 * time.Second,
-		WriteTimeout:   15 * time.Second,
+		WriteTimeout:   writeTimeout,
 		IdleTimeout:    60 * time.Second,
 		MaxHeaderBytes: 1 << 20, // 1 MB
 	}
@@ -65,9 +110,34 @@ func runServer() {
 	port := viper.GetInt("PORT")
 	host := viper.GetString("HOST")
 
-	// Initialize WhatsApp client
+	// Initialize mailer
+	if err := v1.InitMailer(); err != nil {
+		slog.Error("Error initializing mailer", "error", err.Error())
+		slog.Warn("Server will start without email integration")
+	} else {
+		slog.Info("Mailer initialized successfully")
+	}
+
+	// Initialize OTP store
+	if err := v1.InitOTP(context.Background()); err != nil {
+		slog.Error("Error initializing OTP store", "error", err.Error())
+		slog.Warn("Server will start without the OTP service")
+	} else {
+		slog.Info("OTP store initialized successfully")
+	}
+
+	// Initialize two-factor store, in the OTP database
+	if err := v1.InitTwoFactor(context.Background()); err != nil {
+		slog.Error("Error initializing two-factor store", "error", err.Error())
+		slog.Warn("Server will start without two-factor authentication")
+	} else {
+		slog.Info("Two-factor store initialized successfully")
+	}
+
+	// Initialize WhatsApp client. New sessions pair in the background, through
+	// the pairing endpoints, so this does not wait for a QR code scan.
 	slog.Info("Initializing WhatsApp client...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
 	if err := whatsapp.Init(ctx, nil); err != nil {
@@ -77,6 +147,17 @@ func runServer() {
 	} else {
 		slog.Info("WhatsApp client initialized successfully")
 	}
+	if manager := whatsapp.GetManager(); manager != nil {
+		manager.SetDefault(viper.GetString("WHATSAPP_DEFAULT_SESSION"))
+	}
+
+	// Initialize webhooks, in the OTP database, once WhatsApp events can reach them
+	if err := v1.InitWebhooks(context.Background()); err != nil {
+		slog.Error("Error initializing webhooks", "error", err.Error())
+		slog.Warn("Server will start without webhooks")
+	} else {
+		slog.Info("Webhooks initialized successfully")
+	}
 
 	// Start server in goroutine
 	go func() {
@@ -107,6 +188,115 @@ func runServer() {
 	} else {
 		slog.Info("Server exited cleanly")
 	}
+
+	// Close pooled SMTP sessions, webhooks and the OTP and two-factor stores once in-flight requests are done
+	v1.CloseMailer()
+	v1.CloseWebhooks()
+	v1.CloseOTP()
+}
+
+// pairPhone links a WhatsApp session to the phone of phoneNumber with a
+// pairing code, adding the session when it does not exist yet, and waits
+// until the code is entered
+func pairPhone(sessionID, phoneNumber string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	manager, session, err := openPairingSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+
+	events, stop := session.SubscribePairing()
+	defer stop()
+
+	codeCtx, codeCancel := context.WithTimeout(ctx, time.Minute)
+	defer codeCancel()
+	code, err := session.PairPhone(codeCtx, phoneNumber)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n=== WhatsApp Pairing Code (session %s) ===\n", session.ID)
+	fmt.Printf("\n    %s\n\n", code)
+	fmt.Println("On the phone, open WhatsApp → Settings → Linked Devices → Link a Device")
+	fmt.Println("→ Link with phone number instead, and enter the code above.")
+
+	return waitPaired(ctx, session, events, "the code was not entered")
+}
+
+// pairQR links a WhatsApp session by QR code, printing the codes to the
+// terminal, adding the session when it does not exist yet, and waits until
+// one is scanned
+func pairQR(sessionID string) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	manager, session, err := openPairingSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+	manager.SetPrintQR(true)
+
+	events, stop := session.SubscribePairing()
+	defer stop()
+	if err := session.StartPairing(); err != nil {
+		return err
+	}
+	return waitPaired(ctx, session, events, "no QR code was scanned")
+}
+
+// openPairingSession opens the WhatsApp sessions and returns the one to
+// pair, adding it when it does not exist yet
+func openPairingSession(ctx context.Context, sessionID string) (*whatsapp.Manager, *whatsapp.Session, error) {
+	manager, err := whatsapp.Open(ctx, "whatsapp.db")
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := manager.Get(sessionID)
+	if errors.Is(err, whatsapp.ErrSessionNotFound) {
+		session, err = manager.Add(ctx, sessionID)
+	}
+	if err != nil {
+		manager.Close()
+		return nil, nil, err
+	}
+	return manager, session, nil
+}
+
+// waitPaired waits for the pairing of a session to end, timedOut telling
+// why it timed out
+func waitPaired(ctx context.Context, session *whatsapp.Session, events <-chan whatsapp.PairingEvent, timedOut string) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case evt := <-events:
+			switch evt.Event {
+			case whatsapp.PairingEventSuccess:
+				slog.Info("WhatsApp session paired", "session", session.ID, "jid", evt.JID)
+				return nil
+			case whatsapp.PairingEventTimeout:
+				return fmt.Errorf("pairing timed out, %s", timedOut)
+			case whatsapp.PairingEventError:
+				return fmt.Errorf("pairing failed: %s", evt.Error)
+			}
+		}
+	}
+}
+
+// pairingSession returns the session named by the --session flag of a
+// pairing command, WHATSAPP_DEFAULT_SESSION or default when it is empty
+func pairingSession(cmd *cobra.Command) string {
+	session, _ := cmd.Flags().GetString("session")
+	if session == "" {
+		session = viper.GetString("WHATSAPP_DEFAULT_SESSION")
+	}
+	if session == "" {
+		session = "default"
+	}
+	return session
 }
 
 func main() {
@@ -127,23 +317,140 @@ func main() {
 		},
 	}
 
+	// pair-phone command
+	var pairPhoneCmd = &cobra.Command{
+		Use:   "pair-phone <phone-number>",
+		Short: "Link a WhatsApp session with a pairing code",
+		Long: "Link a WhatsApp session to a phone with an 8-character pairing code instead of a QR code.\n" +
+			"The phone number is in international format without the +, e.g. 254712345678.\n" +
+			"Stop the server first, it only loads sessions when it starts.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pairPhone(pairingSession(cmd), args[0])
+		},
+	}
+	pairPhoneCmd.Flags().String("session", "", "Session to pair, WHATSAPP_DEFAULT_SESSION or default when empty")
+	rootCmd.AddCommand(pairPhoneCmd)
+
+	// pair command
+	var pairCmd = &cobra.Command{
+		Use:   "pair",
+		Short: "Link a WhatsApp session by QR code in the terminal",
+		Long: "Link a WhatsApp session by scanning the QR codes printed to the terminal.\n" +
+			"Stop the server first, it only loads sessions when it starts.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pairQR(pairingSession(cmd))
+		},
+	}
+	pairCmd.Flags().String("session", "", "Session to pair, WHATSAPP_DEFAULT_SESSION or default when empty")
+	rootCmd.AddCommand(pairCmd)
+
 	// flags
 	rootCmd.PersistentFlags().Int("port", 8080, "Port to listen on")
 	rootCmd.PersistentFlags().String("host", "0.0.0.0", "Host to listen on")
+	rootCmd.PersistentFlags().Duration("REQUEST_TIMEOUT", 60*time.Second, "Time an API request may take, SMTP_TIMEOUT must be shorter (env: REQUEST_TIMEOUT)")
+	rootCmd.PersistentFlags().String("MAIL_TRANSPORT", "smtp", "Mail transport: smtp, sendmail, file or memory (env: MAIL_TRANSPORT)")
+	rootCmd.PersistentFlags().String("MAIL_SENDMAIL_PATH", "/usr/sbin/sendmail", "sendmail binary for the sendmail transport (env: MAIL_SENDMAIL_PATH)")
+	rootCmd.PersistentFlags().String("MAIL_FILE_DIR", "mail", "Output directory for the file transport (env: MAIL_FILE_DIR)")
+	rootCmd.PersistentFlags().String("MAIL_TEMPLATES_DIR", "", "Directory of mail templates, overriding the built-in ones (env: MAIL_TEMPLATES_DIR)")
 	rootCmd.PersistentFlags().String("SMTP_HOST", "smtp.gmail.com", "SMTP HOST (env: SMTP_HOST)")
 	rootCmd.PersistentFlags().Int("SMTP_PORT", 587, "SMTP PORT (env: SMTP_PORT)")
 	rootCmd.PersistentFlags().String("SMTP_USERNAME", "", "SMTP Username (env: SMTP_USERNAME)")
 	rootCmd.PersistentFlags().String("SMTP_PASSWORD", "", "SMTP Password (env: SMTP_PASSWORD)")
 	rootCmd.PersistentFlags().String("SMTP_EMAIL", "", "SMTP Email (env: SMTP_EMAIL)")
+	rootCmd.PersistentFlags().String("SMTP_FROM_NAME", "", "SMTP sender display name (env: SMTP_FROM_NAME)")
+	rootCmd.PersistentFlags().String("SMTP_TLS_MODE", "", "SMTP TLS mode: implicit, starttls-required, starttls-opportunistic or none (env: SMTP_TLS_MODE)")
+	rootCmd.PersistentFlags().String("SMTP_CA_FILE", "", "SMTP CA bundle path (env: SMTP_CA_FILE)")
+	rootCmd.PersistentFlags().String("SMTP_CERT_FILE", "", "SMTP client certificate path (env: SMTP_CERT_FILE)")
+	rootCmd.PersistentFlags().String("SMTP_KEY_FILE", "", "SMTP client certificate key path (env: SMTP_KEY_FILE)")
+	rootCmd.PersistentFlags().String("SMTP_TLS_MIN_VERSION", "1.2", "SMTP minimum TLS version (env: SMTP_TLS_MIN_VERSION)")
+	rootCmd.PersistentFlags().String("SMTP_AUTH", "", "SMTP auth mechanism: PLAIN, LOGIN, CRAM-MD5, XOAUTH2 or NONE, empty to negotiate (env: SMTP_AUTH)")
+	rootCmd.PersistentFlags().String("SMTP_OAUTH2_TOKEN_URL", "", "OAuth2 token endpoint for XOAUTH2 (env: SMTP_OAUTH2_TOKEN_URL)")
+	rootCmd.PersistentFlags().String("SMTP_OAUTH2_CLIENT_ID", "", "OAuth2 client ID for XOAUTH2 (env: SMTP_OAUTH2_CLIENT_ID)")
+	rootCmd.PersistentFlags().String("SMTP_OAUTH2_CLIENT_SECRET", "", "OAuth2 client secret for XOAUTH2 (env: SMTP_OAUTH2_CLIENT_SECRET)")
+	rootCmd.PersistentFlags().String("SMTP_OAUTH2_REFRESH_TOKEN", "", "OAuth2 refresh token for XOAUTH2 (env: SMTP_OAUTH2_REFRESH_TOKEN)")
+	rootCmd.PersistentFlags().String("SMTP_OAUTH2_ACCESS_TOKEN", "", "Static OAuth2 access token for XOAUTH2 (env: SMTP_OAUTH2_ACCESS_TOKEN)")
+	rootCmd.PersistentFlags().Int("SMTP_POOL_SIZE", 4, "Maximum pooled SMTP connections (env: SMTP_POOL_SIZE)")
+	rootCmd.PersistentFlags().Duration("SMTP_POOL_IDLE_TIMEOUT", 30*time.Second, "Idle time after which pooled SMTP connections are re-dialed (env: SMTP_POOL_IDLE_TIMEOUT)")
+	rootCmd.PersistentFlags().Duration("SMTP_TIMEOUT", 30*time.Second, "Timeout for the SMTP dial and each SMTP command (env: SMTP_TIMEOUT)")
+	rootCmd.PersistentFlags().String("DKIM_DOMAIN", "", "DKIM signing domain (env: DKIM_DOMAIN)")
+	rootCmd.PersistentFlags().String("DKIM_SELECTOR", "", "DKIM selector (env: DKIM_SELECTOR)")
+	rootCmd.PersistentFlags().String("DKIM_PRIVATE_KEY_PATH", "", "DKIM PEM private key path, RSA or Ed25519 (env: DKIM_PRIVATE_KEY_PATH)")
+	rootCmd.PersistentFlags().String("DB_PATH", "app.db", "SQLite database for OTP codes and two-factor keys (env: DB_PATH)")
+	rootCmd.PersistentFlags().String("OTP_SECRET", "", "Key for hashing OTP codes, generated and stored in DB_PATH when empty (env: OTP_SECRET)")
+	rootCmd.PersistentFlags().Int("OTP_LENGTH", 6, "OTP code length (env: OTP_LENGTH)")
+	rootCmd.PersistentFlags().String("OTP_ALPHABET", "digits", "OTP code characters: digits, alphanumeric or a custom set (env: OTP_ALPHABET)")
+	rootCmd.PersistentFlags().Int("OTP_MAX_ATTEMPTS", 5, "Failed OTP and two-factor verifications before a lockout (env: OTP_MAX_ATTEMPTS)")
+	rootCmd.PersistentFlags().Duration("OTP_LOCKOUT", 15*time.Minute, "OTP and two-factor lockout after too many failed verifications (env: OTP_LOCKOUT)")
+	rootCmd.PersistentFlags().Duration("OTP_RESEND_COOLDOWN", time.Minute, "Minimum time between OTP codes for a recipient and purpose (env: OTP_RESEND_COOLDOWN)")
+	rootCmd.PersistentFlags().String("OTP_PURPOSES", "", "Comma-separated custom OTP purposes besides the built-in ones (env: OTP_PURPOSES)")
+	rootCmd.PersistentFlags().String("MAGIC_LINK_URL", "", "Page magic links point to, with the token added as ?token= (env: MAGIC_LINK_URL)")
+	rootCmd.PersistentFlags().String("TWOFA_ISSUER", "", "Service name shown in authenticator apps (env: TWOFA_ISSUER)")
+	rootCmd.PersistentFlags().String("TWOFA_ENCRYPTION_KEY", "", "Key for encrypting two-factor secrets, generated and stored in DB_PATH when empty (env: TWOFA_ENCRYPTION_KEY)")
+	rootCmd.PersistentFlags().Int("TWOFA_WINDOW", 1, "TOTP steps accepted before and after the current one (env: TWOFA_WINDOW)")
+	rootCmd.PersistentFlags().Int("TWOFA_LOOK_AHEAD", 10, "HOTP counter values accepted ahead of the expected one (env: TWOFA_LOOK_AHEAD)")
+	rootCmd.PersistentFlags().Int("TWOFA_RECOVERY_CODES", 10, "Recovery codes per user (env: TWOFA_RECOVERY_CODES)")
+	rootCmd.PersistentFlags().String("WHATSAPP_DEFAULT_SESSION", "", "WhatsApp session used when a request names none, the oldest when empty (env: WHATSAPP_DEFAULT_SESSION)")
+	rootCmd.PersistentFlags().Int("WEBHOOK_MAX_ATTEMPTS", 8, "Webhook delivery attempts before giving up (env: WEBHOOK_MAX_ATTEMPTS)")
+	rootCmd.PersistentFlags().Duration("WEBHOOK_BACKOFF", 30*time.Second, "Wait before the first webhook retry, doubled after each (env: WEBHOOK_BACKOFF)")
+	rootCmd.PersistentFlags().Duration("WEBHOOK_MAX_BACKOFF", time.Hour, "Longest wait between webhook retries (env: WEBHOOK_MAX_BACKOFF)")
+	rootCmd.PersistentFlags().Duration("WEBHOOK_TIMEOUT", 10*time.Second, "Timeout for each webhook request (env: WEBHOOK_TIMEOUT)")
+	rootCmd.PersistentFlags().Duration("WEBHOOK_RETENTION", 7*24*time.Hour, "How long finished webhook deliveries are kept (env: WEBHOOK_RETENTION)")
 
 	// Bind flags to viper
 	viper.BindPFlag("PORT", rootCmd.PersistentFlags().Lookup("port"))
 	viper.BindPFlag("HOST", rootCmd.PersistentFlags().Lookup("host"))
+	viper.BindPFlag("REQUEST_TIMEOUT", rootCmd.PersistentFlags().Lookup("REQUEST_TIMEOUT"))
+	viper.BindPFlag("MAIL_TRANSPORT", rootCmd.PersistentFlags().Lookup("MAIL_TRANSPORT"))
+	viper.BindPFlag("MAIL_SENDMAIL_PATH", rootCmd.PersistentFlags().Lookup("MAIL_SENDMAIL_PATH"))
+	viper.BindPFlag("MAIL_FILE_DIR", rootCmd.PersistentFlags().Lookup("MAIL_FILE_DIR"))
+	viper.BindPFlag("MAIL_TEMPLATES_DIR", rootCmd.PersistentFlags().Lookup("MAIL_TEMPLATES_DIR"))
 	viper.BindPFlag("SMTP_HOST", rootCmd.PersistentFlags().Lookup("SMTP_HOST"))
 	viper.BindPFlag("SMTP_PORT", rootCmd.PersistentFlags().Lookup("SMTP_PORT"))
 	viper.BindPFlag("SMTP_USERNAME", rootCmd.PersistentFlags().Lookup("SMTP_USERNAME"))
 	viper.BindPFlag("SMTP_PASSWORD", rootCmd.PersistentFlags().Lookup("SMTP_PASSWORD"))
 	viper.BindPFlag("SMTP_EMAIL", rootCmd.PersistentFlags().Lookup("SMTP_EMAIL"))
+	viper.BindPFlag("SMTP_FROM_NAME", rootCmd.PersistentFlags().Lookup("SMTP_FROM_NAME"))
+	viper.BindPFlag("SMTP_TLS_MODE", rootCmd.PersistentFlags().Lookup("SMTP_TLS_MODE"))
+	viper.BindPFlag("SMTP_CA_FILE", rootCmd.PersistentFlags().Lookup("SMTP_CA_FILE"))
+	viper.BindPFlag("SMTP_CERT_FILE", rootCmd.PersistentFlags().Lookup("SMTP_CERT_FILE"))
+	viper.BindPFlag("SMTP_KEY_FILE", rootCmd.PersistentFlags().Lookup("SMTP_KEY_FILE"))
+	viper.BindPFlag("SMTP_TLS_MIN_VERSION", rootCmd.PersistentFlags().Lookup("SMTP_TLS_MIN_VERSION"))
+	viper.BindPFlag("SMTP_AUTH", rootCmd.PersistentFlags().Lookup("SMTP_AUTH"))
+	viper.BindPFlag("SMTP_OAUTH2_TOKEN_URL", rootCmd.PersistentFlags().Lookup("SMTP_OAUTH2_TOKEN_URL"))
+	viper.BindPFlag("SMTP_OAUTH2_CLIENT_ID", rootCmd.PersistentFlags().Lookup("SMTP_OAUTH2_CLIENT_ID"))
+	viper.BindPFlag("SMTP_OAUTH2_CLIENT_SECRET", rootCmd.PersistentFlags().Lookup("SMTP_OAUTH2_CLIENT_SECRET"))
+	viper.BindPFlag("SMTP_OAUTH2_REFRESH_TOKEN", rootCmd.PersistentFlags().Lookup("SMTP_OAUTH2_REFRESH_TOKEN"))
+	viper.BindPFlag("SMTP_OAUTH2_ACCESS_TOKEN", rootCmd.PersistentFlags().Lookup("SMTP_OAUTH2_ACCESS_TOKEN"))
+	viper.BindPFlag("SMTP_POOL_SIZE", rootCmd.PersistentFlags().Lookup("SMTP_POOL_SIZE"))
+	viper.BindPFlag("SMTP_POOL_IDLE_TIMEOUT", rootCmd.PersistentFlags().Lookup("SMTP_POOL_IDLE_TIMEOUT"))
+	viper.BindPFlag("SMTP_TIMEOUT", rootCmd.PersistentFlags().Lookup("SMTP_TIMEOUT"))
+	viper.BindPFlag("DKIM_DOMAIN", rootCmd.PersistentFlags().Lookup("DKIM_DOMAIN"))
+	viper.BindPFlag("DKIM_SELECTOR", rootCmd.PersistentFlags().Lookup("DKIM_SELECTOR"))
+	viper.BindPFlag("DKIM_PRIVATE_KEY_PATH", rootCmd.PersistentFlags().Lookup("DKIM_PRIVATE_KEY_PATH"))
+	viper.BindPFlag("DB_PATH", rootCmd.PersistentFlags().Lookup("DB_PATH"))
+	viper.BindPFlag("OTP_SECRET", rootCmd.PersistentFlags().Lookup("OTP_SECRET"))
+	viper.BindPFlag("OTP_LENGTH", rootCmd.PersistentFlags().Lookup("OTP_LENGTH"))
+	viper.BindPFlag("OTP_ALPHABET", rootCmd.PersistentFlags().Lookup("OTP_ALPHABET"))
+	viper.BindPFlag("OTP_MAX_ATTEMPTS", rootCmd.PersistentFlags().Lookup("OTP_MAX_ATTEMPTS"))
+	viper.BindPFlag("OTP_LOCKOUT", rootCmd.PersistentFlags().Lookup("OTP_LOCKOUT"))
+	viper.BindPFlag("OTP_RESEND_COOLDOWN", rootCmd.PersistentFlags().Lookup("OTP_RESEND_COOLDOWN"))
+	viper.BindPFlag("OTP_PURPOSES", rootCmd.PersistentFlags().Lookup("OTP_PURPOSES"))
+	viper.BindPFlag("MAGIC_LINK_URL", rootCmd.PersistentFlags().Lookup("MAGIC_LINK_URL"))
+	viper.BindPFlag("TWOFA_ISSUER", rootCmd.PersistentFlags().Lookup("TWOFA_ISSUER"))
+	viper.BindPFlag("TWOFA_ENCRYPTION_KEY", rootCmd.PersistentFlags().Lookup("TWOFA_ENCRYPTION_KEY"))
+	viper.BindPFlag("TWOFA_WINDOW", rootCmd.PersistentFlags().Lookup("TWOFA_WINDOW"))
+	viper.BindPFlag("TWOFA_LOOK_AHEAD", rootCmd.PersistentFlags().Lookup("TWOFA_LOOK_AHEAD"))
+	viper.BindPFlag("TWOFA_RECOVERY_CODES", rootCmd.PersistentFlags().Lookup("TWOFA_RECOVERY_CODES"))
+	viper.BindPFlag("WHATSAPP_DEFAULT_SESSION", rootCmd.PersistentFlags().Lookup("WHATSAPP_DEFAULT_SESSION"))
+	viper.BindPFlag("WEBHOOK_MAX_ATTEMPTS", rootCmd.PersistentFlags().Lookup("WEBHOOK_MAX_ATTEMPTS"))
+	viper.BindPFlag("WEBHOOK_BACKOFF", rootCmd.PersistentFlags().Lookup("WEBHOOK_BACKOFF"))
+	viper.BindPFlag("WEBHOOK_MAX_BACKOFF", rootCmd.PersistentFlags().Lookup("WEBHOOK_MAX_BACKOFF"))
+	viper.BindPFlag("WEBHOOK_TIMEOUT", rootCmd.PersistentFlags().Lookup("WEBHOOK_TIMEOUT"))
+	viper.BindPFlag("WEBHOOK_RETENTION", rootCmd.PersistentFlags().Lookup("WEBHOOK_RETENTION"))
 
 	// Bind env variables
 	viper.AutomaticEnv()
@@ -0,0 +1,275 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthMechanism selects how the mailer authenticates with the SMTP server
+type AuthMechanism string
+
+const (
+	// AuthAuto picks the best mechanism advertised by the server
+	AuthAuto    AuthMechanism = ""
+	AuthPlain   AuthMechanism = "PLAIN"
+	AuthLogin   AuthMechanism = "LOGIN"
+	AuthCRAMMD5 AuthMechanism = "CRAM-MD5"
+	AuthXOAUTH2 AuthMechanism = "XOAUTH2"
+	// AuthNone skips authentication, for relays that accept unauthenticated mail
+	AuthNone AuthMechanism = "NONE"
+)
+
+// autoMechanisms is the preference order used by AuthAuto for password logins
+var autoMechanisms = []AuthMechanism{AuthPlain, AuthLogin, AuthCRAMMD5}
+
+// TokenSource supplies OAuth2 access tokens for XOAUTH2. Implementations are
+// expected to refresh expired tokens themselves.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticTokenSource always returns the same access token
+type StaticTokenSource string
+
+// Token returns the static access token
+func (t StaticTokenSource) Token(ctx context.Context) (string, error) {
+	if t == "" {
+		return "", fmt.Errorf("OAuth2 access token is empty")
+	}
+	return string(t), nil
+}
+
+// OAuth2TokenSource exchanges a refresh token for access tokens at an OAuth2
+// token endpoint (e.g. https://oauth2.googleapis.com/token) and caches each
+// access token until shortly before it expires. It is safe for concurrent use.
+type OAuth2TokenSource struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	HTTPClient   *http.Client // defaults to http.DefaultClient
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+// Token returns a cached access token or refreshes it
+func (s *OAuth2TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Refresh a minute early so the token cannot expire mid-session
+	if s.accessToken != "" && time.Now().Add(time.Minute).Before(s.expiry) {
+		return s.accessToken, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {s.ClientID},
+		"client_secret": {s.ClientSecret},
+		"refresh_token": {s.RefreshToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	httpClient := s.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh OAuth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode OAuth2 token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", fmt.Errorf("failed to refresh OAuth2 token: %s %s (status %d)", body.Error, body.ErrorDescription, resp.StatusCode)
+	}
+
+	s.accessToken = body.AccessToken
+	s.expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	if body.RefreshToken != "" {
+		// Some providers rotate refresh tokens on every use
+		s.RefreshToken = body.RefreshToken
+	}
+
+	return s.accessToken, nil
+}
+
+// validateAuthConfig checks the credentials required by the auth mechanism
+func validateAuthConfig(config SMTPConfig) error {
+	switch config.AuthMechanism {
+	case AuthNone:
+		return nil
+	case AuthXOAUTH2:
+		if config.Username == "" {
+			return fmt.Errorf("SMTP username is required")
+		}
+		if config.TokenSource == nil {
+			return fmt.Errorf("SMTP OAuth2 token source is required for XOAUTH2")
+		}
+		return nil
+	case AuthAuto, AuthPlain, AuthLogin, AuthCRAMMD5:
+		if config.Username == "" {
+			return fmt.Errorf("SMTP username is required")
+		}
+		if config.Password == "" && (config.AuthMechanism != AuthAuto || config.TokenSource == nil) {
+			return fmt.Errorf("SMTP password is required")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown SMTP auth mechanism %q", config.AuthMechanism)
+	}
+}
+
+// authenticate negotiates the configured mechanism against the AUTH
+// extension advertised in the server's EHLO response and logs in
+func authenticate(ctx context.Context, client *smtp.Client, config SMTPConfig) error {
+	if config.AuthMechanism == AuthNone {
+		return nil
+	}
+
+	ok, params := client.Extension("AUTH")
+	if !ok {
+		if config.AuthMechanism == AuthAuto {
+			// Nothing to negotiate, the relay accepts mail without login
+			return nil
+		}
+		return fmt.Errorf("SMTP server does not support authentication")
+	}
+	offered := strings.Fields(strings.ToUpper(params))
+
+	mechanism := config.AuthMechanism
+	if mechanism == AuthAuto {
+		var err error
+		if mechanism, err = pickMechanism(offered, config); err != nil {
+			return err
+		}
+	} else if !slices.Contains(offered, string(mechanism)) {
+		return fmt.Errorf("SMTP server does not support %s authentication (offered: %s)", mechanism, params)
+	}
+
+	if err := client.Auth(newAuth(ctx, mechanism, config)); err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	return nil
+}
+
+// pickMechanism chooses the preferred mechanism the server offers
+func pickMechanism(offered []string, config SMTPConfig) (AuthMechanism, error) {
+	if config.TokenSource != nil && slices.Contains(offered, string(AuthXOAUTH2)) {
+		return AuthXOAUTH2, nil
+	}
+	if config.Password != "" {
+		for _, mechanism := range autoMechanisms {
+			if slices.Contains(offered, string(mechanism)) {
+				return mechanism, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no supported SMTP auth mechanism offered (offered: %s)", strings.Join(offered, " "))
+}
+
+func newAuth(ctx context.Context, mechanism AuthMechanism, config SMTPConfig) smtp.Auth {
+	switch mechanism {
+	case AuthLogin:
+		return &loginAuth{username: config.Username, password: config.Password, host: config.Host}
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(config.Username, config.Password)
+	case AuthXOAUTH2:
+		return &xoauth2Auth{ctx: ctx, username: config.Username, tokenSource: config.TokenSource}
+	default:
+		return smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+}
+
+// requireTLS refuses to send credentials in the clear, except to localhost,
+// mirroring the check smtp.PlainAuth does
+func requireTLS(server *smtp.ServerInfo) error {
+	if server.TLS || server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1" {
+		return nil
+	}
+	return errors.New("unencrypted connection")
+}
+
+// loginAuth implements the non-standard but widely deployed LOGIN mechanism
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := requireTLS(server); err != nil {
+		return "", nil, err
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return string(AuthLogin), nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch prompt := strings.ToLower(strings.TrimSpace(string(fromServer))); {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+	}
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism used by Gmail and Microsoft 365
+type xoauth2Auth struct {
+	ctx         context.Context // bounds the token refresh
+	username    string
+	tokenSource TokenSource
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := requireTLS(server); err != nil {
+		return "", nil, err
+	}
+	token, err := a.tokenSource.Token(a.ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(AuthXOAUTH2), []byte("user=" + a.username + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sent a JSON error; an empty response makes it finish
+		// the exchange with the final failure status
+		return []byte{}, nil
+	}
+	return nil, nil
+}
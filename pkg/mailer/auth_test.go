@@ -0,0 +1,217 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// authExchange runs auth against a scripted server offering the AUTH
+// mechanisms in offered, which answers each line after EHLO with the next
+// reply. It returns the lines the client sent and the result of Auth.
+func authExchange(t *testing.T, auth smtp.Auth, offered string, replies []string) ([]string, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+
+	lines := make(chan []string, 1)
+	go func() {
+		defer server.Close()
+		var got []string
+		defer func() { lines <- got }()
+		r := bufio.NewReader(server)
+		fmt.Fprint(server, "220 fake ESMTP\r\n")
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		fmt.Fprintf(server, "250-fake\r\n250 AUTH %s\r\n", offered)
+		for _, reply := range replies {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			got = append(got, strings.TrimRight(line, "\r\n"))
+			fmt.Fprintf(server, "%s\r\n", reply)
+		}
+	}()
+
+	// localhost passes the TLS check of the mechanisms
+	c, err := smtp.NewClient(client, "localhost")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	err = c.Auth(auth)
+	client.Close()
+	return <-lines, err
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestLoginAuth(t *testing.T) {
+	auth := &loginAuth{username: "jane@example.com", password: "secret", host: "localhost"}
+	sent, err := authExchange(t, auth, "PLAIN LOGIN", []string{
+		"334 " + b64("Username:"),
+		"334 " + b64("Password:"),
+		"235 2.7.0 Accepted",
+	})
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	want := []string{"AUTH LOGIN", b64("jane@example.com"), b64("secret")}
+	if strings.Join(sent, " ") != strings.Join(want, " ") {
+		t.Errorf("client sent %q, want %q", sent, want)
+	}
+
+	// Some servers send the prompts in lower case
+	if resp, err := auth.Next([]byte("password:"), true); err != nil || string(resp) != "secret" {
+		t.Errorf("Next(password:) = %q, %v", resp, err)
+	}
+	if _, err := auth.Next([]byte("Token:"), true); err == nil {
+		t.Error("Next accepted an unknown challenge")
+	}
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com"}); err == nil {
+		t.Error("Start sent credentials without TLS")
+	}
+}
+
+func TestXOAUTH2Auth(t *testing.T) {
+	ctx := context.Background()
+	initial := b64("user=jane@example.com\x01auth=Bearer ya29.token\x01\x01")
+
+	t.Run("accepted", func(t *testing.T) {
+		auth := &xoauth2Auth{ctx: ctx, username: "jane@example.com", tokenSource: StaticTokenSource("ya29.token")}
+		sent, err := authExchange(t, auth, "XOAUTH2", []string{"235 2.7.0 Accepted"})
+		if err != nil {
+			t.Fatalf("Auth: %v", err)
+		}
+		if want := "AUTH XOAUTH2 " + initial; len(sent) != 1 || sent[0] != want {
+			t.Errorf("client sent %q, want %q", sent, want)
+		}
+	})
+
+	t.Run("error JSON", func(t *testing.T) {
+		// The server rejects the token with a JSON challenge, the client
+		// answers with an empty line to get the final status
+		auth := &xoauth2Auth{ctx: ctx, username: "jane@example.com", tokenSource: StaticTokenSource("ya29.token")}
+		sent, err := authExchange(t, auth, "XOAUTH2", []string{
+			"334 " + b64(`{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`),
+			"535 5.7.8 Username and Password not accepted",
+		})
+		var protoErr *textproto.Error
+		if !errors.As(err, &protoErr) || protoErr.Code != 535 {
+			t.Fatalf("Auth = %v, want the 535 reply", err)
+		}
+		if len(sent) != 2 || sent[1] != "" {
+			t.Errorf("client sent %q, want the initial response and an empty line", sent)
+		}
+	})
+
+	t.Run("token error", func(t *testing.T) {
+		auth := &xoauth2Auth{ctx: ctx, username: "jane@example.com", tokenSource: StaticTokenSource("")}
+		if _, _, err := auth.Start(&smtp.ServerInfo{Name: "localhost"}); err == nil {
+			t.Error("Start succeeded without a token")
+		}
+	})
+}
+
+func TestPickMechanism(t *testing.T) {
+	password := SMTPConfig{Username: "jane", Password: "secret"}
+	token := SMTPConfig{Username: "jane", TokenSource: StaticTokenSource("ya29.token")}
+	both := SMTPConfig{Username: "jane", Password: "secret", TokenSource: StaticTokenSource("ya29.token")}
+
+	tests := []struct {
+		name    string
+		offered string
+		config  SMTPConfig
+		want    AuthMechanism
+		wantErr bool
+	}{
+		{name: "plain first", offered: "LOGIN PLAIN CRAM-MD5", config: password, want: AuthPlain},
+		{name: "login", offered: "LOGIN CRAM-MD5", config: password, want: AuthLogin},
+		{name: "cram-md5", offered: "CRAM-MD5", config: password, want: AuthCRAMMD5},
+		{name: "xoauth2 preferred", offered: "PLAIN LOGIN XOAUTH2", config: both, want: AuthXOAUTH2},
+		{name: "password fallback", offered: "PLAIN LOGIN", config: both, want: AuthPlain},
+		{name: "token only", offered: "XOAUTH2 OAUTHBEARER", config: token, want: AuthXOAUTH2},
+		{name: "token without xoauth2", offered: "PLAIN LOGIN", config: token, wantErr: true},
+		{name: "password without match", offered: "XOAUTH2 GSSAPI", config: password, wantErr: true},
+		{name: "nothing offered", offered: "", config: both, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pickMechanism(strings.Fields(tt.offered), tt.config)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("pickMechanism(%q) = %s, want an error", tt.offered, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("pickMechanism(%q): %v", tt.offered, err)
+			}
+			if got != tt.want {
+				t.Errorf("pickMechanism(%q) = %s, want %s", tt.offered, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenSource(t *testing.T) {
+	ctx := context.Background()
+	var calls atomic.Int32
+	var lastRefresh atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		r.ParseForm()
+		lastRefresh.Store(r.PostForm.Get("refresh_token"))
+		w.Header().Set("Content-Type", "application/json")
+		switch r.PostForm.Get("refresh_token") {
+		case "revoked":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`)
+		case "short":
+			fmt.Fprintf(w, `{"access_token":"short-%d","expires_in":30}`, n)
+		default:
+			fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600,"refresh_token":"rotated"}`, n)
+		}
+	}))
+	defer server.Close()
+
+	source := &OAuth2TokenSource{TokenURL: server.URL, ClientID: "id", ClientSecret: "secret", RefreshToken: "initial"}
+	for range 2 {
+		token, err := source.Token(ctx)
+		if err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+		if token != "token-1" {
+			t.Errorf("Token = %q, want the cached token-1", token)
+		}
+	}
+	if calls.Load() != 1 || lastRefresh.Load() != "initial" || source.RefreshToken != "rotated" {
+		t.Errorf("%d refreshes with %v, refresh token now %q", calls.Load(), lastRefresh.Load(), source.RefreshToken)
+	}
+
+	// A token expiring within a minute is refreshed
+	short := &OAuth2TokenSource{TokenURL: server.URL, RefreshToken: "short"}
+	first, _ := short.Token(ctx)
+	second, err := short.Token(ctx)
+	if err != nil || first == second {
+		t.Errorf("Token = %q then %q, %v, want a new token", first, second, err)
+	}
+
+	revoked := &OAuth2TokenSource{TokenURL: server.URL, RefreshToken: "revoked"}
+	if _, err := revoked.Token(ctx); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("Token with a revoked refresh token = %v, want invalid_grant", err)
+	}
+}
@@ -0,0 +1,393 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CalendarMethod is the iTIP method of a calendar invitation (RFC 5546)
+type CalendarMethod string
+
+const (
+	CalendarRequest CalendarMethod = "REQUEST" // a new event or an update
+	CalendarCancel  CalendarMethod = "CANCEL"
+)
+
+// Calendar is an invitation for a single event. It is sent as a
+// text/calendar alternative, which Gmail and Outlook show as an invite, and
+// as an invite.ics attachment for other clients.
+type Calendar struct {
+	Method CalendarMethod // defaults to CalendarRequest
+	Event  Event
+}
+
+// Event is a calendar event. Updates and cancellations reuse the UID of the
+// original invitation with a higher Sequence.
+type Event struct {
+	UID         string
+	Sequence    int
+	Summary     string
+	Description string
+	Location    string
+	URL         string
+	Start       time.Time
+	End         time.Time
+	TimeZone    *time.Location  // Start and End are written in this zone, UTC when nil
+	Organizer   Organizer       // defaults to the sender
+	Attendees   []Attendee      // default to the To and Cc recipients
+	Reminders   []time.Duration // alarms this long before Start
+}
+
+// Organizer is the owner of an event
+type Organizer struct {
+	Name  string
+	Email string
+}
+
+// Attendee is a participant invited to an event
+type Attendee struct {
+	Name     string
+	Email    string
+	Optional bool
+}
+
+// icalTimeFormat is the DATE-TIME format of RFC 5545, local or with a Z suffix
+const icalTimeFormat = "20060102T150405"
+
+// GenerateEventUID returns a globally unique event UID in the domain of sender
+func GenerateEventUID(sender string) (string, error) {
+	messageID, err := generateMessageID(sender)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate event UID: %w", err)
+	}
+	return strings.Trim(messageID, "<>"), nil
+}
+
+// withDefaults fills in the method, organizer and attendees left empty from
+// the sender and recipients of the message
+func (c Calendar) withDefaults(emailData EmailData, config SMTPConfig) Calendar {
+	if c.Method == "" {
+		c.Method = CalendarRequest
+	}
+	if c.Event.Organizer.Email == "" {
+		c.Event.Organizer = Organizer{Name: config.FromName, Email: config.Email}
+	}
+	if len(c.Event.Attendees) == 0 {
+		for _, addr := range append(append([]string{}, emailData.To...), emailData.Cc...) {
+			if parsed, err := mail.ParseAddress(addr); err == nil {
+				c.Event.Attendees = append(c.Event.Attendees, Attendee{Name: parsed.Name, Email: parsed.Address})
+			}
+		}
+	}
+	return c
+}
+
+// Validate checks that the calendar can be encoded
+func (c Calendar) Validate() error {
+	switch c.Method {
+	case CalendarRequest, CalendarCancel:
+	default:
+		return fmt.Errorf("unsupported calendar method %q", c.Method)
+	}
+
+	event := c.Event
+	switch {
+	case strings.TrimSpace(event.UID) == "":
+		return fmt.Errorf("event UID is required")
+	case event.Sequence < 0:
+		return fmt.Errorf("event sequence must not be negative")
+	case strings.TrimSpace(event.Summary) == "":
+		return fmt.Errorf("event summary is required")
+	case event.Start.IsZero():
+		return fmt.Errorf("event start is required")
+	case !event.End.After(event.Start):
+		return fmt.Errorf("event end must be after its start")
+	case event.Organizer.Email == "":
+		return fmt.Errorf("event organizer is required")
+	case len(event.Attendees) == 0:
+		return fmt.Errorf("event needs at least one attendee")
+	}
+	for i, attendee := range event.Attendees {
+		if _, err := mail.ParseAddress(attendee.Email); err != nil {
+			return fmt.Errorf("attendee %d: invalid email address %q", i, attendee.Email)
+		}
+	}
+	for _, reminder := range event.Reminders {
+		if reminder < 0 {
+			return fmt.Errorf("event reminders must not be negative")
+		}
+	}
+	return nil
+}
+
+// Bytes encodes the calendar as an iCalendar object (RFC 5545)
+func (c Calendar) Bytes() ([]byte, error) {
+	if c.Method == "" {
+		c.Method = CalendarRequest
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	event := c.Event
+	w := &icalWriter{}
+	w.line("BEGIN:VCALENDAR")
+	w.line("PRODID:-//imrany//whats-email//EN")
+	w.line("VERSION:2.0")
+	w.line("CALSCALE:GREGORIAN")
+	w.line("METHOD:" + string(c.Method))
+
+	location := event.TimeZone
+	if location == nil || location.String() == "UTC" {
+		location = nil
+	} else {
+		writeTimeZone(w, location, event.Start, event.End)
+	}
+
+	status := "CONFIRMED"
+	if c.Method == CalendarCancel {
+		status = "CANCELLED"
+	}
+
+	w.line("BEGIN:VEVENT")
+	w.line("UID:" + escapeText(event.UID))
+	w.line(fmt.Sprintf("SEQUENCE:%d", event.Sequence))
+	w.line("DTSTAMP:" + time.Now().UTC().Format(icalTimeFormat) + "Z")
+	w.line(formatEventTime("DTSTART", event.Start, location))
+	w.line(formatEventTime("DTEND", event.End, location))
+	w.line("SUMMARY:" + escapeText(event.Summary))
+	if event.Description != "" {
+		w.line("DESCRIPTION:" + escapeText(event.Description))
+	}
+	if event.Location != "" {
+		w.line("LOCATION:" + escapeText(event.Location))
+	}
+	if event.URL != "" {
+		w.line("URL:" + event.URL)
+	}
+	w.line("ORGANIZER" + commonName(event.Organizer.Name) + ":mailto:" + event.Organizer.Email)
+	for _, attendee := range event.Attendees {
+		role := "REQ-PARTICIPANT"
+		if attendee.Optional {
+			role = "OPT-PARTICIPANT"
+		}
+		params := commonName(attendee.Name) + ";ROLE=" + role + ";PARTSTAT=NEEDS-ACTION"
+		if c.Method == CalendarRequest {
+			params += ";RSVP=TRUE"
+		}
+		w.line("ATTENDEE" + params + ":mailto:" + attendee.Email)
+	}
+	w.line("STATUS:" + status)
+	if c.Method == CalendarRequest {
+		for _, reminder := range event.Reminders {
+			w.line("BEGIN:VALARM")
+			w.line("ACTION:DISPLAY")
+			w.line("DESCRIPTION:" + escapeText(event.Summary))
+			w.line("TRIGGER:-" + formatICalDuration(reminder))
+			w.line("END:VALARM")
+		}
+	}
+	w.line("END:VEVENT")
+	w.line("END:VCALENDAR")
+
+	return w.buf.Bytes(), nil
+}
+
+// Text describes the event in plain text, for use as the body of the
+// invitation email
+func (c Calendar) Text() string {
+	event := c.Event
+	location := event.TimeZone
+	if location == nil {
+		location = time.UTC
+	}
+	start, end := event.Start.In(location), event.End.In(location)
+
+	var b strings.Builder
+	if c.Method == CalendarCancel {
+		b.WriteString("Cancelled: ")
+	}
+	b.WriteString(event.Summary + "\n\n")
+
+	when := start.Format("Mon, 2 Jan 2006 15:04") + " - "
+	if start.YearDay() == end.YearDay() && start.Year() == end.Year() {
+		when += end.Format("15:04")
+	} else {
+		when += end.Format("Mon, 2 Jan 2006 15:04")
+	}
+	b.WriteString("When: " + when + " (" + location.String() + ")\n")
+	if event.Location != "" {
+		b.WriteString("Where: " + event.Location + "\n")
+	}
+	if event.URL != "" {
+		b.WriteString("Link: " + event.URL + "\n")
+	}
+	if event.Description != "" {
+		b.WriteString("\n" + event.Description + "\n")
+	}
+	return b.String()
+}
+
+// writeTimeZone writes a VTIMEZONE for location covering the years from
+// start to end. Offsets are sampled from the Go time zone database, so the
+// component lists every transition in those years instead of an RRULE.
+func writeTimeZone(w *icalWriter, location *time.Location, start, end time.Time) {
+	from := time.Date(start.In(location).Year(), time.January, 1, 0, 0, 0, 0, location)
+	to := time.Date(end.In(location).Year()+1, time.January, 1, 0, 0, 0, 0, location)
+
+	w.line("BEGIN:VTIMEZONE")
+	w.line("TZID:" + location.String())
+
+	name, offset := from.Zone()
+	writeTimeZoneRule(w, from, from.IsDST(), name, offset, offset)
+	for t := from.Add(24 * time.Hour); t.Before(to); t = t.Add(24 * time.Hour) {
+		_, next := t.Zone()
+		if next == offset {
+			continue
+		}
+		// Find the first second with the new offset
+		lo, hi := t.Add(-24*time.Hour), t
+		for hi.Sub(lo) > time.Second {
+			mid := lo.Add(hi.Sub(lo) / 2)
+			if _, midOffset := mid.Zone(); midOffset == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		transition := hi.Truncate(time.Second)
+		name, next = transition.Zone()
+		writeTimeZoneRule(w, transition, transition.IsDST(), name, offset, next)
+		offset = next
+	}
+
+	w.line("END:VTIMEZONE")
+}
+
+// writeTimeZoneRule writes a STANDARD or DAYLIGHT component starting at
+// transition, whose DTSTART is local time in the offset before it
+func writeTimeZoneRule(w *icalWriter, transition time.Time, dst bool, name string, from, to int) {
+	kind := "STANDARD"
+	if dst {
+		kind = "DAYLIGHT"
+	}
+	local := transition.UTC().Add(time.Duration(from) * time.Second)
+
+	w.line("BEGIN:" + kind)
+	w.line("DTSTART:" + local.Format(icalTimeFormat))
+	w.line("TZOFFSETFROM:" + formatUTCOffset(from))
+	w.line("TZOFFSETTO:" + formatUTCOffset(to))
+	if name != "" && !strings.HasPrefix(name, "+") && !strings.HasPrefix(name, "-") {
+		w.line("TZNAME:" + escapeText(name))
+	}
+	w.line("END:" + kind)
+}
+
+// formatEventTime formats a DATE-TIME property, in UTC when location is nil
+func formatEventTime(name string, t time.Time, location *time.Location) string {
+	if location == nil {
+		return name + ":" + t.UTC().Format(icalTimeFormat) + "Z"
+	}
+	return name + ";TZID=" + paramValue(location.String()) + ":" + t.In(location).Format(icalTimeFormat)
+}
+
+// formatUTCOffset formats a UTC offset in seconds as +HHMM, or +HHMMSS
+func formatUTCOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	formatted := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+	if seconds := offset % 60; seconds != 0 {
+		formatted += fmt.Sprintf("%02d", seconds)
+	}
+	return formatted
+}
+
+// formatICalDuration formats a DURATION value, e.g. PT15M or P1DT2H
+func formatICalDuration(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	if seconds == 0 {
+		return "PT0S"
+	}
+
+	var b strings.Builder
+	b.WriteString("P")
+	if days := seconds / 86400; days > 0 {
+		fmt.Fprintf(&b, "%dD", days)
+	}
+	if seconds%86400 == 0 {
+		return b.String()
+	}
+	b.WriteString("T")
+	if hours := seconds % 86400 / 3600; hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+	}
+	if minutes := seconds % 3600 / 60; minutes > 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+	}
+	if seconds%60 > 0 {
+		fmt.Fprintf(&b, "%dS", seconds%60)
+	}
+	return b.String()
+}
+
+// commonName returns the CN parameter for name, if any
+func commonName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return ";CN=" + paramValue(name)
+}
+
+// paramValue quotes a property parameter value when needed. Parameter
+// values cannot contain double quotes or line breaks, so those are dropped.
+func paramValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r == '"' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, value)
+	if strings.ContainsAny(value, ":;,") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// escapeText escapes a TEXT property value
+var escapeText = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+	"\r", `\n`,
+).Replace
+
+// icalWriter writes content lines folded at 75 octets (RFC 5545 3.1)
+type icalWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *icalWriter) line(line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		// Never split a UTF-8 sequence
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.buf.WriteString(line[:cut])
+		w.buf.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	w.buf.WriteString(line)
+	w.buf.WriteString("\r\n")
+}
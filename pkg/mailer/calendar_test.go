@@ -0,0 +1,210 @@
+package mailer
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// dtstamp matches the DTSTAMP line, which is the time of encoding
+var dtstamp = regexp.MustCompile(`(?m)^DTSTAMP:\d{8}T\d{6}Z\r$`)
+
+func testEvent() Event {
+	return Event{
+		UID:         "20261016.abc@example.com",
+		Summary:     "Planning, Q4",
+		Description: "Agenda:\n1. Budget; 2. Hiring",
+		Location:    "Room 4",
+		URL:         "https://example.com/meet",
+		Start:       time.Date(2026, time.November, 2, 7, 0, 0, 0, time.UTC),
+		End:         time.Date(2026, time.November, 2, 8, 30, 0, 0, time.UTC),
+		Organizer:   Organizer{Name: "Jane Doe", Email: "jane@example.com"},
+		Attendees: []Attendee{
+			{Name: "Bob", Email: "bob@example.com"},
+			{Email: "carol@example.com", Optional: true},
+		},
+		Reminders: []time.Duration{15 * time.Minute, 24 * time.Hour},
+	}
+}
+
+func TestCalendarBytes(t *testing.T) {
+	update := testEvent()
+	update.Sequence = 1
+	update.Start = time.Date(2026, time.November, 3, 10, 0, 0, 0, time.FixedZone("EAT", 3*60*60))
+	update.End = update.Start.Add(time.Hour)
+	update.TimeZone = update.Start.Location()
+
+	cancel := testEvent()
+	cancel.Sequence = 2
+
+	tests := []struct {
+		name     string
+		calendar Calendar
+		want     []string
+	}{
+		{
+			name:     "request",
+			calendar: Calendar{Event: testEvent()},
+			want: []string{
+				"BEGIN:VCALENDAR",
+				"PRODID:-//imrany//whats-email//EN",
+				"VERSION:2.0",
+				"CALSCALE:GREGORIAN",
+				"METHOD:REQUEST",
+				"BEGIN:VEVENT",
+				"UID:20261016.abc@example.com",
+				"SEQUENCE:0",
+				"DTSTAMP",
+				"DTSTART:20261102T070000Z",
+				"DTEND:20261102T083000Z",
+				`SUMMARY:Planning\, Q4`,
+				`DESCRIPTION:Agenda:\n1. Budget\; 2. Hiring`,
+				"LOCATION:Room 4",
+				"URL:https://example.com/meet",
+				"ORGANIZER;CN=Jane Doe:mailto:jane@example.com",
+				"ATTENDEE;CN=Bob;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto",
+				" :bob@example.com",
+				"ATTENDEE;ROLE=OPT-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:carol@",
+				" example.com",
+				"STATUS:CONFIRMED",
+				"BEGIN:VALARM",
+				"ACTION:DISPLAY",
+				`DESCRIPTION:Planning\, Q4`,
+				"TRIGGER:-PT15M",
+				"END:VALARM",
+				"BEGIN:VALARM",
+				"ACTION:DISPLAY",
+				`DESCRIPTION:Planning\, Q4`,
+				"TRIGGER:-P1D",
+				"END:VALARM",
+				"END:VEVENT",
+				"END:VCALENDAR",
+			},
+		},
+		{
+			// Same UID with a higher sequence, moved to a time zone
+			name:     "update",
+			calendar: Calendar{Method: CalendarRequest, Event: update},
+			want: []string{
+				"BEGIN:VCALENDAR",
+				"PRODID:-//imrany//whats-email//EN",
+				"VERSION:2.0",
+				"CALSCALE:GREGORIAN",
+				"METHOD:REQUEST",
+				"BEGIN:VTIMEZONE",
+				"TZID:EAT",
+				"BEGIN:STANDARD",
+				"DTSTART:20260101T000000",
+				"TZOFFSETFROM:+0300",
+				"TZOFFSETTO:+0300",
+				"TZNAME:EAT",
+				"END:STANDARD",
+				"END:VTIMEZONE",
+				"BEGIN:VEVENT",
+				"UID:20261016.abc@example.com",
+				"SEQUENCE:1",
+				"DTSTAMP",
+				"DTSTART;TZID=EAT:20261103T100000",
+				"DTEND;TZID=EAT:20261103T110000",
+				`SUMMARY:Planning\, Q4`,
+				`DESCRIPTION:Agenda:\n1. Budget\; 2. Hiring`,
+				"LOCATION:Room 4",
+				"URL:https://example.com/meet",
+				"ORGANIZER;CN=Jane Doe:mailto:jane@example.com",
+				"ATTENDEE;CN=Bob;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto",
+				" :bob@example.com",
+				"ATTENDEE;ROLE=OPT-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:carol@",
+				" example.com",
+				"STATUS:CONFIRMED",
+				"BEGIN:VALARM",
+				"ACTION:DISPLAY",
+				`DESCRIPTION:Planning\, Q4`,
+				"TRIGGER:-PT15M",
+				"END:VALARM",
+				"BEGIN:VALARM",
+				"ACTION:DISPLAY",
+				`DESCRIPTION:Planning\, Q4`,
+				"TRIGGER:-P1D",
+				"END:VALARM",
+				"END:VEVENT",
+				"END:VCALENDAR",
+			},
+		},
+		{
+			// No RSVP and no alarms
+			name:     "cancel",
+			calendar: Calendar{Method: CalendarCancel, Event: cancel},
+			want: []string{
+				"BEGIN:VCALENDAR",
+				"PRODID:-//imrany//whats-email//EN",
+				"VERSION:2.0",
+				"CALSCALE:GREGORIAN",
+				"METHOD:CANCEL",
+				"BEGIN:VEVENT",
+				"UID:20261016.abc@example.com",
+				"SEQUENCE:2",
+				"DTSTAMP",
+				"DTSTART:20261102T070000Z",
+				"DTEND:20261102T083000Z",
+				`SUMMARY:Planning\, Q4`,
+				`DESCRIPTION:Agenda:\n1. Budget\; 2. Hiring`,
+				"LOCATION:Room 4",
+				"URL:https://example.com/meet",
+				"ORGANIZER;CN=Jane Doe:mailto:jane@example.com",
+				"ATTENDEE;CN=Bob;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION:mailto:bob@examp",
+				" le.com",
+				"ATTENDEE;ROLE=OPT-PARTICIPANT;PARTSTAT=NEEDS-ACTION:mailto:carol@example.co",
+				" m",
+				"STATUS:CANCELLED",
+				"END:VEVENT",
+				"END:VCALENDAR",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.calendar.Bytes()
+			if err != nil {
+				t.Fatalf("Bytes: %v", err)
+			}
+			if !dtstamp.Match(data) {
+				t.Fatalf("no DTSTAMP in\n%s", data)
+			}
+			got := dtstamp.ReplaceAllString(string(data), "DTSTAMP\r")
+			want := strings.Join(tt.want, "\r\n") + "\r\n"
+			if got != want {
+				t.Errorf("Bytes() =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestCalendarFoldsLines(t *testing.T) {
+	event := testEvent()
+	// Multi-byte runes straddle the fold points
+	event.Description = strings.Repeat("Karibu sana, ", 10) + strings.Repeat("é€", 40)
+
+	data, err := Calendar{Event: event}.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes: %v", err)
+	}
+	if !strings.HasSuffix(string(data), "\r\n") {
+		t.Fatal("last line does not end with CRLF")
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line of %d octets: %q", len(line), line)
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("line splits a UTF-8 sequence: %q", line)
+		}
+	}
+
+	unfolded := strings.ReplaceAll(string(data), "\r\n ", "")
+	want := "DESCRIPTION:" + escapeText(event.Description) + "\r\n"
+	if !strings.Contains(unfolded, want) {
+		t.Errorf("unfolded calendar does not contain %q", want)
+	}
+}
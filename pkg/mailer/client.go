@@ -0,0 +1,60 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+)
+
+// Client is a long-lived mailer that renders messages from EmailData and
+// hands them to a Transport. It is safe for concurrent use when its
+// Transport is.
+type Client struct {
+	config    SMTPConfig
+	transport Transport
+}
+
+// NewClient validates config and creates a Client that delivers over a
+// pooled SMTPTransport
+func NewClient(config SMTPConfig, options ClientOptions) (*Client, error) {
+	transport, err := NewSMTPTransport(config, options)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{config: config, transport: transport}, nil
+}
+
+// NewClientWithTransport creates a Client that delivers through transport.
+// Only the sender fields (Email, FromName) and DKIM of config are used.
+func NewClientWithTransport(config SMTPConfig, transport Transport) (*Client, error) {
+	if config.Email == "" {
+		return nil, fmt.Errorf("SMTP email is required")
+	}
+	if transport == nil {
+		return nil, fmt.Errorf("mail transport is required")
+	}
+	return &Client{config: config, transport: transport}, nil
+}
+
+// Send sends an email and returns its Message-ID
+func (c *Client) Send(emailData EmailData) (string, error) {
+	return c.SendContext(context.Background(), emailData)
+}
+
+// SendContext is like Send but gives up when ctx is done. The returned error
+// then wraps ctx.Err(), so callers can check for context.DeadlineExceeded.
+func (c *Client) SendContext(ctx context.Context, emailData EmailData) (string, error) {
+	messageID, msg, err := prepareMessage(emailData, c.config)
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.transport.Send(ctx, c.config.Email, emailData.Recipients(), msg); err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+// Close releases the resources held by the transport
+func (c *Client) Close() error {
+	return c.transport.Close()
+}
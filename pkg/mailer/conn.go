@@ -0,0 +1,98 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultTimeout bounds dialing and each SMTP command when SMTPConfig.Timeout is unset
+const defaultTimeout = 30 * time.Second
+
+// smtpConn bounds every read and write on an SMTP connection by the
+// per-command timeout and by the deadline of the context it is bound to, and
+// aborts blocked I/O as soon as that context is cancelled. Since net/smtp
+// reads and writes through it, this also covers the TLS handshake of
+// STARTTLS and every command of the session.
+type smtpConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mu        sync.Mutex
+	deadline  time.Time // deadline of the bound context, zero if none
+	cancelled bool
+}
+
+func newSMTPConn(conn net.Conn, timeout time.Duration) *smtpConn {
+	return &smtpConn{Conn: conn, timeout: timeout}
+}
+
+func (c *smtpConn) Read(b []byte) (int, error) {
+	if err := c.arm(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *smtpConn) Write(b []byte) (int, error) {
+	if err := c.arm(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// arm sets the deadline for the next read or write
+func (c *smtpConn) arm() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancelled {
+		return fmt.Errorf("SMTP operation cancelled")
+	}
+	deadline := time.Now().Add(c.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	return c.Conn.SetDeadline(deadline)
+}
+
+// bind ties the connection to ctx until the returned function is called
+func (c *smtpConn) bind(ctx context.Context) (unbind func()) {
+	c.mu.Lock()
+	c.deadline, _ = ctx.Deadline()
+	c.cancelled = false
+	c.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		c.cancelled = true
+		c.mu.Unlock()
+		// Unblock any read or write in progress
+		c.Conn.SetDeadline(time.Now())
+	})
+
+	return func() {
+		stop()
+		c.mu.Lock()
+		c.deadline = time.Time{}
+		c.mu.Unlock()
+	}
+}
+
+// contextError prefers the context's error over the I/O error it caused
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	// The connection deadline can fire a moment before the context notices
+	// its own deadline has passed
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+	}
+	return err
+}
@@ -0,0 +1,362 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultDKIMHeaders are the header fields signed when DKIMSigner.Headers is
+// empty. Fields missing from a message are skipped.
+var defaultDKIMHeaders = []string{
+	"From", "To", "Cc", "Reply-To", "Subject", "Date", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMSigner signs outgoing messages with DKIM (RFC 6376) using
+// relaxed/relaxed canonicalization. RSA keys sign with rsa-sha256 and
+// Ed25519 keys with ed25519-sha256 (RFC 8463).
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey
+	Headers  []string      // header fields to sign, defaults to defaultDKIMHeaders
+}
+
+// LoadDKIMSigner creates a DKIMSigner from a PEM encoded private key file
+// (PKCS#1 RSA or PKCS#8 RSA/Ed25519)
+func LoadDKIMSigner(domain, selector, keyPath string) (*DKIMSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, fmt.Errorf("DKIM domain and selector are required")
+	}
+
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DKIM private key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in DKIM private key %s", keyPath)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported DKIM private key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DKIM private key: %w", err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &DKIMSigner{Domain: domain, Selector: selector, Key: k}, nil
+	case ed25519.PrivateKey:
+		return &DKIMSigner{Domain: domain, Selector: selector, Key: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key algorithm %T", key)
+	}
+}
+
+// algorithm returns the DKIM a= tag for the signer's key
+func (s *DKIMSigner) algorithm() (string, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("unsupported DKIM key algorithm %T", s.Key)
+	}
+}
+
+// DNSRecord returns the TXT record to publish at <selector>._domainkey.<domain>
+func (s *DKIMSigner) DNSRecord() (string, error) {
+	switch pub := s.Key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	default:
+		return "", fmt.Errorf("unsupported DKIM key algorithm %T", pub)
+	}
+}
+
+// Sign returns message with a DKIM-Signature header prepended
+func (s *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	algorithm, err := s.algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	// SMTP DATA transmits CRLF line endings, so sign exactly that
+	message = normalizeCRLF(message)
+	headers, body := splitMessage(message)
+
+	bodyHash := sha256.Sum256(canonicalizeBodyRelaxed(body))
+
+	names := s.Headers
+	if len(names) == 0 {
+		names = defaultDKIMHeaders
+	}
+	signed, fields := selectHeaders(headers, names)
+	if len(signed) == 0 {
+		return nil, fmt.Errorf("message has none of the headers to sign")
+	}
+
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		algorithm, s.Domain, s.Selector, time.Now().Unix(),
+		strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	hash := sha256.New()
+	for _, field := range fields {
+		hash.Write([]byte(canonicalizeHeaderRelaxed(field)))
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalizeHeaderRelaxed("DKIM-Signature: "+value), "\r\n")))
+	digest := hash.Sum(nil)
+
+	var signature []byte
+	switch key := s.Key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, digest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign message: %w", err)
+	}
+
+	var header strings.Builder
+	writeHeader(&header, "DKIM-Signature", value+base64.StdEncoding.EncodeToString(signature))
+
+	return append([]byte(header.String()), message...), nil
+}
+
+// VerifyDKIM checks the first DKIM-Signature of message against publicKey.
+// It is meant for checking signatures locally, e.g. against the key that is
+// published in DNS, and does not perform any DNS lookups itself.
+// Only the relaxed/relaxed canonicalization DKIMSigner produces is
+// supported, signatures with any other c= are rejected.
+func VerifyDKIM(message []byte, publicKey crypto.PublicKey) error {
+	message = normalizeCRLF(message)
+	headers, body := splitMessage(message)
+
+	var signatureField string
+	for _, field := range headers {
+		if strings.EqualFold(headerName(field), "DKIM-Signature") {
+			signatureField = field
+			break
+		}
+	}
+	if signatureField == "" {
+		return fmt.Errorf("message has no DKIM-Signature header")
+	}
+
+	tags := parseDKIMTags(signatureField[strings.Index(signatureField, ":")+1:])
+	if tags["v"] != "1" {
+		return fmt.Errorf("unsupported DKIM version %q", tags["v"])
+	}
+	if tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("unsupported DKIM canonicalization %q", tags["c"])
+	}
+
+	bodyHash := sha256.Sum256(canonicalizeBodyRelaxed(body))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return fmt.Errorf("DKIM body hash mismatch")
+	}
+
+	// Every header but the signature itself, which is hashed last with an empty b=
+	var others []string
+	for _, field := range headers {
+		if field != signatureField {
+			others = append(others, field)
+		}
+	}
+	_, fields := selectHeaders(others, strings.Split(tags["h"], ":"))
+
+	hash := sha256.New()
+	for _, field := range fields {
+		hash.Write([]byte(canonicalizeHeaderRelaxed(field)))
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalizeHeaderRelaxed(stripSignatureValue(signatureField)), "\r\n")))
+	digest := hash.Sum(nil)
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("invalid DKIM signature encoding: %w", err)
+	}
+
+	switch tags["a"] {
+	case "rsa-sha256":
+		key, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("rsa-sha256 signature needs an RSA public key, got %T", publicKey)
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature); err != nil {
+			return fmt.Errorf("DKIM signature mismatch: %w", err)
+		}
+	case "ed25519-sha256":
+		key, ok := publicKey.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("ed25519-sha256 signature needs an Ed25519 public key, got %T", publicKey)
+		}
+		if !ed25519.Verify(key, digest, signature) {
+			return fmt.Errorf("DKIM signature mismatch")
+		}
+	default:
+		return fmt.Errorf("unsupported DKIM algorithm %q", tags["a"])
+	}
+
+	return nil
+}
+
+// normalizeCRLF converts bare LF line endings to CRLF
+func normalizeCRLF(message []byte) []byte {
+	message = bytes.ReplaceAll(message, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(message, []byte("\n"), []byte("\r\n"))
+}
+
+// splitMessage splits a CRLF message into its raw header fields, each still
+// folded and CRLF terminated, and its body
+func splitMessage(message []byte) ([]string, []byte) {
+	head, body, _ := bytes.Cut(message, []byte("\r\n\r\n"))
+	return splitHeaderFields(string(head) + "\r\n"), body
+}
+
+func splitHeaderFields(head string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(head, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func headerName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// selectHeaders picks the fields to sign for each name, taking repeated
+// fields from the bottom up as RFC 6376 section 5.4.2 requires. It returns
+// the names actually found and the matching raw fields.
+func selectHeaders(fields []string, names []string) ([]string, []string) {
+	used := make(map[int]bool)
+	var signed, selected []string
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headerName(fields[i]), name) {
+				used[i] = true
+				signed = append(signed, strings.ToLower(name))
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+	return signed, selected
+}
+
+// canonicalizeHeaderRelaxed applies the "relaxed" header canonicalization
+// of RFC 6376 section 3.4.2
+func canonicalizeHeaderRelaxed(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = compressWSP(strings.ReplaceAll(value, "\r\n", ""))
+	return strings.ToLower(strings.TrimRightFunc(name, isWSP)) + ":" + strings.TrimPrefix(value, " ") + "\r\n"
+}
+
+// canonicalizeBodyRelaxed applies the "relaxed" body canonicalization of
+// RFC 6376 section 3.4.4
+func canonicalizeBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = compressWSP(line)
+	}
+	// Empty lines at the end of the body are ignored
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// compressWSP reduces runs of whitespace to a single space and drops
+// trailing whitespace
+func compressWSP(line string) string {
+	var result strings.Builder
+	pending := false
+	for _, r := range line {
+		if isWSP(r) {
+			pending = true
+			continue
+		}
+		if pending {
+			result.WriteByte(' ')
+			pending = false
+		}
+		result.WriteRune(r)
+	}
+	return result.String()
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// parseDKIMTags parses a tag=value list, removing all whitespace from values
+func parseDKIMTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		name, val, found := strings.Cut(tag, "=")
+		if !found {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.Map(func(r rune) rune {
+			if isWSP(r) || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, val)
+	}
+	return tags
+}
+
+// stripSignatureValue empties the b= tag of a DKIM-Signature field
+func stripSignatureValue(field string) string {
+	var result strings.Builder
+	for i, tag := range strings.Split(field, ";") {
+		if i > 0 {
+			result.WriteString(";")
+		}
+		if name, _, found := strings.Cut(tag, "="); found && strings.TrimSpace(name) == "b" {
+			result.WriteString(name + "=")
+			continue
+		}
+		result.WriteString(tag)
+	}
+	return result.String()
+}
@@ -0,0 +1,219 @@
+package mailer
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dkimKeys returns an RSA-2048 and an Ed25519 signer with their public keys
+func dkimKeys(t *testing.T) map[string]struct {
+	signer *DKIMSigner
+	public crypto.PublicKey
+} {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]struct {
+		signer *DKIMSigner
+		public crypto.PublicKey
+	}{
+		"rsa-sha256":     {&DKIMSigner{Domain: "example.com", Selector: "mail", Key: rsaKey}, &rsaKey.PublicKey},
+		"ed25519-sha256": {&DKIMSigner{Domain: "example.com", Selector: "mail", Key: edKey}, edPublic},
+	}
+}
+
+// dkimTestMessage builds a message the way the mailer sends it
+func dkimTestMessage(t *testing.T) []byte {
+	t.Helper()
+	_, msg, err := prepareMessage(EmailData{
+		To:      []string{"Jane Doe <jane@example.com>"},
+		Cc:      []string{"bob@example.com"},
+		Subject: "Your invoice for October",
+		Body:    "Hello Jane,\n\nYour invoice is attached.\n\nThanks",
+	}, SMTPConfig{Email: "billing@example.com", FromName: "Acme Billing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDKIMSignVerify(t *testing.T) {
+	for algorithm, key := range dkimKeys(t) {
+		t.Run(algorithm, func(t *testing.T) {
+			signed, err := key.signer.Sign(dkimTestMessage(t))
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			fields, _ := splitMessage(signed)
+			if headerName(fields[0]) != "DKIM-Signature" {
+				t.Fatalf("message does not start with a DKIM-Signature:\n%s", signed)
+			}
+			_, value, _ := strings.Cut(fields[0], ":")
+			tags := parseDKIMTags(value)
+			for name, want := range map[string]string{"v": "1", "a": algorithm, "c": "relaxed/relaxed", "d": "example.com", "s": "mail"} {
+				if tags[name] != want {
+					t.Errorf("%s=%q, want %q", name, tags[name], want)
+				}
+			}
+			if err := VerifyDKIM(signed, key.public); err != nil {
+				t.Fatalf("VerifyDKIM: %v", err)
+			}
+
+			t.Run("changed body", func(t *testing.T) {
+				tampered := strings.Replace(string(signed), "Your invoice is attached.", "Your invoice is attached!", 1)
+				if tampered == string(signed) {
+					t.Fatal("body text not found")
+				}
+				if err := VerifyDKIM([]byte(tampered), key.public); err == nil {
+					t.Error("VerifyDKIM accepted a changed body")
+				}
+			})
+
+			t.Run("changed signed header", func(t *testing.T) {
+				tampered := strings.Replace(string(signed), "Subject: Your invoice for October", "Subject: Your invoice for November", 1)
+				if tampered == string(signed) {
+					t.Fatal("subject not found")
+				}
+				if err := VerifyDKIM([]byte(tampered), key.public); err == nil {
+					t.Error("VerifyDKIM accepted a changed subject")
+				}
+			})
+
+			t.Run("added header of a signed name", func(t *testing.T) {
+				// Signed fields are taken from the bottom, so a second
+				// Subject below the first replaces it for verifiers
+				head, body, _ := strings.Cut(string(signed), "\r\n\r\n")
+				tampered := head + "\r\nSubject: Urgent: pay now\r\n\r\n" + body
+				if err := VerifyDKIM([]byte(tampered), key.public); err == nil {
+					t.Error("VerifyDKIM accepted an added Subject")
+				}
+			})
+
+			t.Run("whitespace changes", func(t *testing.T) {
+				// Relaxed canonicalization ignores changes to whitespace
+				// runs, trailing whitespace, header folding, header name
+				// case and trailing empty lines
+				relaxed := string(signed)
+				relaxed = strings.Replace(relaxed, "Subject: Your invoice for October", "subject:   Your invoice\r\n\tfor  October  ", 1)
+				relaxed = strings.Replace(relaxed, "Your invoice is attached.", "Your  invoice\tis attached.   ", 1)
+				relaxed += "\r\n\r\n"
+				if err := VerifyDKIM([]byte(relaxed), key.public); err != nil {
+					t.Errorf("VerifyDKIM rejected whitespace changes: %v", err)
+				}
+			})
+
+			t.Run("bare LF", func(t *testing.T) {
+				if err := VerifyDKIM([]byte(strings.ReplaceAll(string(signed), "\r\n", "\n")), key.public); err != nil {
+					t.Errorf("VerifyDKIM rejected LF line endings: %v", err)
+				}
+			})
+		})
+	}
+}
+
+func TestVerifyDKIMWrongKey(t *testing.T) {
+	keys := dkimKeys(t)
+	other := dkimKeys(t)
+	for algorithm, key := range keys {
+		signed, err := key.signer.Sign(dkimTestMessage(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyDKIM(signed, other[algorithm].public); err == nil {
+			t.Errorf("%s: VerifyDKIM accepted another key", algorithm)
+		}
+	}
+	signed, err := keys["rsa-sha256"].signer.Sign(dkimTestMessage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDKIM(signed, keys["ed25519-sha256"].public); err == nil {
+		t.Error("VerifyDKIM accepted an Ed25519 key for an RSA signature")
+	}
+}
+
+func TestVerifyDKIMRejectsOtherCanonicalization(t *testing.T) {
+	key := dkimKeys(t)["ed25519-sha256"]
+	signed, err := key.signer.Sign(dkimTestMessage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"simple/simple", "relaxed/simple", "relaxed"} {
+		changed := strings.Replace(string(signed), "c=relaxed/relaxed", "c="+c, 1)
+		if err := VerifyDKIM([]byte(changed), key.public); err == nil || !strings.Contains(err.Error(), "canonicalization") {
+			t.Errorf("c=%s: VerifyDKIM = %v, want an unsupported canonicalization error", c, err)
+		}
+	}
+	if err := VerifyDKIM(dkimTestMessage(t), key.public); err == nil {
+		t.Error("VerifyDKIM accepted an unsigned message")
+	}
+}
+
+func TestPrepareMessageDKIM(t *testing.T) {
+	key := dkimKeys(t)["rsa-sha256"]
+	_, msg, err := prepareMessage(EmailData{
+		To:      []string{"jane@example.com"},
+		Subject: "Signed",
+		Body:    "<p>Hello</p>",
+		IsHTML:  true,
+	}, SMTPConfig{Email: "noreply@example.com", DKIM: key.signer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDKIM(msg, key.public); err != nil {
+		t.Errorf("VerifyDKIM of a multipart message: %v", err)
+	}
+}
+
+func TestLoadDKIMSigner(t *testing.T) {
+	dir := t.TempDir()
+	keys := dkimKeys(t)
+
+	rsaKey := keys["rsa-sha256"].signer.Key.(*rsa.PrivateKey)
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(keys["ed25519-sha256"].signer.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"rsa.pem":     pkcs1,
+		"ed25519.pem": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+		"bad.pem":     []byte("not a key"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, algorithm := range map[string]string{"rsa.pem": "rsa-sha256", "ed25519.pem": "ed25519-sha256"} {
+		signer, err := LoadDKIMSigner("example.com", "mail", filepath.Join(dir, file))
+		if err != nil {
+			t.Fatalf("LoadDKIMSigner(%s): %v", file, err)
+		}
+		signed, err := signer.Sign(dkimTestMessage(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyDKIM(signed, keys[algorithm].public); err != nil {
+			t.Errorf("%s: VerifyDKIM: %v", file, err)
+		}
+	}
+	if _, err := LoadDKIMSigner("example.com", "mail", filepath.Join(dir, "bad.pem")); err == nil {
+		t.Error("LoadDKIMSigner accepted a file without a key")
+	}
+}
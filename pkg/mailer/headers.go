@@ -0,0 +1,113 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxHeaderLineLength is the line length RFC 5322 asks header lines to stay within
+const maxHeaderLineLength = 78
+
+// contentIDPattern matches the Content-IDs accepted for inline parts: the
+// characters of an RFC 5322 dot-atom, optionally with an @domain
+var contentIDPattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+/=?^_`{|}~.@-]+$")
+
+// writeHeader writes a header field, folding the value at whitespace so that
+// lines stay within maxHeaderLineLength where possible
+func writeHeader(message *strings.Builder, name, value string) {
+	message.WriteString(name)
+	message.WriteString(":")
+
+	lineLength := len(name) + 1
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && lineLength+1+len(word) > maxHeaderLineLength {
+			message.WriteString("\r\n")
+			lineLength = 0
+		}
+		message.WriteString(" ")
+		message.WriteString(word)
+		lineLength += 1 + len(word)
+	}
+
+	message.WriteString("\r\n")
+}
+
+// encodeHeader encodes a free-form header value per RFC 2047. ASCII values
+// are returned unchanged.
+func encodeHeader(value string) string {
+	return mime.QEncoding.Encode("UTF-8", value)
+}
+
+// formatAddressList formats addresses for a To/Cc/Reply-To header, encoding
+// non-ASCII display names per RFC 2047. Addresses that do not parse are an
+// error, they would be written to the header as given.
+func formatAddressList(addrs []string) (string, error) {
+	formatted := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			return "", fmt.Errorf("invalid address %q: %w", addr, err)
+		}
+		formatted = append(formatted, parsed.String())
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+// validateHeaderValues rejects line breaks in the values that end up in
+// message or part headers, or in the SMTP envelope, where they would start
+// new header fields or commands
+func validateHeaderValues(emailData EmailData, config SMTPConfig) error {
+	fields := []struct {
+		name   string
+		values []string
+	}{
+		{"subject", []string{emailData.Subject}},
+		{"to", emailData.To},
+		{"cc", emailData.Cc},
+		{"bcc", emailData.Bcc},
+		{"reply-to", []string{emailData.ReplyTo}},
+		{"message ID", []string{emailData.MessageID}},
+		{"sender name", []string{config.FromName}},
+		{"sender address", []string{config.Email}},
+	}
+	for _, field := range fields {
+		for _, value := range field.values {
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("%s must not contain line breaks", field.name)
+			}
+		}
+	}
+	for i, attachment := range slices.Concat(emailData.Attachments, emailData.Inline) {
+		if strings.ContainsAny(attachment.Filename, "\r\n") || strings.ContainsAny(attachment.ContentType, "\r\n") {
+			return fmt.Errorf("attachment %d: filename and content type must not contain line breaks", i)
+		}
+	}
+	return nil
+}
+
+// generateMessageID creates a globally unique Message-ID on the sender's domain
+func generateMessageID(sender string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate message ID: %w", err)
+	}
+
+	domain := "localhost"
+	if at := strings.LastIndex(sender, "@"); at != -1 && at < len(sender)-1 {
+		domain = sender[at+1:]
+	}
+
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random), domain), nil
+}
+
+// ValidContentID reports whether id can be used as the Content-ID of an inline part
+func ValidContentID(id string) bool {
+	return contentIDPattern.MatchString(id)
+}
@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatAddressList(t *testing.T) {
+	tests := []struct {
+		name    string
+		addrs   []string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", addrs: []string{"jane@example.com"}, want: "<jane@example.com>"},
+		{name: "display name", addrs: []string{"Jane Doe <jane@example.com>", "bob@example.com"}, want: `"Jane Doe" <jane@example.com>, <bob@example.com>`},
+		{name: "non-ASCII name", addrs: []string{"Zoë <zoe@example.com>"}, want: "=?utf-8?q?Zo=C3=AB?= <zoe@example.com>"},
+		{name: "not an address", addrs: []string{"not an address"}, wantErr: true},
+		{name: "CRLF payload", addrs: []string{"jane@example.com\r\nBcc: evil@example.com"}, wantErr: true},
+		{name: "bad address among good", addrs: []string{"jane@example.com", "x\nSubject: hi"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatAddressList(tt.addrs)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("formatAddressList(%q) = %q, want an error", tt.addrs, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("formatAddressList(%q): %v", tt.addrs, err)
+			}
+			if got != tt.want {
+				t.Errorf("formatAddressList(%q) = %q, want %q", tt.addrs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareMessageRejectsLineBreaks(t *testing.T) {
+	config := SMTPConfig{Email: "sender@example.com", FromName: "Sender"}
+	valid := func() EmailData {
+		return EmailData{
+			To:      []string{"jane@example.com"},
+			Subject: "Hello",
+			Body:    "Hi Jane",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*EmailData, *SMTPConfig)
+	}{
+		{"subject CRLF", func(e *EmailData, _ *SMTPConfig) { e.Subject = "Hello\r\nBcc: evil@example.com" }},
+		{"subject LF", func(e *EmailData, _ *SMTPConfig) { e.Subject = "Hello\nX-Evil: 1" }},
+		{"to", func(e *EmailData, _ *SMTPConfig) { e.To = []string{"jane@example.com\r\nBcc: evil@example.com"} }},
+		{"cc", func(e *EmailData, _ *SMTPConfig) { e.Cc = []string{"bob@example.com\r\nX-Evil: 1"} }},
+		{"bcc", func(e *EmailData, _ *SMTPConfig) { e.Bcc = []string{"bob@example.com\r\nRCPT TO:<evil@example.com>"} }},
+		{"reply-to", func(e *EmailData, _ *SMTPConfig) { e.ReplyTo = "bob@example.com\nX-Evil: 1" }},
+		{"message ID", func(e *EmailData, _ *SMTPConfig) { e.MessageID = "<a@b>\r\nX-Evil: 1" }},
+		{"sender name", func(_ *EmailData, c *SMTPConfig) { c.FromName = "Sender\r\nX-Evil: 1" }},
+		{"attachment filename", func(e *EmailData, _ *SMTPConfig) {
+			e.Attachments = []Attachment{{Filename: "a.txt\r\nX-Evil: 1", Data: []byte("a")}}
+		}},
+		{"attachment content type", func(e *EmailData, _ *SMTPConfig) {
+			e.Attachments = []Attachment{{Filename: "a.txt", ContentType: "text/plain\r\nX-Evil: 1", Data: []byte("a")}}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emailData, cfg := valid(), config
+			tt.modify(&emailData, &cfg)
+			if _, msg, err := prepareMessage(emailData, cfg); err == nil {
+				t.Fatalf("prepareMessage accepted a line break, message:\n%s", msg)
+			}
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		emailData := valid()
+		emailData.Subject = "Grüße aus Nairobi"
+		_, msg, err := prepareMessage(emailData, config)
+		if err != nil {
+			t.Fatalf("prepareMessage: %v", err)
+		}
+		if !strings.Contains(string(msg), "Subject: =?UTF-8?q?Gr=C3=BC=C3=9Fe_aus_Nairobi?=\r\n") {
+			t.Errorf("subject not encoded, message:\n%s", msg)
+		}
+	})
+}
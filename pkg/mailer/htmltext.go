@@ -0,0 +1,286 @@
+package mailer
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToText converts an HTML email body to a plain-text alternative. Links
+// keep their target as "text (url)", images their alt text, lists become
+// "- item" or "1. item" lines and every table row is flattened to a single
+// line with its cells separated by " | ".
+func HTMLToText(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		// html.Parse only fails on read errors, which strings.Reader never returns
+		return body
+	}
+
+	var w textWriter
+	w.walk(doc)
+	return w.String()
+}
+
+// textWriter accumulates plain text while walking an HTML tree. It collapses
+// whitespace the way a browser would and tracks line breaks so block
+// elements never produce more than one blank line.
+type textWriter struct {
+	b        strings.Builder
+	newlines int    // trailing newlines written
+	space    bool   // a collapsed space is pending
+	sep      string // cell separator pending before the next text on this line
+	pre      int    // depth of <pre> elements
+	lists    []*listState
+	inRow    bool // a cell of the current table row has been opened
+}
+
+type listState struct {
+	ordered bool
+	n       int
+}
+
+// skippedElements have no visible text content
+var skippedElements = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Template: true,
+	atom.Noscript: true,
+	atom.Title:    true,
+}
+
+// blockElements start and end on their own line
+var blockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Center: true, atom.Dd: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+	atom.Fieldset: true, atom.Figcaption: true, atom.Figure: true, atom.Footer: true,
+	atom.Form: true, atom.Header: true, atom.Main: true, atom.Nav: true,
+	atom.Section: true, atom.Table: true, atom.Tbody: true, atom.Thead: true,
+	atom.Tfoot: true, atom.Caption: true,
+}
+
+// paragraphElements are separated from their surroundings by a blank line
+var paragraphElements = map[atom.Atom]bool{
+	atom.P: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true,
+	atom.H5: true, atom.H6: true,
+}
+
+func (w *textWriter) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			w.walk(c)
+		}
+		return
+	}
+
+	if skippedElements[n.DataAtom] {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		w.raw("\n")
+		return
+	case atom.Hr:
+		w.lineBreak(2)
+		w.raw("----------")
+		w.lineBreak(2)
+		return
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			w.text(alt)
+		}
+		return
+	case atom.A:
+		w.link(n)
+		return
+	case atom.Tr:
+		w.lineBreak(1)
+		inRow := w.inRow
+		w.inRow = false
+		w.children(n)
+		w.inRow = inRow
+		w.lineBreak(1)
+		return
+	case atom.Td, atom.Th:
+		if w.inRow && w.newlines == 0 {
+			w.sep = " | "
+		}
+		w.inRow = true
+		w.children(n)
+		return
+	case atom.Ul, atom.Ol:
+		// Nested lists continue their parent list without a blank line
+		gap := 2
+		if len(w.lists) > 0 {
+			gap = 1
+		}
+		w.lineBreak(gap)
+		w.lists = append(w.lists, &listState{ordered: n.DataAtom == atom.Ol})
+		w.children(n)
+		w.lists = w.lists[:len(w.lists)-1]
+		w.lineBreak(gap)
+		return
+	case atom.Li:
+		w.listItem(n)
+		return
+	case atom.Pre:
+		w.lineBreak(2)
+		w.pre++
+		w.children(n)
+		w.pre--
+		w.lineBreak(2)
+		return
+	}
+
+	switch {
+	case paragraphElements[n.DataAtom]:
+		w.lineBreak(2)
+		w.children(n)
+		w.lineBreak(2)
+	case blockElements[n.DataAtom]:
+		w.lineBreak(1)
+		w.children(n)
+		w.lineBreak(1)
+	default:
+		w.children(n)
+	}
+}
+
+func (w *textWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.walk(c)
+	}
+}
+
+// link writes the link text followed by its target, leaving out targets
+// that carry no information (anchors, scripts, or the text itself)
+func (w *textWriter) link(n *html.Node) {
+	start := w.b.Len()
+	w.children(n)
+	text := strings.TrimSpace(w.b.String()[start:])
+
+	href := strings.TrimSpace(attr(n, "href"))
+	switch {
+	case href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:"):
+		return
+	case text == "":
+		w.text(href)
+	case text == href || "mailto:"+text == href || "tel:"+text == href:
+		return
+	default:
+		w.space = true
+		w.text("(" + href + ")")
+	}
+}
+
+// listItem writes an item of the innermost list
+func (w *textWriter) listItem(n *html.Node) {
+	w.lineBreak(1)
+
+	marker := "- "
+	depth := len(w.lists)
+	if depth > 0 {
+		list := w.lists[depth-1]
+		list.n++
+		if list.ordered {
+			marker = strconv.Itoa(list.n) + ". "
+		}
+	} else {
+		depth = 1
+	}
+	w.raw(strings.Repeat("  ", depth-1) + marker)
+
+	w.children(n)
+	w.lineBreak(1)
+}
+
+// text writes character data, collapsing whitespace outside <pre>
+func (w *textWriter) text(s string) {
+	if w.pre > 0 {
+		w.raw(s)
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" && w.newlines == 0 {
+			w.space = true
+		}
+		return
+	}
+
+	leading := s[0] == ' ' || s[0] == '\t' || s[0] == '\n' || s[0] == '\r'
+	if w.newlines == 0 {
+		if w.sep != "" {
+			w.b.WriteString(w.sep)
+		} else if (w.space || leading) && !strings.HasSuffix(w.b.String(), " ") {
+			w.b.WriteString(" ")
+		}
+	}
+	w.sep = ""
+	w.b.WriteString(strings.Join(words, " "))
+	w.newlines = 0
+
+	last := s[len(s)-1]
+	w.space = last == ' ' || last == '\t' || last == '\n' || last == '\r'
+}
+
+// raw writes s unchanged
+func (w *textWriter) raw(s string) {
+	if s == "" {
+		return
+	}
+	w.b.WriteString(s)
+	if trailing := len(s) - len(strings.TrimRight(s, "\n")); trailing == len(s) {
+		w.newlines += trailing
+	} else {
+		w.newlines = trailing
+	}
+	w.space = false
+	w.sep = ""
+}
+
+// lineBreak ends the current line so that at least n newlines precede the
+// next text. Nothing is written before the first text.
+func (w *textWriter) lineBreak(n int) {
+	w.space = false
+	w.sep = ""
+	if w.b.Len() == 0 {
+		return
+	}
+	for w.newlines < n {
+		w.b.WriteString("\n")
+		w.newlines++
+	}
+}
+
+// String returns the text with trailing spaces removed from every line
+func (w *textWriter) String() string {
+	lines := strings.Split(w.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	text := strings.TrimSpace(strings.Join(lines, "\n"))
+	if text == "" {
+		return ""
+	}
+	return text + "\n"
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package mailer
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "whitespace",
+			html: "<p>  Hello \n\t <b>dear</b>   friend,</p>\n\n<p>Welcome <i>aboard</i>.</p>",
+			want: "Hello dear friend,\n\nWelcome aboard.\n",
+		},
+		{
+			name: "skipped elements",
+			html: "<html><head><title>Title</title><style>p {}</style></head><body><script>alert(1)</script><h1>Hi</h1></body></html>",
+			want: "Hi\n",
+		},
+		{
+			name: "links",
+			html: `<p><a href="https://example.com/verify">Verify your email</a> or visit <a href="https://example.com">https://example.com</a>.</p>`,
+			want: "Verify your email (https://example.com/verify) or visit https://example.com.\n",
+		},
+		{
+			name: "mailto link",
+			html: `<p>Write to <a href="mailto:help@example.com">help@example.com</a> or <a href="mailto:help@example.com">support</a></p>`,
+			want: "Write to help@example.com or support (mailto:help@example.com)\n",
+		},
+		{
+			name: "anchor and script links",
+			html: `<p><a href="#top">Back to top</a> <a href="javascript:void(0)">Open</a> <a href="">Empty</a></p>`,
+			want: "Back to top Open Empty\n",
+		},
+		{
+			name: "link without text",
+			html: `<p>Go to <a href="https://example.com/x"></a></p>`,
+			want: "Go to https://example.com/x\n",
+		},
+		{
+			name: "image alt text",
+			html: `<p><img src="logo.png" alt="Acme"> <img src="spacer.gif"></p>`,
+			want: "Acme\n",
+		},
+		{
+			name: "nested lists",
+			html: "<p>Steps:</p><ol><li>Open the app</li><li>Go to settings<ul><li>Account</li><li>Security</li></ul></li><li>Done</li></ol><p>Thanks</p>",
+			want: "Steps:\n\n1. Open the app\n2. Go to settings\n  - Account\n  - Security\n3. Done\n\nThanks\n",
+		},
+		{
+			name: "table",
+			html: "<table><tr><th>Item</th><th>Qty</th><th>Price</th></tr><tr><td>Spores</td><td></td><td>$5</td></tr><tr><td></td><td>2</td><td>$10</td></tr></table>",
+			want: "Item | Qty | Price\nSpores | $5\n2 | $10\n",
+		},
+		{
+			name: "pre",
+			html: "<p>Run:</p><pre>go run main.go\n  --port  8080</pre><p>Then wait.</p>",
+			want: "Run:\n\ngo run main.go\n  --port  8080\n\nThen wait.\n",
+		},
+		{
+			name: "br and hr",
+			html: "<div>Line one<br>Line two</div><hr><div>Footer</div>",
+			want: "Line one\nLine two\n\n----------\n\nFooter\n",
+		},
+		{
+			name: "empty",
+			html: "<div> </div>",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HTMLToText(tt.html); got != tt.want {
+				t.Errorf("HTMLToText(%q)\n got: %q\nwant: %q", tt.html, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package mailer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DefaultLocale ends every locale fallback chain
+const DefaultLocale = "en"
+
+var (
+	languagePattern = regexp.MustCompile(`^[a-z]{2,3}$`)
+	subtagPattern   = regexp.MustCompile(`^[a-z0-9]{1,8}$`)
+)
+
+// NormalizeLocale canonicalizes a BCP 47 style locale, e.g. "sw_ke" becomes
+// "sw-KE" and "zh-hant-tw" becomes "zh-Hant-TW"
+func NormalizeLocale(locale string) (string, error) {
+	subtags := strings.Split(strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-")), "-")
+	if !languagePattern.MatchString(subtags[0]) {
+		return "", fmt.Errorf("invalid locale %q", locale)
+	}
+	for i, subtag := range subtags[1:] {
+		if !subtagPattern.MatchString(subtag) {
+			return "", fmt.Errorf("invalid locale %q", locale)
+		}
+		switch {
+		case len(subtag) == 2 && isLetters(subtag):
+			// Region
+			subtags[i+1] = strings.ToUpper(subtag)
+		case len(subtag) == 4 && isLetters(subtag):
+			// Script
+			subtags[i+1] = strings.ToUpper(subtag[:1]) + subtag[1:]
+		}
+	}
+	return strings.Join(subtags, "-"), nil
+}
+
+func isLetters(s string) bool {
+	for _, c := range s {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// localeChain returns the fallback chain of a normalized locale, most
+// specific first: sw-KE, sw, en
+func localeChain(locale string) []string {
+	var chain []string
+	for locale != "" {
+		chain = append(chain, locale)
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	if !slices.Contains(chain, DefaultLocale) {
+		chain = append(chain, DefaultLocale)
+	}
+	return chain
+}
+
+// AddMessages adds messages to the catalog of locale, replacing messages
+// with the same key
+func (r *TemplateRegistry) AddMessages(locale string, messages map[string]string) error {
+	locale, err := NormalizeLocale(locale)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.addMessages(locale, messages)
+	return nil
+}
+
+// Locales returns the locales that have a message catalog, sorted
+func (r *TemplateRegistry) Locales() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	locales := make([]string, 0, len(r.catalogs))
+	for locale := range r.catalogs {
+		locales = append(locales, locale)
+	}
+	slices.Sort(locales)
+	return locales
+}
+
+// Translate looks up a message along the fallback chain of locale. With args
+// the message is used as a fmt format.
+func (r *TemplateRegistry) Translate(locale, key string, args ...any) (string, error) {
+	return r.translator(r.resolveLocale(locale))(key, args...)
+}
+
+// resolveLocale returns the fallback chain of locale, keeping only locales
+// that have a catalog. An invalid or empty locale resolves to DefaultLocale.
+func (r *TemplateRegistry) resolveLocale(locale string) []string {
+	normalized, err := NormalizeLocale(locale)
+	if err != nil {
+		normalized = DefaultLocale
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var chain []string
+	for _, candidate := range localeChain(normalized) {
+		if _, ok := r.catalogs[candidate]; ok {
+			chain = append(chain, candidate)
+		}
+	}
+	if len(chain) == 0 {
+		chain = []string{DefaultLocale}
+	}
+	return chain
+}
+
+// translator returns the t template function for a resolved locale chain.
+// Messages are looked up when called, so catalogs loaded later are used.
+func (r *TemplateRegistry) translator(chain []string) func(key string, args ...any) (string, error) {
+	return func(key string, args ...any) (string, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		for _, locale := range chain {
+			message, ok := r.catalogs[locale][key]
+			if !ok {
+				continue
+			}
+			if len(args) > 0 {
+				return fmt.Sprintf(message, args...), nil
+			}
+			return message, nil
+		}
+		return "", fmt.Errorf("no message %q for locale %s", key, chain[0])
+	}
+}
+
+// loadCatalogs reads the <locale>.json catalogs in _locales/. Callers must
+// hold r.mu.
+func (r *TemplateRegistry) loadCatalogs(fsys fs.FS) error {
+	entries, err := fs.ReadDir(fsys, localesDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read message catalogs: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		locale, err := NormalizeLocale(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return fmt.Errorf("message catalog %s: %w", entry.Name(), err)
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(localesDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read message catalog: %w", err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(content, &messages); err != nil {
+			return fmt.Errorf("failed to parse message catalog %s: %w", entry.Name(), err)
+		}
+		r.addMessages(locale, messages)
+	}
+
+	return nil
+}
+
+// addMessages merges messages into a catalog. Callers must hold r.mu.
+func (r *TemplateRegistry) addMessages(locale string, messages map[string]string) {
+	if r.catalogs[locale] == nil {
+		r.catalogs[locale] = map[string]string{}
+	}
+	for key, message := range messages {
+		r.catalogs[locale][key] = message
+	}
+}
@@ -0,0 +1,75 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLocale(t *testing.T) {
+	tests := []struct {
+		locale  string
+		want    string
+		wantErr bool
+	}{
+		{locale: "en", want: "en"},
+		{locale: "EN", want: "en"},
+		{locale: "sw_ke", want: "sw-KE"},
+		{locale: " sw-KE ", want: "sw-KE"},
+		{locale: "zh-hant-tw", want: "zh-Hant-TW"},
+		{locale: "es-419", want: "es-419"},
+		{locale: "", wantErr: true},
+		{locale: "english", wantErr: true},
+		{locale: "en--US", wantErr: true},
+		{locale: "en-US/../..", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.locale, func(t *testing.T) {
+			got, err := NormalizeLocale(tt.locale)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NormalizeLocale(%q) = %q, want an error", tt.locale, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeLocale(%q): %v", tt.locale, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeLocale(%q) = %q, want %q", tt.locale, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveLocale(t *testing.T) {
+	registry := NewTemplateRegistry()
+	for _, locale := range []string{"en", "sw", "sw-KE", "zh-Hant"} {
+		if err := registry.AddMessages(locale, map[string]string{"greeting": locale}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		{locale: "sw-KE", want: "sw-KE sw en"},
+		{locale: "sw-TZ", want: "sw en"},
+		{locale: "zh-Hant-TW", want: "zh-Hant en"},
+		{locale: "fr", want: "en"},
+		{locale: "", want: "en"},
+		{locale: "???", want: "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.locale, func(t *testing.T) {
+			if got := strings.Join(registry.resolveLocale(tt.locale), " "); got != tt.want {
+				t.Errorf("resolveLocale(%q) = %s, want %s", tt.locale, got, tt.want)
+			}
+		})
+	}
+
+	// Without any catalog the chain still ends in the default locale
+	if got := NewTemplateRegistry().resolveLocale("sw-KE"); len(got) != 1 || got[0] != DefaultLocale {
+		t.Errorf("resolveLocale without catalogs = %v, want [%s]", got, DefaultLocale)
+	}
+}
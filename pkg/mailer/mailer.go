@@ -1,10 +1,20 @@
 package mailer
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
+	"encoding/base64"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
@@ -17,6 +27,7 @@ const (
 	OtpPurposePasswordReset OtpPurpose = "password_reset"
 	OtpPurposeVerification  OtpPurpose = "verification"
 	OtpPurposeRegistration  OtpPurpose = "registration"
+	OtpPurposeMagicLink     OtpPurpose = "magic_link" // passwordless sign-in links
 )
 
 // SMTPConfig holds the SMTP server configuration
@@ -26,14 +37,51 @@ type SMTPConfig struct {
 	Username string
 	Password string
 	Email    string
+	FromName string // optional display name for the sender, e.g. "Acme Support"
+
+	// TLS settings
+	TLSMode       TLSMode // defaults to implicit on port 465 and starttls otherwise
+	CAFile        string  // PEM bundle used instead of the system roots
+	CertFile      string  // client certificate, PEM
+	KeyFile       string  // client certificate key, PEM
+	MinTLSVersion string  // "1.0", "1.1", "1.2" (default) or "1.3"
+
+	// Authentication settings
+	AuthMechanism AuthMechanism // defaults to the best mechanism the server offers
+	TokenSource   TokenSource   // access tokens for XOAUTH2
+
+	// DKIM signs outgoing messages when set
+	DKIM *DKIMSigner
+
+	// Timeout bounds dialing and each SMTP command, default 30s. The context
+	// passed to the *Context functions can only shorten it.
+	Timeout time.Duration
 }
 
 // EmailData represents an email message
 type EmailData struct {
-	To      []string
-	Subject string
-	Body    string
-	IsHTML  bool
+	To          []string
+	Cc          []string
+	Bcc         []string // envelope only, never written to the headers
+	ReplyTo     string
+	Subject     string
+	Body        string
+	IsHTML      bool
+	TextBody    string       // plain-text alternative to an HTML Body, generated when empty
+	Inline      []Attachment // images the HTML Body references as cid:<ContentID>
+	Calendar    *Calendar    // invitation sent along with the body
+	Attachments []Attachment
+	MessageID   string // generated when empty
+}
+
+// Attachment represents a file attached to an email. Content is taken from
+// Reader when it is set, otherwise from Data.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	Reader      io.Reader
+	ContentID   string // inline parts only, without angle brackets
 }
 
 // OTPData represents OTP information
@@ -51,104 +99,220 @@ func ValidateConfig(config SMTPConfig) error {
 	if config.Port == 0 {
 		return fmt.Errorf("SMTP port is required")
 	}
-	if config.Username == "" {
-		return fmt.Errorf("SMTP username is required")
-	}
-	if config.Password == "" {
-		return fmt.Errorf("SMTP password is required")
-	}
 	if config.Email == "" {
 		return fmt.Errorf("SMTP email is required")
 	}
-	return nil
+	if err := validateAuthConfig(config); err != nil {
+		return err
+	}
+	return validateTLSConfig(config)
+}
+
+// SendEmail sends a generic email and returns its Message-ID
+func SendEmail(emailData EmailData, config SMTPConfig) (string, error) {
+	return SendEmailContext(context.Background(), emailData, config)
 }
 
-// SendEmail sends a generic email
-func SendEmail(emailData EmailData, config SMTPConfig) error {
+// SendEmailContext is like SendEmail but aborts when ctx is done
+func SendEmailContext(ctx context.Context, emailData EmailData, config SMTPConfig) (string, error) {
 	if err := ValidateConfig(config); err != nil {
-		return fmt.Errorf("SMTP configuration error: %w", err)
+		return "", fmt.Errorf("SMTP configuration error: %w", err)
 	}
 
+	messageID, msg, err := prepareMessage(emailData, config)
+	if err != nil {
+		return "", err
+	}
+
+	addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
+
+	if err := sendWithTLS(ctx, addr, config.Email, emailData.Recipients(), msg, config); err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+// prepareMessage validates emailData and renders the (DKIM signed) message.
+// It returns the message's Message-ID along with the raw message.
+func prepareMessage(emailData EmailData, config SMTPConfig) (string, []byte, error) {
 	// Validate email data
 	if len(emailData.To) == 0 {
-		return fmt.Errorf("recipient email address is required")
+		return "", nil, fmt.Errorf("recipient email address is required")
 	}
 	if emailData.Subject == "" {
-		return fmt.Errorf("email subject is required")
+		return "", nil, fmt.Errorf("email subject is required")
 	}
 	if emailData.Body == "" {
-		return fmt.Errorf("email body is required")
+		return "", nil, fmt.Errorf("email body is required")
+	}
+	if err := validateHeaderValues(emailData, config); err != nil {
+		return "", nil, err
+	}
+	for i, attachment := range emailData.Attachments {
+		if attachment.Filename == "" {
+			return "", nil, fmt.Errorf("attachment %d: filename is required", i)
+		}
+	}
+	if err := validateInline(emailData); err != nil {
+		return "", nil, err
+	}
+	if emailData.Calendar != nil {
+		calendar := emailData.Calendar.withDefaults(emailData, config)
+		if err := calendar.Validate(); err != nil {
+			return "", nil, fmt.Errorf("invalid calendar invitation: %w", err)
+		}
+		emailData.Calendar = &calendar
 	}
 
-	// Create authentication
-	auth := smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	if emailData.MessageID == "" {
+		messageID, err := generateMessageID(config.Email)
+		if err != nil {
+			return "", nil, err
+		}
+		emailData.MessageID = messageID
+	}
 
-	message := buildMessage(emailData, config)
+	message, err := buildMessage(emailData, config)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to build message: %w", err)
+	}
 
-	addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
+	msg := []byte(message)
+	if config.DKIM != nil {
+		if msg, err = config.DKIM.Sign(msg); err != nil {
+			return "", nil, fmt.Errorf("failed to DKIM sign message: %w", err)
+		}
+	}
 
-	return sendWithTLS(addr, auth, config.Email, emailData.To, []byte(message), config)
+	return emailData.MessageID, msg, nil
+}
+
+// Recipients returns every envelope recipient: To, Cc and Bcc. Display
+// names are dropped, RCPT TO only takes the address.
+func (e EmailData) Recipients() []string {
+	recipients := make([]string, 0, len(e.To)+len(e.Cc)+len(e.Bcc))
+	for _, list := range [][]string{e.To, e.Cc, e.Bcc} {
+		for _, addr := range list {
+			if parsed, err := mail.ParseAddress(addr); err == nil {
+				addr = parsed.Address
+			}
+			recipients = append(recipients, addr)
+		}
+	}
+	return recipients
 }
 
 // SendOTP generates and sends an OTP via email
 func SendOTP(email string, purpose OtpPurpose, otp string, config SMTPConfig) (string, error) {
+	return SendOTPContext(context.Background(), email, purpose, otp, config)
+}
+
+// SendOTPContext is like SendOTP but aborts when ctx is done
+func SendOTPContext(ctx context.Context, email string, purpose OtpPurpose, otp string, config SMTPConfig) (string, error) {
+	return SendLocalizedOTP(ctx, email, purpose, otp, "", config)
+}
+
+// SendLocalizedOTP sends an OTP email in locale, falling back along its
+// chain (sw-KE, sw, en). An empty locale sends the DefaultLocale email.
+func SendLocalizedOTP(ctx context.Context, email string, purpose OtpPurpose, otp, locale string, config SMTPConfig) (string, error) {
 	if email == "" {
 		return "", fmt.Errorf("email address is required")
 	}
 
-	subject := getOTPSubject(purpose)
-	body := getOTPBody(otp, purpose)
-
-	emailData := EmailData{
-		To:      []string{email},
-		Subject: subject,
-		Body:    body,
-		IsHTML:  true,
+	rendered, err := RenderOTP(otp, purpose, locale)
+	if err != nil {
+		return "", err
 	}
+	emailData := EmailData{To: []string{email}}
+	rendered.Apply(&emailData)
 
-	err := SendEmail(emailData, config)
-	if err != nil {
+	if _, err := SendEmailContext(ctx, emailData, config); err != nil {
 		return "", fmt.Errorf("%w", err)
 	}
 
-	log.Printf("OTP sent successfully to %s for purpose: %s", email, purpose)
+	slog.Info("OTP email sent", "purpose", purpose, "locale", DefaultTemplates.resolveLocale(locale)[0])
 	return otp, nil
 }
 
 // SendOTPWithCustomTemplate sends OTP with custom email template
 func SendOTPWithCustomTemplate(email string, purpose OtpPurpose, otp string, subject, htmlTemplate, textTemplate string, config SMTPConfig) (string, error) {
+	return SendOTPWithCustomTemplateContext(context.Background(), email, purpose, otp, subject, htmlTemplate, textTemplate, config)
+}
+
+// SendOTPWithCustomTemplateContext is like SendOTPWithCustomTemplate but aborts when ctx is done.
+// Templates whose only actions are {{OTP}} and {{PURPOSE}} are filled in by
+// plain substitution. Any other {{ makes both templates Go templates, HTML
+// parsed with html/template, where literal braces must be written as
+// {{"{{"}}.
+func SendOTPWithCustomTemplateContext(ctx context.Context, email string, purpose OtpPurpose, otp string, subject, htmlTemplate, textTemplate string, config SMTPConfig) (string, error) {
 	if email == "" {
 		return "", fmt.Errorf("email address is required")
 	}
 
-	// Replace placeholders in templates
-	htmlBody := strings.ReplaceAll(htmlTemplate, "{{OTP}}", otp)
-	htmlBody = strings.ReplaceAll(htmlBody, "{{PURPOSE}}", string(purpose))
-
-	textBody := strings.ReplaceAll(textTemplate, "{{OTP}}", otp)
-	textBody = strings.ReplaceAll(textBody, "{{PURPOSE}}", string(purpose))
-
-	// Create multipart message
-	body := buildMultipartMessage(htmlBody, textBody)
-
-	emailData := EmailData{
-		To:      []string{email},
-		Subject: subject,
-		Body:    body,
-		IsHTML:  true,
+	// Templates with no other actions than {{OTP}} and {{PURPOSE}} keep the
+	// plain substitution they had before templates were Go templates, so
+	// literal braces and HTML in the code or purpose are sent as written
+	if isPlaceholderTemplate(htmlTemplate) && isPlaceholderTemplate(textTemplate) {
+		if htmlTemplate == "" && textTemplate == "" {
+			return "", fmt.Errorf("template needs an HTML or text body")
+		}
+		replacer := strings.NewReplacer("{{OTP}}", otp, "{{PURPOSE}}", string(purpose))
+		emailData := EmailData{To: []string{email}}
+		RenderedTemplate{
+			HTML: replacer.Replace(htmlTemplate),
+			Text: replacer.Replace(textTemplate),
+		}.Apply(&emailData)
+		emailData.Subject = subject
+
+		if _, err := SendEmailContext(ctx, emailData, config); err != nil {
+			return "", fmt.Errorf("failed to send OTP email: %w", err)
+		}
+		slog.Info("OTP email sent with a custom template", "purpose", purpose)
+		return otp, nil
 	}
 
-	err := SendEmail(emailData, config)
+	// Other templates are Go templates; {{OTP}} and {{PURPOSE}} are kept as
+	// functions there too
+	registry := NewTemplateRegistry()
+	funcs := map[string]any{
+		"OTP":     func() string { return otp },
+		"PURPOSE": func() string { return string(purpose) },
+	}
+	if err := registry.Register("custom", 1, "", htmlTemplate, textTemplate, funcs); err != nil {
+		return "", err
+	}
+	rendered, err := registry.Render("custom", 1, otpTemplateData(otp, purpose))
 	if err != nil {
+		return "", err
+	}
+
+	emailData := EmailData{To: []string{email}}
+	rendered.Apply(&emailData)
+	emailData.Subject = subject
+
+	if _, err := SendEmailContext(ctx, emailData, config); err != nil {
 		return "", fmt.Errorf("failed to send OTP email: %w", err)
 	}
 
-	log.Printf("OTP with custom template sent successfully to %s for purpose: %s", email, purpose)
+	slog.Info("OTP email sent with a custom template", "purpose", purpose)
 	return otp, nil
 }
 
+// isPlaceholderTemplate tells whether a custom template uses no other
+// actions than the {{OTP}} and {{PURPOSE}} placeholders
+func isPlaceholderTemplate(tmpl string) bool {
+	tmpl = strings.ReplaceAll(tmpl, "{{OTP}}", "")
+	tmpl = strings.ReplaceAll(tmpl, "{{PURPOSE}}", "")
+	return !strings.Contains(tmpl, "{{")
+}
+
 // SendOTPWithExistingCode sends an existing OTP via email (for resend functionality)
 func SendOTPWithExistingCode(email string, purpose OtpPurpose, otp string, config SMTPConfig) error {
+	return SendOTPWithExistingCodeContext(context.Background(), email, purpose, otp, config)
+}
+
+// SendOTPWithExistingCodeContext is like SendOTPWithExistingCode but aborts when ctx is done
+func SendOTPWithExistingCodeContext(ctx context.Context, email string, purpose OtpPurpose, otp string, config SMTPConfig) error {
 	if email == "" {
 		return fmt.Errorf("email address is required")
 	}
@@ -156,109 +320,376 @@ func SendOTPWithExistingCode(email string, purpose OtpPurpose, otp string, confi
 		return fmt.Errorf("OTP is required")
 	}
 
-	subject := getOTPSubject(purpose)
-	body := getOTPBody(otp, purpose)
-
-	emailData := EmailData{
-		To:      []string{email},
-		Subject: subject,
-		Body:    body,
-		IsHTML:  true,
+	rendered, err := RenderOTP(otp, purpose, "")
+	if err != nil {
+		return err
 	}
+	emailData := EmailData{To: []string{email}}
+	rendered.Apply(&emailData)
 
-	err := SendEmail(emailData, config)
-	if err != nil {
+	if _, err := SendEmailContext(ctx, emailData, config); err != nil {
 		return fmt.Errorf("failed to resend OTP email: %w", err)
 	}
 
-	log.Printf("OTP resent successfully to %s for purpose: %s", email, purpose)
+	slog.Info("OTP email resent", "purpose", purpose)
 	return nil
 }
 
 // Helper functions
-func buildMessage(emailData EmailData, config SMTPConfig) string {
+func buildMessage(emailData EmailData, config SMTPConfig) (string, error) {
 	var message strings.Builder
 
 	// Headers
-	message.WriteString(fmt.Sprintf("From: %s\r\n", config.Email))
-	message.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(emailData.To, ", ")))
-	message.WriteString(fmt.Sprintf("Subject: %s\r\n", emailData.Subject))
+	from := mail.Address{Name: config.FromName, Address: config.Email}
+	writeHeader(&message, "From", from.String())
+	to, err := formatAddressList(emailData.To)
+	if err != nil {
+		return "", err
+	}
+	writeHeader(&message, "To", to)
+	if len(emailData.Cc) > 0 {
+		cc, err := formatAddressList(emailData.Cc)
+		if err != nil {
+			return "", err
+		}
+		writeHeader(&message, "Cc", cc)
+	}
+	if emailData.ReplyTo != "" {
+		replyTo, err := formatAddressList([]string{emailData.ReplyTo})
+		if err != nil {
+			return "", err
+		}
+		writeHeader(&message, "Reply-To", replyTo)
+	}
+	writeHeader(&message, "Subject", encodeHeader(emailData.Subject))
+	writeHeader(&message, "Date", time.Now().Format(time.RFC1123Z))
+	if emailData.MessageID != "" {
+		writeHeader(&message, "Message-ID", emailData.MessageID)
+	}
+	message.WriteString("MIME-Version: 1.0\r\n")
+
+	var calendar []byte
+	attachments := emailData.Attachments
+	if emailData.Calendar != nil {
+		var err error
+		if calendar, err = emailData.Calendar.Bytes(); err != nil {
+			return "", err
+		}
+		// Clients that ignore the text/calendar alternative can import the file
+		attachments = append(slices.Clip(attachments), Attachment{
+			Filename:    "invite.ics",
+			ContentType: "application/ics",
+			Data:        calendar,
+		})
+	}
 
-	if emailData.IsHTML {
-		message.WriteString("MIME-Version: 1.0\r\n")
-		message.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
-	} else {
-		message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	contentType, encoding, body, err := buildBody(emailData, calendar)
+	if err != nil {
+		return "", err
 	}
 
+	if len(attachments) == 0 {
+		message.WriteString(fmt.Sprintf("Content-Type: %s\r\n", contentType))
+		if encoding != "" {
+			message.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %s\r\n", encoding))
+		}
+		message.WriteString("\r\n")
+		message.Write(body)
+
+		return message.String(), nil
+	}
+
+	writer := multipart.NewWriter(&message)
+	message.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=%s\r\n", writer.Boundary()))
 	message.WriteString("\r\n")
-	message.WriteString(emailData.Body)
 
-	return message.String()
+	// Body part
+	header := textproto.MIMEHeader{"Content-Type": {contentType}}
+	if encoding != "" {
+		header.Set("Content-Transfer-Encoding", encoding)
+	}
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(body); err != nil {
+		return "", err
+	}
+
+	// Attachment parts
+	for _, attachment := range attachments {
+		if err := writeAttachment(writer, attachment, "attachment"); err != nil {
+			return "", fmt.Errorf("attachment %s: %w", attachment.Filename, err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return message.String(), nil
 }
 
-func buildMultipartMessage(htmlBody, textBody string) string {
-	boundary := fmt.Sprintf("boundary_%d", time.Now().Unix())
+// buildBody renders the body entity of a message: a single quoted-printable
+// part for plain text, or a multipart/alternative with the text part first
+// for HTML. The text alternative is generated from the HTML unless TextBody
+// is set, and an encoded calendar invitation is the last alternative. Inline
+// images wrap the alternatives in a multipart/related. encoding is empty for
+// multipart bodies.
+func buildBody(emailData EmailData, calendar []byte) (contentType, encoding string, body []byte, err error) {
+	contentType, encoding, body, err = buildAlternative(emailData, calendar)
+	if err != nil || len(emailData.Inline) == 0 {
+		return contentType, encoding, body, err
+	}
+	return buildRelated(contentType, encoding, body, emailData.Inline)
+}
 
-	var message strings.Builder
-	message.WriteString("MIME-Version: 1.0\r\n")
-	message.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=%s\r\n", boundary))
-	message.WriteString("\r\n")
+// buildAlternative renders the text and HTML bodies of emailData and the
+// calendar invitation
+func buildAlternative(emailData EmailData, calendar []byte) (contentType, encoding string, body []byte, err error) {
+	var buf bytes.Buffer
 
-	// Text part
-	message.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
-	message.WriteString("\r\n")
-	message.WriteString(textBody)
-	message.WriteString("\r\n")
+	if emailData.IsHTML && emailData.TextBody == "" {
+		emailData.TextBody = HTMLToText(emailData.Body)
+	}
 
-	// HTML part
-	message.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-	message.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
-	message.WriteString("\r\n")
-	message.WriteString(htmlBody)
-	message.WriteString("\r\n")
+	type alternative struct {
+		isHTML bool
+		body   string
+	}
+	// Clients show the last alternative they support, so HTML goes last
+	alternatives := []alternative{{emailData.IsHTML, emailData.Body}}
+	if emailData.IsHTML && emailData.TextBody != "" {
+		alternatives = []alternative{{false, emailData.TextBody}, {true, emailData.Body}}
+	}
 
-	message.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+	if len(alternatives) == 1 && calendar == nil {
+		if err := writeQuotedPrintable(&buf, emailData.Body); err != nil {
+			return "", "", nil, err
+		}
+		return bodyContentType(emailData.IsHTML), "quoted-printable", buf.Bytes(), nil
+	}
 
-	return message.String()
+	writer := multipart.NewWriter(&buf)
+	for _, alternative := range alternatives {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {bodyContentType(alternative.isHTML)},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", "", nil, err
+		}
+		if err := writeQuotedPrintable(part, alternative.body); err != nil {
+			return "", "", nil, err
+		}
+	}
+	if calendar != nil {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {calendarContentType(emailData.Calendar)},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return "", "", nil, err
+		}
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWriter{w: part})
+		if _, err := encoder.Write(calendar); err != nil {
+			return "", "", nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return "", "", nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", "", nil, err
+	}
+
+	return "multipart/alternative; boundary=" + writer.Boundary(), "", buf.Bytes(), nil
 }
 
-func sendWithTLS(addr string, auth smtp.Auth, from string, to []string, msg []byte, config SMTPConfig) error {
-	// Connect to server
-	client, err := smtp.Dial(addr)
+// calendarContentType returns the content type of a calendar invitation,
+// whose method parameter must match its METHOD property
+func calendarContentType(calendar *Calendar) string {
+	method := calendar.Method
+	if method == "" {
+		method = CalendarRequest
+	}
+	return "text/calendar; charset=UTF-8; method=" + string(method)
+}
+
+// buildRelated wraps the root body and its inline images in a
+// multipart/related entity (RFC 2387)
+func buildRelated(rootType, rootEncoding string, root []byte, inline []Attachment) (contentType, encoding string, body []byte, err error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	header := textproto.MIMEHeader{"Content-Type": {rootType}}
+	if rootEncoding != "" {
+		header.Set("Content-Transfer-Encoding", rootEncoding)
+	}
+	part, err := writer.CreatePart(header)
 	if err != nil {
-		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+		return "", "", nil, err
+	}
+	if _, err := part.Write(root); err != nil {
+		return "", "", nil, err
+	}
+
+	for _, image := range inline {
+		if err := writeAttachment(writer, image, "inline"); err != nil {
+			return "", "", nil, fmt.Errorf("inline %s: %w", image.ContentID, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", "", nil, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(rootType)
+	contentType = mime.FormatMediaType("multipart/related", map[string]string{
+		"type":     mediaType,
+		"boundary": writer.Boundary(),
+	})
+	return contentType, "", buf.Bytes(), nil
+}
+
+// validateInline checks the inline parts of emailData
+func validateInline(emailData EmailData) error {
+	if len(emailData.Inline) == 0 {
+		return nil
+	}
+	if !emailData.IsHTML {
+		return fmt.Errorf("inline images require an HTML body")
 	}
-	defer func() {
-		if closeErr := client.Close(); closeErr != nil {
-			log.Printf("Error closing SMTP client: %v", closeErr)
+
+	seen := map[string]bool{}
+	for i, image := range emailData.Inline {
+		if !contentIDPattern.MatchString(image.ContentID) {
+			return fmt.Errorf("inline %d: invalid content ID %q", i, image.ContentID)
 		}
-	}()
+		if seen[image.ContentID] {
+			return fmt.Errorf("inline %d: duplicate content ID %q", i, image.ContentID)
+		}
+		seen[image.ContentID] = true
+	}
+	return nil
+}
+
+// writeQuotedPrintable writes body with quoted-printable encoding, which
+// keeps lines under 76 characters with soft line breaks (RFC 2045)
+func writeQuotedPrintable(w io.Writer, body string) error {
+	encoder := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(encoder, body); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func bodyContentType(isHTML bool) string {
+	if isHTML {
+		return "text/html; charset=UTF-8"
+	}
+	return "text/plain; charset=UTF-8"
+}
+
+// writeAttachment adds a base64 encoded part to a multipart message.
+// disposition is "attachment" or "inline".
+func writeAttachment(writer *multipart.Writer, attachment Attachment, disposition string) error {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(attachment.Filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {disposition},
+	}
+	if attachment.Filename != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	}
+	if attachment.ContentID != "" {
+		header["Content-ID"] = []string{"<" + attachment.ContentID + ">"}
+	}
 
-	// Start TLS
-	tlsConfig := &tls.Config{
-		ServerName:         config.Host,
-		InsecureSkipVerify: false, // Set to true only for testing
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
 	}
 
-	if err = client.StartTLS(tlsConfig); err != nil {
-		return fmt.Errorf("failed to start TLS: %w", err)
+	content := attachment.Reader
+	if content == nil {
+		content = bytes.NewReader(attachment.Data)
 	}
 
+	encoder := base64.NewEncoder(base64.StdEncoding, &lineWriter{w: part})
+	if _, err := io.Copy(encoder, content); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// lineWriter breaks its output into CRLF terminated lines of at most 76
+// characters, as required for base64 encoded MIME bodies (RFC 2045)
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.col == 76 {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+		n := min(76-l.col, len(p))
+		if _, err := l.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		l.col += n
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func sendWithTLS(ctx context.Context, addr string, from string, to []string, msg []byte, config SMTPConfig) error {
+	// Connect to server
+	client, conn, err := dial(ctx, addr, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	unbind := conn.bind(ctx)
+	defer unbind()
+
 	// Authenticate
-	if err = client.Auth(auth); err != nil {
-		return fmt.Errorf("failed to authenticate: %w", err)
+	if err = authenticate(ctx, client, config); err != nil {
+		return contextError(ctx, err)
+	}
+
+	if err = deliver(client, from, to, msg); err != nil {
+		return contextError(ctx, err)
 	}
 
+	return client.Quit()
+}
+
+// deliver runs a single mail transaction on an established SMTP session
+func deliver(client *smtp.Client, from string, to []string, msg []byte) error {
 	// Set sender
-	if err = client.Mail(from); err != nil {
+	if err := client.Mail(from); err != nil {
 		return fmt.Errorf("failed to set sender: %w", err)
 	}
 
 	// Set recipients
 	for _, recipient := range to {
-		if err = client.Rcpt(recipient); err != nil {
+		if err := client.Rcpt(recipient); err != nil {
 			return fmt.Errorf("failed to set recipient %s: %w", recipient, err)
 		}
 	}
@@ -266,141 +697,75 @@ func sendWithTLS(addr string, auth smtp.Auth, from string, to []string, msg []by
 	// Send message
 	writer, err := client.Data()
 	if err != nil {
-		return fmt.Errorf("failed to get data writer: %w", err)
+		return &dataError{fmt.Errorf("failed to get data writer: %w", err)}
 	}
 
 	_, err = writer.Write(msg)
 	if err != nil {
 		writer.Close() // Try to close on error
-		return fmt.Errorf("failed to write message: %w", err)
+		return &dataError{fmt.Errorf("failed to write message: %w", err)}
 	}
 
 	err = writer.Close()
 	if err != nil {
-		return fmt.Errorf("failed to close data writer: %w", err)
+		return &dataError{fmt.Errorf("failed to close data writer: %w", err)}
 	}
 
-	return client.Quit()
+	return nil
+}
+
+// dataError is a failure of a mail transaction from the DATA command on.
+// The server may have accepted the message regardless, so it must not be
+// sent again.
+type dataError struct {
+	err error
+}
+
+func (e *dataError) Error() string { return e.err.Error() }
+func (e *dataError) Unwrap() error { return e.err }
+
+// RenderOTP renders the OTP message for purpose in locale from
+// DefaultTemplates. The template otp_<purpose> is used when it exists, the
+// generic otp template otherwise.
+func RenderOTP(otp string, purpose OtpPurpose, locale string) (RenderedTemplate, error) {
+	name := "otp_" + string(purpose)
+	if _, err := DefaultTemplates.Lookup(name, 0); err != nil {
+		name = "otp"
+	}
+	return DefaultTemplates.RenderLocale(name, 0, locale, otpTemplateData(otp, purpose))
+}
+
+// RenderWhatsAppOTP renders the WhatsApp message for an OTP from
+// DefaultTemplates, like RenderOTP with the whatsapp_otp templates. The
+// message states the same expiry as the OTP email.
+func RenderWhatsAppOTP(otp string, purpose OtpPurpose, locale string) (string, error) {
+	name := "whatsapp_otp_" + string(purpose)
+	if _, err := DefaultTemplates.Lookup(name, 0); err != nil {
+		name = "whatsapp_otp"
+	}
+	rendered, err := DefaultTemplates.RenderLocale(name, 0, locale, otpTemplateData(otp, purpose))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(rendered.Text), nil
+}
+
+// RenderMagicLink renders the sign-in email for a magic link in locale from
+// the magic_link template of DefaultTemplates. The email states the expiry
+// of OtpPurposeMagicLink.
+func RenderMagicLink(link, locale string) (RenderedTemplate, error) {
+	return DefaultTemplates.RenderLocale("magic_link", 0, locale, map[string]any{
+		"Link":             link,
+		"ExpiresInMinutes": int(GetOTPExpirationDuration(OtpPurposeMagicLink).Minutes()),
+	})
 }
 
-// getOTPSubject creates OTP Email Subject based on purpose
-func getOTPSubject(purpose OtpPurpose) string {
-	switch purpose {
-	case OtpPurposeLogin:
-		return "Your Login Verification Code"
-	case OtpPurposePasswordReset:
-		return "Password Reset Verification Code"
-	case OtpPurposeVerification:
-		return "Account Verification Code"
-	case OtpPurposeRegistration:
-		return "Registration Verification Code"
-	default:
-		return "Your Verification Code"
-	}
-}
-
-// getOTPBody creates OTP Email body based on purpose
-func getOTPBody(otp string, purpose OtpPurpose) string {
-	switch purpose {
-	case OtpPurposeLogin:
-		return fmt.Sprintf(`
-			<html>
-			<head>
-				<meta charset="UTF-8">
-				<title>Login Verification</title>
-			</head>
-			<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
-				<div style="max-width: 600px; margin: 0 auto; padding: 20px;">
-					<h2 style="color: #2c5aa0;">Login Verification</h2>
-					<p>Your login verification code is:</p>
-					<div style="background-color: #f4f4f4; padding: 20px; text-align: center; font-size: 24px; font-weight: bold; letter-spacing: 3px; margin: 20px 0;">
-						%s
-					</div>
-					<p><strong>This code will expire in 10 minutes.</strong></p>
-					<p style="color: #666;">If you didn't request this code, please ignore this email and ensure your account is secure.</p>
-					<hr style="border: 1px solid #eee; margin: 20px 0;">
-					<p style="font-size: 12px; color: #999;">This is an automated message, please do not reply to this email.</p>
-				</div>
-			</body>
-			</html>
-		`, otp)
-	case OtpPurposePasswordReset:
-		return fmt.Sprintf(`
-			<html>
-			<head>
-				<meta charset="UTF-8">
-				<title>Password Reset</title>
-			</head>
-			<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
-				<div style="max-width: 600px; margin: 0 auto; padding: 20px;">
-					<h2 style="color: #d9534f;">Password Reset</h2>
-					<p>Your password reset verification code is:</p>
-					<div style="background-color: #f4f4f4; padding: 20px; text-align: center; font-size: 24px; font-weight: bold; letter-spacing: 3px; margin: 20px 0;">
-						%s
-					</div>
-					<p><strong>This code will expire in 15 minutes.</strong></p>
-					<p style="color: #666;">If you didn't request a password reset, please ignore this email and ensure your account is secure.</p>
-					<hr style="border: 1px solid #eee; margin: 20px 0;">
-					<p style="font-size: 12px; color: #999;">This is an automated message, please do not reply to this email.</p>
-				</div>
-			</body>
-			</html>
-		`, otp)
-	case OtpPurposeRegistration:
-		return fmt.Sprintf(`
-			<html>
-			<head>
-				<meta charset="UTF-8">
-				<title>Registration Verification</title>
-			</head>
-			<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
-				<div style="max-width: 600px; margin: 0 auto; padding: 20px;">
-					<h2 style="color: #5cb85c;">Welcome! Complete Your Registration</h2>
-					<p>Thank you for registering! Please use the following verification code to complete your account setup:</p>
-					<div style="background-color: #f4f4f4; padding: 20px; text-align: center; font-size: 24px; font-weight: bold; letter-spacing: 3px; margin: 20px 0;">
-						%s
-					</div>
-					<p><strong>This code will expire in 10 minutes.</strong></p>
-					<p style="color: #666;">If you didn't create an account, please ignore this email.</p>
-					<hr style="border: 1px solid #eee; margin: 20px 0;">
-					<p style="font-size: 12px; color: #999;">This is an automated message, please do not reply to this email.</p>
-				</div>
-			</body>
-			</html>
-		`, otp)
-	default:
-		return fmt.Sprintf(`
-			<html>
-			<head>
-				<meta charset="UTF-8">
-				<title>Verification Code</title>
-			</head>
-			<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
-				<div style="max-width: 600px; margin: 0 auto; padding: 20px;">
-					<h2 style="color: #337ab7;">Verification Code</h2>
-					<p>Your verification code is:</p>
-					<div style="background-color: #f4f4f4; padding: 20px; text-align: center; font-size: 24px; font-weight: bold; letter-spacing: 3px; margin: 20px 0;">
-						%s
-					</div>
-					<p><strong>This code will expire in 10 minutes.</strong></p>
-					<hr style="border: 1px solid #eee; margin: 20px 0;">
-					<p style="font-size: 12px; color: #999;">This is an automated message, please do not reply to this email.</p>
-				</div>
-			</body>
-			</html>
-		`, otp)
-	}
-}
-
-// GetOTPExpirationDuration returns the appropriate expiration duration for each purpose
-func GetOTPExpirationDuration(purpose OtpPurpose) time.Duration {
-	switch purpose {
-	case OtpPurposePasswordReset:
-		return 15 * time.Minute
-	case OtpPurposeLogin, OtpPurposeVerification, OtpPurposeRegistration:
-		return 10 * time.Minute
-	default:
-		return 10 * time.Minute
+// otpTemplateData is the data OTP templates are rendered with
+func otpTemplateData(otp string, purpose OtpPurpose) map[string]any {
+	return map[string]any{
+		"OTP":              otp,
+		"Purpose":          string(purpose),
+		"ExpiresInMinutes": int(GetOTPExpirationDuration(purpose).Minutes()),
 	}
 }
 
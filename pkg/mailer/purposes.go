@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultOTPExpiration is the expiry of purposes registered without one
+const DefaultOTPExpiration = 10 * time.Minute
+
+// purposePattern matches purpose names, which are used in template names
+var purposePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+var (
+	purposesMu sync.RWMutex
+	// otpExpirations holds the registered purposes and their expiry
+	otpExpirations = map[OtpPurpose]time.Duration{
+		OtpPurposeLogin:         10 * time.Minute,
+		OtpPurposePasswordReset: 15 * time.Minute,
+		OtpPurposeVerification:  10 * time.Minute,
+		OtpPurposeRegistration:  10 * time.Minute,
+		OtpPurposeMagicLink:     15 * time.Minute,
+	}
+)
+
+// RegisterOTPPurpose adds a purpose, or changes the expiry of a registered
+// one. Names are lowercase letters, digits and underscores. The expiry is a
+// whole number of minutes, as the OTP messages state it in minutes. Custom
+// purposes are rendered with the otp_<purpose> templates when they exist,
+// the generic otp templates otherwise.
+func RegisterOTPPurpose(purpose OtpPurpose, expiry time.Duration) error {
+	if !purposePattern.MatchString(string(purpose)) {
+		return fmt.Errorf("invalid OTP purpose %q: use up to 32 lowercase letters, digits and underscores", purpose)
+	}
+	if expiry < time.Minute || expiry%time.Minute != 0 {
+		return fmt.Errorf("expiry of OTP purpose %s must be a whole number of minutes, got %s", purpose, expiry)
+	}
+
+	purposesMu.Lock()
+	defer purposesMu.Unlock()
+	otpExpirations[purpose] = expiry
+	return nil
+}
+
+// IsOTPPurpose reports whether purpose is registered
+func IsOTPPurpose(purpose OtpPurpose) bool {
+	purposesMu.RLock()
+	defer purposesMu.RUnlock()
+	_, ok := otpExpirations[purpose]
+	return ok
+}
+
+// OTPPurposes returns the registered purposes, sorted
+func OTPPurposes() []OtpPurpose {
+	purposesMu.RLock()
+	defer purposesMu.RUnlock()
+	purposes := make([]OtpPurpose, 0, len(otpExpirations))
+	for purpose := range otpExpirations {
+		purposes = append(purposes, purpose)
+	}
+	slices.Sort(purposes)
+	return purposes
+}
+
+// GetOTPExpirationDuration returns the expiry of purpose: 15 minutes for
+// password resets and magic links and 10 minutes for the other built-in
+// purposes unless changed with RegisterOTPPurpose, DefaultOTPExpiration for
+// unregistered purposes
+func GetOTPExpirationDuration(purpose OtpPurpose) time.Duration {
+	purposesMu.RLock()
+	defer purposesMu.RUnlock()
+	if expiry, ok := otpExpirations[purpose]; ok {
+		return expiry
+	}
+	return DefaultOTPExpiration
+}
@@ -0,0 +1,239 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// ErrClientClosed is returned when sending through a closed Client or Transport
+var ErrClientClosed = errors.New("mailer client is closed")
+
+// ClientOptions tunes the SMTP session pool of an SMTPTransport
+type ClientOptions struct {
+	MaxConnections     int           // open sessions at most, default 4
+	IdleTimeout        time.Duration // idle sessions older than this are re-dialed, default 30s
+	MaxMessagesPerConn int           // messages per session before it is recycled, default 100
+}
+
+func (o ClientOptions) withDefaults() ClientOptions {
+	if o.MaxConnections <= 0 {
+		o.MaxConnections = 4
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = 30 * time.Second
+	}
+	if o.MaxMessagesPerConn <= 0 {
+		o.MaxMessagesPerConn = 100
+	}
+	return o
+}
+
+// SMTPTransport delivers messages over network SMTP. It keeps a bounded pool
+// of authenticated sessions and reuses them across messages, issuing RSET in
+// between. It is safe for concurrent use.
+type SMTPTransport struct {
+	config  SMTPConfig
+	options ClientOptions
+	addr    string
+
+	idle  chan *session // authenticated sessions ready for reuse
+	slots chan struct{} // one token per open session
+	done  chan struct{} // closed by Close
+	once  sync.Once
+}
+
+// session is a pooled SMTP connection
+type session struct {
+	client   *smtp.Client
+	conn     *smtpConn
+	lastUsed time.Time
+	messages int
+}
+
+// NewSMTPTransport validates config and creates an SMTPTransport. Sessions
+// are dialed lazily on first use.
+func NewSMTPTransport(config SMTPConfig, options ClientOptions) (*SMTPTransport, error) {
+	if err := ValidateConfig(config); err != nil {
+		return nil, fmt.Errorf("SMTP configuration error: %w", err)
+	}
+
+	options = options.withDefaults()
+	return &SMTPTransport{
+		config:  config,
+		options: options,
+		addr:    fmt.Sprintf("%s:%d", config.Host, config.Port),
+		idle:    make(chan *session, options.MaxConnections),
+		slots:   make(chan struct{}, options.MaxConnections),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Send delivers msg over a pooled session. A send that fails because a
+// reused session has died before DATA is retried once on a freshly dialed
+// session. Once the message is on its way it is never sent again, as the
+// server may have accepted it. Cancelling ctx aborts the transaction and
+// closes the session it was using.
+func (c *SMTPTransport) Send(ctx context.Context, from string, to []string, msg []byte) error {
+	for attempt := 0; ; attempt++ {
+		s, reused, err := c.acquire(ctx)
+		if err != nil {
+			return err
+		}
+
+		unbind := s.conn.bind(ctx)
+		err = deliver(s.client, from, to, msg)
+		unbind()
+		if err == nil {
+			c.release(s)
+			return nil
+		}
+
+		var smtpErr *textproto.Error
+		if errors.As(err, &smtpErr) {
+			// The server answered, so the session is still usable
+			c.release(s)
+			return err
+		}
+
+		c.discard(s)
+		if ctx.Err() != nil {
+			return contextError(ctx, err)
+		}
+		var dataErr *dataError
+		if !reused || attempt > 0 || errors.As(err, &dataErr) {
+			return err
+		}
+		slog.Warn("Pooled SMTP session failed, retrying on a new connection", "error", err)
+	}
+}
+
+// Close quits every idle session. Sessions in use are closed as they are
+// released. Sending after Close returns ErrClientClosed.
+func (c *SMTPTransport) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	for {
+		select {
+		case s := <-c.idle:
+			c.quit(s)
+		default:
+			return nil
+		}
+	}
+}
+
+// acquire returns an idle session, or dials a new one if the pool has room,
+// waiting for a session to be released otherwise. reused reports whether the
+// session has carried a message before. Waiting stops when ctx is done.
+func (c *SMTPTransport) acquire(ctx context.Context) (s *session, reused bool, err error) {
+	for {
+		select {
+		case <-c.done:
+			return nil, false, ErrClientClosed
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		default:
+		}
+
+		// Prefer idle sessions over dialing new ones
+		select {
+		case s = <-c.idle:
+		default:
+			select {
+			case s = <-c.idle:
+			case c.slots <- struct{}{}:
+				s, err = c.dial(ctx)
+				if err != nil {
+					<-c.slots
+					return nil, false, err
+				}
+				return s, false, nil
+			case <-c.done:
+				return nil, false, ErrClientClosed
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+		}
+
+		if time.Since(s.lastUsed) > c.options.IdleTimeout {
+			c.quit(s)
+			continue
+		}
+		// RSET clears the previous transaction and doubles as a liveness check
+		unbind := s.conn.bind(ctx)
+		err = s.client.Reset()
+		unbind()
+		if err != nil {
+			c.discard(s)
+			if ctx.Err() != nil {
+				return nil, false, contextError(ctx, err)
+			}
+			continue
+		}
+		return s, true, nil
+	}
+}
+
+// dial opens and authenticates a new session
+func (c *SMTPTransport) dial(ctx context.Context) (*session, error) {
+	client, conn, err := dial(ctx, c.addr, c.config)
+	if err != nil {
+		return nil, err
+	}
+
+	unbind := conn.bind(ctx)
+	defer unbind()
+	if err := authenticate(ctx, client, c.config); err != nil {
+		client.Close()
+		return nil, contextError(ctx, err)
+	}
+	return &session{client: client, conn: conn, lastUsed: time.Now()}, nil
+}
+
+// release returns a session to the pool, recycling it once it has carried
+// MaxMessagesPerConn messages or the client has been closed
+func (c *SMTPTransport) release(s *session) {
+	s.lastUsed = time.Now()
+	s.messages++
+
+	select {
+	case <-c.done:
+		c.quit(s)
+		return
+	default:
+	}
+
+	if s.messages >= c.options.MaxMessagesPerConn {
+		c.quit(s)
+		return
+	}
+	c.idle <- s
+
+	// Close may have drained the pool while the session was being returned
+	select {
+	case <-c.done:
+		c.Close()
+	default:
+	}
+}
+
+// quit politely ends a session and frees its slot
+func (c *SMTPTransport) quit(s *session) {
+	if err := s.client.Quit(); err != nil {
+		s.client.Close()
+	}
+	<-c.slots
+}
+
+// discard drops a broken session and frees its slot
+func (c *SMTPTransport) discard(s *session) {
+	s.client.Close()
+	<-c.slots
+}
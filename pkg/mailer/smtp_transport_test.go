@@ -0,0 +1,306 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpServer is a fake SMTP server that accepts mail without authentication
+// and records what it receives
+type smtpServer struct {
+	ln net.Listener
+
+	// drop, when set, tells whether to close a connection instead of
+	// answering a command. It gets the command, "." for the end of the
+	// message, and how many messages the connection delivered so far.
+	drop func(cmd string, delivered int) bool
+	// delay is waited before accepting a message
+	delay time.Duration
+
+	mu       sync.Mutex
+	commands []string
+	messages []string
+	conns    int
+	open     int
+	maxOpen  int
+}
+
+// newSMTPServer starts a fake SMTP server, closed at the end of the test
+func newSMTPServer(t *testing.T, drop func(cmd string, delivered int) bool, delay time.Duration) *smtpServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{ln: ln, drop: drop, delay: delay}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// config returns an SMTP configuration for the server
+func (s *smtpServer) config() SMTPConfig {
+	return SMTPConfig{
+		Host:          "127.0.0.1",
+		Port:          s.ln.Addr().(*net.TCPAddr).Port,
+		Email:         "sender@example.com",
+		TLSMode:       TLSModeNone,
+		AuthMechanism: AuthNone,
+		Timeout:       5 * time.Second,
+	}
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	s.mu.Lock()
+	s.conns++
+	s.open++
+	s.maxOpen = max(s.maxOpen, s.open)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.open--
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	dropped := func(cmd string, delivered int) bool { return s.drop != nil && s.drop(cmd, delivered) }
+	delivered := 0
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, _, _ := strings.Cut(strings.ToUpper(strings.TrimSpace(line)), " ")
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+		if dropped(cmd, delivered) {
+			return
+		}
+
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250 fake")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var body strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				body.WriteString(line)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, body.String())
+			s.mu.Unlock()
+			if dropped(".", delivered) {
+				return
+			}
+			time.Sleep(s.delay)
+			delivered++
+			reply("250 Queued")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+// stats returns the commands received, the messages accepted and the
+// connections made
+func (s *smtpServer) stats() (commands []string, messages []string, conns int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...), append([]string(nil), s.messages...), s.conns
+}
+
+// countCommand returns how many times cmd was received
+func countCommand(commands []string, cmd string) int {
+	n := 0
+	for _, c := range commands {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+func testSMTPTransport(t *testing.T, server *smtpServer, options ClientOptions) *SMTPTransport {
+	t.Helper()
+	transport, err := NewSMTPTransport(server.config(), options)
+	if err != nil {
+		t.Fatalf("NewSMTPTransport: %v", err)
+	}
+	t.Cleanup(func() { transport.Close() })
+	return transport
+}
+
+func sendTest(ctx context.Context, transport *SMTPTransport, n int) error {
+	return transport.Send(ctx, "sender@example.com", []string{"bob@example.com"}, fmt.Appendf(nil, "Subject: %d\r\n\r\nHello\r\n", n))
+}
+
+func TestSMTPTransportReusesSession(t *testing.T) {
+	ctx := context.Background()
+	server := newSMTPServer(t, nil, 0)
+	transport := testSMTPTransport(t, server, ClientOptions{})
+
+	for i := range 3 {
+		if err := sendTest(ctx, transport, i); err != nil {
+			t.Fatalf("Send %d: %v", i, err)
+		}
+	}
+
+	commands, messages, conns := server.stats()
+	if conns != 1 || len(messages) != 3 {
+		t.Fatalf("%d connections and %d messages, want 1 and 3", conns, len(messages))
+	}
+	// RSET clears the previous transaction before every reuse
+	want := []string{"EHLO", "MAIL", "RCPT", "DATA", "RSET", "MAIL", "RCPT", "DATA", "RSET", "MAIL", "RCPT", "DATA"}
+	if got := strings.Join(commands, " "); got != strings.Join(want, " ") {
+		t.Errorf("commands = %s, want %s", got, strings.Join(want, " "))
+	}
+
+	transport.Close()
+	if err := sendTest(ctx, transport, 4); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("Send after Close = %v, want ErrClientClosed", err)
+	}
+	// Close quits the idle session
+	deadline := time.Now().Add(time.Second)
+	for commands, _, _ = server.stats(); countCommand(commands, "QUIT") == 0 && time.Now().Before(deadline); commands, _, _ = server.stats() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if countCommand(commands, "QUIT") != 1 {
+		t.Errorf("commands after Close = %s, want a QUIT", strings.Join(commands, " "))
+	}
+}
+
+func TestSMTPTransportRedials(t *testing.T) {
+	tests := []struct {
+		name string
+		// drop ends the first connection after its first message
+		drop     func(cmd string, delivered int) bool
+		wantErr  bool
+		messages int
+		conns    int
+	}{
+		{
+			// The dead session fails the RSET check and is replaced
+			name:     "at RSET",
+			drop:     func(cmd string, delivered int) bool { return cmd == "RSET" },
+			messages: 2,
+			conns:    2,
+		},
+		{
+			// The session passed the check but died before DATA, the
+			// message is sent again on a new session
+			name:     "at MAIL FROM",
+			drop:     func(cmd string, delivered int) bool { return cmd == "MAIL" && delivered == 1 },
+			messages: 2,
+			conns:    2,
+		},
+		{
+			// The server may have accepted the message, it is not sent again
+			name:     "after the message",
+			drop:     func(cmd string, delivered int) bool { return cmd == "." && delivered == 1 },
+			wantErr:  true,
+			messages: 2,
+			conns:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			server := newSMTPServer(t, tt.drop, 0)
+			transport := testSMTPTransport(t, server, ClientOptions{})
+
+			if err := sendTest(ctx, transport, 1); err != nil {
+				t.Fatalf("first Send: %v", err)
+			}
+			err := sendTest(ctx, transport, 2)
+			if tt.wantErr != (err != nil) {
+				t.Errorf("second Send = %v, want error %v", err, tt.wantErr)
+			}
+
+			_, messages, conns := server.stats()
+			if len(messages) != tt.messages || conns != tt.conns {
+				t.Errorf("%d messages over %d connections, want %d over %d", len(messages), conns, tt.messages, tt.conns)
+			}
+		})
+	}
+}
+
+func TestSMTPTransportConcurrentSends(t *testing.T) {
+	ctx := context.Background()
+	server := newSMTPServer(t, nil, 10*time.Millisecond)
+	transport := testSMTPTransport(t, server, ClientOptions{MaxConnections: 2})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- sendTest(ctx, transport, i)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Send: %v", err)
+		}
+	}
+
+	_, messages, conns := server.stats()
+	server.mu.Lock()
+	maxOpen := server.maxOpen
+	server.mu.Unlock()
+	if len(messages) != 20 {
+		t.Errorf("%d messages, want 20", len(messages))
+	}
+	if maxOpen > 2 || conns > 2 {
+		t.Errorf("%d connections, %d open at once, want at most 2", conns, maxOpen)
+	}
+}
+
+func TestSMTPTransportCanceledWait(t *testing.T) {
+	server := newSMTPServer(t, nil, 200*time.Millisecond)
+	transport := testSMTPTransport(t, server, ClientOptions{MaxConnections: 1})
+
+	// The only session is busy, waiting for it ends with the context
+	go sendTest(context.Background(), transport, 1)
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sendTest(ctx, transport, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send while the pool is full = %v, want context.DeadlineExceeded", err)
+	}
+}
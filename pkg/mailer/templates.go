@@ -0,0 +1,616 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"maps"
+	"mime"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// Template files inside a version directory
+const (
+	templateSubjectFile = "subject.txt"
+	templateHTMLFile    = "body.html"
+	templateTextFile    = "body.txt"
+)
+
+// layoutsDir holds layouts and partials shared by every template
+const layoutsDir = "_layouts"
+
+// localesDir holds the message catalogs, one <locale>.json file per locale
+const localesDir = "_locales"
+
+// sharedInlineDir holds inline images available to every template, and
+// inlineDir those of a single template version. An image's Content-ID is its
+// file name without the extension.
+const (
+	sharedInlineDir = "_inline"
+	inlineDir       = "inline"
+)
+
+// templateNamePattern restricts template names, which double as directory names
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+//go:embed templates templates/_layouts templates/_locales
+var embeddedTemplates embed.FS
+
+// DefaultTemplates holds the built-in templates (the OTP emails) and is used
+// by SendOTP. Load a directory into it to override or add templates.
+var DefaultTemplates = mustLoadEmbeddedTemplates()
+
+// TemplateRegistry holds named, versioned email templates. A template has a
+// subject and an HTML and/or a plain-text body, rendered with text/template
+// and html/template respectively. It is safe for concurrent use.
+//
+// On disk every template lives in <name>/v<version>/ as subject.txt,
+// body.html and body.txt. Files in _layouts/ (*.html and *.txt) are parsed
+// into every HTML or text body, so they can define layouts and partials.
+// _locales/ holds the message catalogs used by the t template function.
+// Images in _inline/ and <name>/v<version>/inline/ are sent as inline parts
+// when the rendered HTML references them, e.g. logo.png as cid:logo:
+//
+//	_inline/logo.png
+//	_layouts/base.html
+//	_locales/en.json
+//	_locales/sw.json
+//	welcome/v1/subject.txt
+//	welcome/v1/body.html
+//	welcome/v2/subject.txt
+//	welcome/v2/body.html
+//	welcome/v2/body.txt
+type TemplateRegistry struct {
+	mu          sync.RWMutex
+	htmlLayouts map[string]string
+	textLayouts map[string]string
+	templates   map[string]map[int]*Template
+	catalogs    map[string]map[string]string // locale -> message key -> message
+	inline      map[string]Attachment        // shared inline images by Content-ID
+}
+
+// Template is a parsed template version
+type Template struct {
+	Name    string
+	Version int
+
+	registry *TemplateRegistry
+	parts    templateParts         // parsed with placeholder t and locale funcs, never executed
+	inline   map[string]Attachment // inline images of this version by Content-ID
+
+	mu        sync.Mutex
+	localized map[string]templateParts // clones bound to a locale chain
+}
+
+// templateParts are the parsed subject and bodies of a template
+type templateParts struct {
+	subject *texttemplate.Template
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+}
+
+// RenderedTemplate is the output of a template
+type RenderedTemplate struct {
+	Subject string
+	HTML    string
+	Text    string
+	Inline  []Attachment // inline images referenced by HTML
+}
+
+// NewTemplateRegistry creates an empty registry
+func NewTemplateRegistry() *TemplateRegistry {
+	return &TemplateRegistry{
+		htmlLayouts: map[string]string{},
+		textLayouts: map[string]string{},
+		templates:   map[string]map[int]*Template{},
+		catalogs:    map[string]map[string]string{},
+		inline:      map[string]Attachment{},
+	}
+}
+
+// LoadTemplates creates a registry from fsys, e.g. os.DirFS("templates") or
+// an embed.FS
+func LoadTemplates(fsys fs.FS) (*TemplateRegistry, error) {
+	registry := NewTemplateRegistry()
+	if err := registry.Load(fsys); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+func mustLoadEmbeddedTemplates() *TemplateRegistry {
+	fsys, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		panic(err)
+	}
+	registry, err := LoadTemplates(fsys)
+	if err != nil {
+		panic(fmt.Sprintf("failed to load built-in templates: %v", err))
+	}
+	return registry
+}
+
+// Load adds the layouts and templates found in fsys to the registry,
+// replacing layouts and template versions that already exist. Templates
+// loaded earlier keep the layouts they were parsed with.
+func (r *TemplateRegistry) Load(fsys fs.FS) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	layouts, err := fs.ReadDir(fsys, layoutsDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read layouts: %w", err)
+	}
+	for _, entry := range layouts {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := fs.ReadFile(fsys, path.Join(layoutsDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read layout: %w", err)
+		}
+		switch path.Ext(entry.Name()) {
+		case ".html":
+			r.htmlLayouts[entry.Name()] = string(content)
+		case ".txt":
+			r.textLayouts[entry.Name()] = string(content)
+		}
+	}
+
+	if err := r.loadCatalogs(fsys); err != nil {
+		return err
+	}
+
+	shared, err := readInline(fsys, sharedInlineDir)
+	if err != nil {
+		return err
+	}
+	for id, image := range shared {
+		r.inline[id] = image
+	}
+
+	names, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return fmt.Errorf("failed to read templates: %w", err)
+	}
+	for _, nameEntry := range names {
+		name := nameEntry.Name()
+		if !nameEntry.IsDir() || strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if !templateNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid template name %q", name)
+		}
+
+		versions, err := fs.ReadDir(fsys, name)
+		if err != nil {
+			return fmt.Errorf("failed to read template %s: %w", name, err)
+		}
+		for _, versionEntry := range versions {
+			if !versionEntry.IsDir() {
+				continue
+			}
+			version, err := parseTemplateVersion(versionEntry.Name())
+			if err != nil {
+				return fmt.Errorf("template %s: %w", name, err)
+			}
+
+			dir := path.Join(name, versionEntry.Name())
+			subject, err := readOptional(fsys, path.Join(dir, templateSubjectFile))
+			if err != nil {
+				return err
+			}
+			html, err := readOptional(fsys, path.Join(dir, templateHTMLFile))
+			if err != nil {
+				return err
+			}
+			text, err := readOptional(fsys, path.Join(dir, templateTextFile))
+			if err != nil {
+				return err
+			}
+			if html == "" && text == "" {
+				return fmt.Errorf("template %s v%d: %s or %s is required", name, version, templateHTMLFile, templateTextFile)
+			}
+
+			tmpl, err := r.parse(name, version, subject, html, text, nil)
+			if err != nil {
+				return err
+			}
+			if tmpl.inline, err = readInline(fsys, path.Join(dir, inlineDir)); err != nil {
+				return err
+			}
+			r.add(tmpl)
+		}
+	}
+
+	return nil
+}
+
+// Register adds a template version from strings. html or text may be empty,
+// but not both. funcs are made available to all three parts.
+func (r *TemplateRegistry) Register(name string, version int, subject, html, text string, funcs map[string]any) error {
+	if !templateNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid template name %q", name)
+	}
+	if version < 1 {
+		return fmt.Errorf("template version must be at least 1")
+	}
+	if html == "" && text == "" {
+		return fmt.Errorf("template %s v%d: an HTML or text body is required", name, version)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tmpl, err := r.parse(name, version, subject, html, text, funcs)
+	if err != nil {
+		return err
+	}
+	r.add(tmpl)
+	return nil
+}
+
+// AddInline adds an inline image available to every template. It is sent
+// with the emails whose HTML references cid:<ContentID>.
+func (r *TemplateRegistry) AddInline(image Attachment) error {
+	if !contentIDPattern.MatchString(image.ContentID) {
+		return fmt.Errorf("invalid content ID %q", image.ContentID)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.inline[image.ContentID] = image
+	return nil
+}
+
+// Lookup returns a template version. Version 0 selects the latest version.
+func (r *TemplateRegistry) Lookup(name string, version int) (*Template, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions, ok := r.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("template %q not found", name)
+	}
+	if version == 0 {
+		for v := range versions {
+			version = max(version, v)
+		}
+	}
+	tmpl, ok := versions[version]
+	if !ok {
+		return nil, fmt.Errorf("template %q has no version %d", name, version)
+	}
+	return tmpl, nil
+}
+
+// Render renders a template version with data in the default locale.
+// Version 0 selects the latest version.
+func (r *TemplateRegistry) Render(name string, version int, data any) (RenderedTemplate, error) {
+	return r.RenderLocale(name, version, "", data)
+}
+
+// RenderLocale renders a template version with data in locale, see
+// Template.RenderLocale. Version 0 selects the latest version.
+func (r *TemplateRegistry) RenderLocale(name string, version int, locale string, data any) (RenderedTemplate, error) {
+	tmpl, err := r.Lookup(name, version)
+	if err != nil {
+		return RenderedTemplate{}, err
+	}
+	return tmpl.RenderLocale(locale, data)
+}
+
+// Names returns the names of all templates, sorted
+func (r *TemplateRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.templates))
+	for name := range r.templates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Versions returns the versions of a template, oldest first
+func (r *TemplateRegistry) Versions(name string) []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions := make([]int, 0, len(r.templates[name]))
+	for version := range r.templates[name] {
+		versions = append(versions, version)
+	}
+	slices.Sort(versions)
+	return versions
+}
+
+// Render executes every part of the template with data in the default
+// locale. Referencing a missing map key is an error rather than rendering
+// "<no value>".
+func (t *Template) Render(data any) (RenderedTemplate, error) {
+	return t.RenderLocale("", data)
+}
+
+// RenderLocale executes every part of the template with data. The t function
+// looks messages up along the fallback chain of locale, e.g. sw-KE, sw and
+// then DefaultLocale.
+func (t *Template) RenderLocale(locale string, data any) (RenderedTemplate, error) {
+	var rendered RenderedTemplate
+	var buf bytes.Buffer
+
+	parts, err := t.localize(locale)
+	if err != nil {
+		return rendered, err
+	}
+
+	if parts.subject != nil {
+		if err := parts.subject.Execute(&buf, data); err != nil {
+			return rendered, fmt.Errorf("failed to render %s v%d subject: %w", t.Name, t.Version, err)
+		}
+		// Subjects are a single line
+		rendered.Subject = strings.Join(strings.Fields(buf.String()), " ")
+	}
+
+	if parts.html != nil {
+		buf.Reset()
+		if err := parts.html.Execute(&buf, data); err != nil {
+			return rendered, fmt.Errorf("failed to render %s v%d HTML body: %w", t.Name, t.Version, err)
+		}
+		rendered.HTML = strings.TrimSpace(buf.String()) + "\n"
+		rendered.Inline = t.referencedInline(rendered.HTML)
+	}
+
+	if parts.text != nil {
+		buf.Reset()
+		if err := parts.text.Execute(&buf, data); err != nil {
+			return rendered, fmt.Errorf("failed to render %s v%d text body: %w", t.Name, t.Version, err)
+		}
+		rendered.Text = strings.TrimSpace(buf.String()) + "\n"
+	}
+
+	return rendered, nil
+}
+
+// referencedInline returns the inline images html references, the
+// template's own taking precedence over shared ones with the same Content-ID
+func (t *Template) referencedInline(html string) []Attachment {
+	t.registry.mu.RLock()
+	images := make(map[string]Attachment, len(t.registry.inline)+len(t.inline))
+	for id, image := range t.registry.inline {
+		images[id] = image
+	}
+	t.registry.mu.RUnlock()
+	for id, image := range t.inline {
+		images[id] = image
+	}
+
+	var inline []Attachment
+	for _, id := range slices.Sorted(maps.Keys(images)) {
+		if referencesContentID(html, id) {
+			inline = append(inline, images[id])
+		}
+	}
+	return inline
+}
+
+// referencesContentID reports whether html contains a cid: URL for id, so
+// that cid:logo does not match cid:logo-dark
+func referencesContentID(html, id string) bool {
+	url := "cid:" + id
+	for i := strings.Index(html, url); i >= 0; {
+		end := i + len(url)
+		if end == len(html) || !contentIDPattern.MatchString(html[end:end+1]) {
+			return true
+		}
+		next := strings.Index(html[end:], url)
+		if next < 0 {
+			break
+		}
+		i = end + next
+	}
+	return false
+}
+
+// localize returns the template parts bound to the catalogs available for
+// locale. Clones are cached per resolved chain, which keeps the cache bounded
+// by the loaded catalogs rather than by the locales callers ask for.
+func (t *Template) localize(locale string) (templateParts, error) {
+	chain := t.registry.resolveLocale(locale)
+	key := strings.Join(chain, ",")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if parts, ok := t.localized[key]; ok {
+		return parts, nil
+	}
+
+	funcs := map[string]any{
+		"t":      t.registry.translator(chain),
+		"locale": func() string { return chain[0] },
+	}
+
+	var parts templateParts
+	if t.parts.subject != nil {
+		clone, err := t.parts.subject.Clone()
+		if err != nil {
+			return parts, err
+		}
+		parts.subject = clone.Funcs(funcs)
+	}
+	if t.parts.html != nil {
+		clone, err := t.parts.html.Clone()
+		if err != nil {
+			return parts, err
+		}
+		parts.html = clone.Funcs(funcs)
+	}
+	if t.parts.text != nil {
+		clone, err := t.parts.text.Clone()
+		if err != nil {
+			return parts, err
+		}
+		parts.text = clone.Funcs(funcs)
+	}
+
+	if t.localized == nil {
+		t.localized = map[string]templateParts{}
+	}
+	t.localized[key] = parts
+	return parts, nil
+}
+
+// Apply copies the rendered subject and bodies into emailData. The HTML body
+// is preferred, with the text body as its plain-text alternative.
+func (r RenderedTemplate) Apply(emailData *EmailData) {
+	emailData.Subject = r.Subject
+	if r.HTML != "" {
+		emailData.Body = r.HTML
+		emailData.IsHTML = true
+		emailData.TextBody = r.Text
+		emailData.Inline = r.Inline
+		return
+	}
+	emailData.Body = r.Text
+	emailData.IsHTML = false
+	emailData.TextBody = ""
+	emailData.Inline = nil
+}
+
+// parse builds a Template, parsing the layouts into its bodies. Callers must
+// hold r.mu.
+func (r *TemplateRegistry) parse(name string, version int, subject, html, text string, userFuncs map[string]any) (*Template, error) {
+	tmpl := &Template{Name: name, Version: version, registry: r}
+	id := fmt.Sprintf("%s v%d", name, version)
+
+	// t and locale are bound to a locale when the template is rendered
+	funcs := map[string]any{
+		"t":      func(key string, args ...any) (string, error) { return "", nil },
+		"locale": func() string { return DefaultLocale },
+		// cid marks a cid: URL as safe, html/template would replace it otherwise
+		"cid": func(contentID string) htmltemplate.URL { return htmltemplate.URL("cid:" + contentID) },
+	}
+	for name, fn := range userFuncs {
+		funcs[name] = fn
+	}
+
+	if strings.TrimSpace(subject) != "" {
+		parsed, err := texttemplate.New(templateSubjectFile).Option("missingkey=error").Funcs(funcs).Parse(subject)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s subject: %w", id, err)
+		}
+		tmpl.parts.subject = parsed
+	}
+
+	if html != "" {
+		parsed := htmltemplate.New(templateHTMLFile).Option("missingkey=error").Funcs(funcs)
+		for _, layout := range sortedKeys(r.htmlLayouts) {
+			if _, err := parsed.New(layout).Parse(r.htmlLayouts[layout]); err != nil {
+				return nil, fmt.Errorf("failed to parse layout %s: %w", layout, err)
+			}
+		}
+		if _, err := parsed.Parse(html); err != nil {
+			return nil, fmt.Errorf("failed to parse %s HTML body: %w", id, err)
+		}
+		tmpl.parts.html = parsed
+	}
+
+	if text != "" {
+		parsed := texttemplate.New(templateTextFile).Option("missingkey=error").Funcs(funcs)
+		for _, layout := range sortedKeys(r.textLayouts) {
+			if _, err := parsed.New(layout).Parse(r.textLayouts[layout]); err != nil {
+				return nil, fmt.Errorf("failed to parse layout %s: %w", layout, err)
+			}
+		}
+		if _, err := parsed.Parse(text); err != nil {
+			return nil, fmt.Errorf("failed to parse %s text body: %w", id, err)
+		}
+		tmpl.parts.text = parsed
+	}
+
+	return tmpl, nil
+}
+
+// add stores a parsed template. Callers must hold r.mu.
+func (r *TemplateRegistry) add(tmpl *Template) {
+	if r.templates[tmpl.Name] == nil {
+		r.templates[tmpl.Name] = map[int]*Template{}
+	}
+	r.templates[tmpl.Name][tmpl.Version] = tmpl
+}
+
+// parseTemplateVersion parses a version directory name such as "v2"
+func parseTemplateVersion(dir string) (int, error) {
+	version, err := strconv.Atoi(strings.TrimPrefix(dir, "v"))
+	if !strings.HasPrefix(dir, "v") || err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid version directory %q, expected v1, v2, ...", dir)
+	}
+	return version, nil
+}
+
+// readOptional reads a file, returning "" when it does not exist
+func readOptional(fsys fs.FS, name string) (string, error) {
+	content, err := fs.ReadFile(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read template file: %w", err)
+	}
+	return string(content), nil
+}
+
+// readInline reads the inline images in dir by Content-ID. A missing dir
+// has no images.
+func readInline(fsys fs.FS, dir string) (map[string]Attachment, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inline images: %w", err)
+	}
+
+	images := map[string]Attachment{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))
+		if !contentIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("inline image %s: invalid content ID %q", path.Join(dir, entry.Name()), id)
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read inline image: %w", err)
+		}
+		images[id] = Attachment{
+			Filename:    entry.Name(),
+			ContentType: mime.TypeByExtension(path.Ext(entry.Name())),
+			Data:        data,
+			ContentID:   id,
+		}
+	}
+	return images, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,157 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// testTemplates loads a registry with two versions of a welcome template,
+// a layout and catalogs for en, sw and sw-KE
+func testTemplates(t *testing.T) *TemplateRegistry {
+	t.Helper()
+	registry, err := LoadTemplates(fstest.MapFS{
+		"_layouts/base.html":     {Data: []byte(`{{define "base"}}<body>{{block "content" .}}{{end}}</body>{{end}}`)},
+		"_locales/en.json":       {Data: []byte(`{"greeting": "Hello %s", "footer": "Thanks", "help": "Reply for help"}`)},
+		"_locales/sw.json":       {Data: []byte(`{"greeting": "Habari %s", "footer": "Asante"}`)},
+		"_locales/sw_ke.json":    {Data: []byte(`{"greeting": "Sasa %s"}`)},
+		"welcome/v1/subject.txt": {Data: []byte("Welcome {{.Name}}")},
+		"welcome/v1/body.txt":    {Data: []byte("Hi {{.Name}}")},
+		"welcome/v2/subject.txt": {Data: []byte(`{{t "greeting" .Name}}
+			& welcome`)},
+		"welcome/v2/body.html": {Data: []byte(`{{template "base" .}}{{define "content"}}<p>{{t "greeting" .Name}}</p><p>{{t "footer"}} {{t "help"}}</p><p>{{locale}}</p>{{end}}`)},
+		"welcome/v2/body.txt":  {Data: []byte(`{{t "greeting" .Name}}`)},
+	})
+	if err != nil {
+		t.Fatalf("LoadTemplates: %v", err)
+	}
+	return registry
+}
+
+func TestTemplateVersions(t *testing.T) {
+	registry := testTemplates(t)
+	data := map[string]any{"Name": "Jane"}
+
+	if got := registry.Versions("welcome"); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("Versions = %v, want [1 2]", got)
+	}
+
+	latest, err := registry.Render("welcome", 0, data)
+	if err != nil {
+		t.Fatalf("Render latest: %v", err)
+	}
+	if latest.Subject != "Hello Jane & welcome" || latest.HTML != "<body><p>Hello Jane</p><p>Thanks Reply for help</p><p>en</p></body>\n" {
+		t.Errorf("latest = %+v, want version 2", latest)
+	}
+
+	pinned, err := registry.Render("welcome", 1, data)
+	if err != nil {
+		t.Fatalf("Render v1: %v", err)
+	}
+	if pinned.Subject != "Welcome Jane" || pinned.Text != "Hi Jane\n" || pinned.HTML != "" {
+		t.Errorf("v1 = %+v", pinned)
+	}
+
+	if _, err := registry.Lookup("welcome", 3); err == nil {
+		t.Error("Lookup of a missing version succeeded")
+	}
+	if _, err := registry.Lookup("goodbye", 0); err == nil {
+		t.Error("Lookup of a missing template succeeded")
+	}
+}
+
+func TestTemplateEscaping(t *testing.T) {
+	registry := testTemplates(t)
+
+	rendered, err := registry.Render("welcome", 2, map[string]any{"Name": `Jane <b>"&"</b>`})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	// The subject is a header, not HTML
+	if want := `Hello Jane <b>"&"</b> & welcome`; rendered.Subject != want {
+		t.Errorf("Subject = %q, want %q", rendered.Subject, want)
+	}
+	if want := "<p>Hello Jane &lt;b&gt;&#34;&amp;&#34;&lt;/b&gt;</p>"; !strings.Contains(rendered.HTML, want) {
+		t.Errorf("HTML = %q, want it to contain %q", rendered.HTML, want)
+	}
+	if want := "Hello Jane <b>\"&\"</b>\n"; rendered.Text != want {
+		t.Errorf("Text = %q, want %q", rendered.Text, want)
+	}
+}
+
+func TestTemplateMissingKey(t *testing.T) {
+	registry := testTemplates(t)
+
+	if _, err := registry.Render("welcome", 1, map[string]any{"name": "Jane"}); err == nil || !strings.Contains(err.Error(), "Name") {
+		t.Errorf("Render without Name = %v, want a missing key error", err)
+	}
+	if err := registry.Register("broken", 1, "", "", `{{t "nope"}}`, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Render("broken", 1, nil); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("Render with an unknown message = %v, want an error", err)
+	}
+}
+
+func TestTemplateLocaleFallback(t *testing.T) {
+	registry := testTemplates(t)
+
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		// Each message comes from the most specific catalog that has it
+		{locale: "sw-KE", want: "<p>Sasa Jane</p><p>Asante Reply for help</p><p>sw-KE</p>"},
+		{locale: "sw_ke", want: "<p>Sasa Jane</p><p>Asante Reply for help</p><p>sw-KE</p>"},
+		{locale: "sw-TZ", want: "<p>Habari Jane</p><p>Asante Reply for help</p><p>sw</p>"},
+		{locale: "fr-FR", want: "<p>Hello Jane</p><p>Thanks Reply for help</p><p>en</p>"},
+		{locale: "", want: "<p>Hello Jane</p><p>Thanks Reply for help</p><p>en</p>"},
+		{locale: "not a locale", want: "<p>Hello Jane</p><p>Thanks Reply for help</p><p>en</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.locale, func(t *testing.T) {
+			rendered, err := registry.RenderLocale("welcome", 0, tt.locale, map[string]any{"Name": "Jane"})
+			if err != nil {
+				t.Fatalf("RenderLocale: %v", err)
+			}
+			if want := "<body>" + tt.want + "</body>\n"; rendered.HTML != want {
+				t.Errorf("HTML = %q, want %q", rendered.HTML, want)
+			}
+		})
+	}
+}
+
+func TestTemplateCatalogMerging(t *testing.T) {
+	registry := testTemplates(t)
+	render := func() string {
+		t.Helper()
+		rendered, err := registry.RenderLocale("welcome", 2, "sw-KE", map[string]any{"Name": "Jane"})
+		if err != nil {
+			t.Fatalf("RenderLocale: %v", err)
+		}
+		return rendered.HTML
+	}
+	render()
+
+	// Messages added later replace those with the same key and reach
+	// templates already rendered in the locale
+	if err := registry.AddMessages("sw", map[string]string{"footer": "Karibu tena", "help": "Jibu kwa msaada"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := render(), "<body><p>Sasa Jane</p><p>Karibu tena Jibu kwa msaada</p><p>sw-KE</p></body>\n"; got != want {
+		t.Errorf("after AddMessages HTML = %q, want %q", got, want)
+	}
+
+	// Loading another directory merges its catalogs
+	if err := registry.Load(fstest.MapFS{
+		"_locales/sw-KE.json": {Data: []byte(`{"help": "Tuma ujumbe"}`)},
+	}); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got, want := render(), "<body><p>Sasa Jane</p><p>Karibu tena Tuma ujumbe</p><p>sw-KE</p></body>\n"; got != want {
+		t.Errorf("after Load HTML = %q, want %q", got, want)
+	}
+	if got := strings.Join(registry.Locales(), " "); got != "en sw sw-KE" {
+		t.Errorf("Locales = %s, want en sw sw-KE", got)
+	}
+}
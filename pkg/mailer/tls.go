@@ -0,0 +1,166 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+)
+
+// TLSMode controls how the connection to the SMTP server is secured
+type TLSMode string
+
+const (
+	// TLSModeImplicit speaks TLS from the first byte (SMTPS, usually port 465)
+	TLSModeImplicit TLSMode = "implicit"
+	// TLSModeStartTLS upgrades a plaintext connection and fails if the server does not offer STARTTLS
+	TLSModeStartTLS TLSMode = "starttls-required"
+	// TLSModeOpportunistic upgrades with STARTTLS when offered and stays plaintext otherwise
+	TLSModeOpportunistic TLSMode = "starttls-opportunistic"
+	// TLSModeNone never uses TLS, for local relays only
+	TLSModeNone TLSMode = "none"
+)
+
+// tlsVersions maps the accepted MinTLSVersion values to crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsModeAliases maps the short names the TLS modes are also accepted by
+var tlsModeAliases = map[TLSMode]TLSMode{
+	"starttls":      TLSModeStartTLS,
+	"opportunistic": TLSModeOpportunistic,
+}
+
+// tlsMode returns the configured TLS mode, resolving aliases. When unset,
+// port 465 defaults to implicit TLS and every other port to required STARTTLS.
+func (c SMTPConfig) tlsMode() TLSMode {
+	if mode, ok := tlsModeAliases[c.TLSMode]; ok {
+		return mode
+	}
+	if c.TLSMode != "" {
+		return c.TLSMode
+	}
+	if c.Port == 465 {
+		return TLSModeImplicit
+	}
+	return TLSModeStartTLS
+}
+
+// validateTLSConfig checks the TLS related fields of an SMTP configuration
+func validateTLSConfig(config SMTPConfig) error {
+	switch config.tlsMode() {
+	case TLSModeImplicit, TLSModeStartTLS, TLSModeOpportunistic, TLSModeNone:
+	default:
+		return fmt.Errorf("unknown SMTP TLS mode %q", config.TLSMode)
+	}
+	if config.MinTLSVersion != "" {
+		if _, ok := tlsVersions[config.MinTLSVersion]; !ok {
+			return fmt.Errorf("unknown minimum TLS version %q", config.MinTLSVersion)
+		}
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("SMTP client certificate and key must be set together")
+	}
+	return nil
+}
+
+// buildTLSConfig creates the tls.Config used to talk to the SMTP server
+func buildTLSConfig(config SMTPConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: config.Host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config.MinTLSVersion != "" {
+		tlsConfig.MinVersion = tlsVersions[config.MinTLSVersion]
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// dial connects to the SMTP server and secures the connection according to
+// the configured TLS mode. ctx bounds the dial, the server greeting and the
+// TLS handshake.
+func dial(ctx context.Context, addr string, config SMTPConfig) (*smtp.Client, *smtpConn, error) {
+	tlsConfig, err := buildTLSConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	rawConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, contextError(ctx, fmt.Errorf("failed to connect to SMTP server: %w", err))
+	}
+	conn := newSMTPConn(rawConn, timeout)
+	unbind := conn.bind(ctx)
+	defer unbind()
+
+	mode := config.tlsMode()
+	var netConn net.Conn = conn
+	if mode == TLSModeImplicit {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, contextError(ctx, fmt.Errorf("failed TLS handshake: %w", err))
+		}
+		netConn = tlsConn
+	}
+
+	client, err := smtp.NewClient(netConn, config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, contextError(ctx, fmt.Errorf("failed to connect to SMTP server: %w", err))
+	}
+
+	if mode == TLSModeImplicit || mode == TLSModeNone {
+		return client, conn, nil
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		if mode == TLSModeOpportunistic {
+			return client, conn, nil
+		}
+		client.Close()
+		return nil, nil, fmt.Errorf("SMTP server does not support STARTTLS")
+	}
+
+	if err = client.StartTLS(tlsConfig); err != nil {
+		client.Close()
+		return nil, nil, contextError(ctx, fmt.Errorf("failed to start TLS: %w", err))
+	}
+
+	return client, conn, nil
+}
@@ -0,0 +1,33 @@
+package mailer
+
+import "testing"
+
+func TestTLSMode(t *testing.T) {
+	tests := []struct {
+		mode TLSMode
+		port int
+		want TLSMode
+	}{
+		{"", 465, TLSModeImplicit},
+		{"", 587, TLSModeStartTLS},
+		{"implicit", 587, TLSModeImplicit},
+		{"starttls-required", 587, TLSModeStartTLS},
+		{"starttls", 587, TLSModeStartTLS},
+		{"starttls-opportunistic", 25, TLSModeOpportunistic},
+		{"opportunistic", 25, TLSModeOpportunistic},
+		{"none", 25, TLSModeNone},
+	}
+	for _, tt := range tests {
+		config := SMTPConfig{TLSMode: tt.mode, Port: tt.port}
+		if got := config.tlsMode(); got != tt.want {
+			t.Errorf("tlsMode() with %q on port %d = %q, want %q", tt.mode, tt.port, got, tt.want)
+		}
+		if err := validateTLSConfig(config); err != nil {
+			t.Errorf("validateTLSConfig with %q: %v", tt.mode, err)
+		}
+	}
+
+	if err := validateTLSConfig(SMTPConfig{TLSMode: "tls", Port: 587}); err == nil {
+		t.Error("validateTLSConfig accepted an unknown mode")
+	}
+}
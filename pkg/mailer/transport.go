@@ -0,0 +1,198 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport delivers a fully rendered message to its envelope recipients.
+// Send must give up and return an error wrapping ctx.Err() once ctx is done.
+type Transport interface {
+	Send(ctx context.Context, from string, to []string, msg []byte) error
+	Close() error
+}
+
+// TransportKind names a Transport implementation in configuration
+type TransportKind string
+
+const (
+	TransportSMTP     TransportKind = "smtp"
+	TransportSendmail TransportKind = "sendmail"
+	TransportFile     TransportKind = "file"
+	TransportMemory   TransportKind = "memory"
+)
+
+// TransportConfig selects and configures a Transport
+type TransportConfig struct {
+	Kind         TransportKind // defaults to TransportSMTP
+	SendmailPath string        // TransportSendmail binary, defaults to /usr/sbin/sendmail
+	Dir          string        // TransportFile output directory
+	SMTP         ClientOptions // TransportSMTP pool options
+}
+
+// NewTransport creates the Transport selected by transportConfig. config is
+// only used by TransportSMTP.
+func NewTransport(transportConfig TransportConfig, config SMTPConfig) (Transport, error) {
+	switch transportConfig.Kind {
+	case TransportSMTP, "":
+		return NewSMTPTransport(config, transportConfig.SMTP)
+	case TransportSendmail:
+		return &SendmailTransport{Path: transportConfig.SendmailPath}, nil
+	case TransportFile:
+		return NewFileTransport(transportConfig.Dir)
+	case TransportMemory:
+		return &MemoryTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", transportConfig.Kind)
+	}
+}
+
+// SendmailTransport pipes messages to a local sendmail compatible binary.
+// Envelope recipients are passed as arguments rather than read from the
+// headers with -t, so Bcc recipients are delivered without ever being
+// written to the message.
+type SendmailTransport struct {
+	Path string   // defaults to /usr/sbin/sendmail
+	Args []string // extra arguments placed before the recipients
+}
+
+// Send runs sendmail once for msg
+func (t *SendmailTransport) Send(ctx context.Context, from string, to []string, msg []byte) error {
+	path := t.Path
+	if path == "" {
+		path = "/usr/sbin/sendmail"
+	}
+
+	args := append([]string{"-i", "-f", from}, t.Args...)
+	args = append(args, "--")
+	args = append(args, to...)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("sendmail aborted: %w", ctx.Err())
+		}
+		return fmt.Errorf("sendmail failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Close is a no-op
+func (t *SendmailTransport) Close() error {
+	return nil
+}
+
+// FileTransport writes every message to its own .eml file in Dir, which is
+// useful in local development. The envelope is recorded in X-Envelope-From
+// and X-Envelope-To headers.
+type FileTransport struct {
+	Dir string
+}
+
+// NewFileTransport creates a FileTransport, creating dir if needed
+func NewFileTransport(dir string) (*FileTransport, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("mail output directory is required")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create mail output directory: %w", err)
+	}
+	return &FileTransport{Dir: dir}, nil
+}
+
+// Send writes msg to a new .eml file
+func (t *FileTransport) Send(ctx context.Context, from string, to []string, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(random))
+
+	var data bytes.Buffer
+	fmt.Fprintf(&data, "X-Envelope-From: %s\r\n", from)
+	fmt.Fprintf(&data, "X-Envelope-To: %s\r\n", strings.Join(to, ", "))
+	data.Write(msg)
+
+	if err := os.WriteFile(filepath.Join(t.Dir, name), data.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+// Close is a no-op
+func (t *FileTransport) Close() error {
+	return nil
+}
+
+// SentMessage is a message recorded by MemoryTransport
+type SentMessage struct {
+	From   string
+	To     []string
+	Data   []byte
+	SentAt time.Time
+}
+
+// MemoryTransport records messages instead of delivering them, for tests.
+// It is safe for concurrent use.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []SentMessage
+}
+
+// Send records msg
+func (t *MemoryTransport) Send(ctx context.Context, from string, to []string, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = append(t.messages, SentMessage{
+		From:   from,
+		To:     append([]string(nil), to...),
+		Data:   append([]byte(nil), msg...),
+		SentAt: time.Now(),
+	})
+	return nil
+}
+
+// Messages returns a copy of the recorded messages, oldest first
+func (t *MemoryTransport) Messages() []SentMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	messages := make([]SentMessage, len(t.messages))
+	for i, msg := range t.messages {
+		msg.To = append([]string(nil), msg.To...)
+		msg.Data = append([]byte(nil), msg.Data...)
+		messages[i] = msg
+	}
+	return messages
+}
+
+// Reset forgets every recorded message
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = nil
+}
+
+// Close is a no-op
+func (t *MemoryTransport) Close() error {
+	return nil
+}
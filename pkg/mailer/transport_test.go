@@ -0,0 +1,178 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// transportTestEmail has recipients in every field so the envelope can be
+// told apart from the headers
+func transportTestEmail() EmailData {
+	return EmailData{
+		To:      []string{"Jane Doe <jane@example.com>"},
+		Cc:      []string{"bob@example.com"},
+		Bcc:     []string{"audit@example.com"},
+		Subject: "Quarterly report",
+		Body:    "Hello Jane,\n\nThe report is ready.",
+	}
+}
+
+var transportTestConfig = SMTPConfig{Email: "reports@example.com", FromName: "Reports"}
+
+func TestMemoryTransport(t *testing.T) {
+	transport := &MemoryTransport{}
+	client, err := NewClientWithTransport(transportTestConfig, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messageID, err := client.Send(transportTestEmail())
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	messages := transport.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("recorded %d messages, want 1", len(messages))
+	}
+	sent := messages[0]
+	if sent.From != "reports@example.com" {
+		t.Errorf("envelope from = %q, want reports@example.com", sent.From)
+	}
+	wantTo := []string{"jane@example.com", "bob@example.com", "audit@example.com"}
+	if !slices.Equal(sent.To, wantTo) {
+		t.Errorf("envelope to = %q, want %q", sent.To, wantTo)
+	}
+
+	data := string(sent.Data)
+	for _, want := range []string{
+		"From: \"Reports\" <reports@example.com>\r\n",
+		"To: \"Jane Doe\" <jane@example.com>\r\n",
+		"Cc: <bob@example.com>\r\n",
+		"Subject: Quarterly report\r\n",
+		"Message-ID: " + messageID + "\r\n",
+		"The report is ready.",
+	} {
+		if !strings.Contains(data, want) {
+			t.Errorf("message lacks %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(data, "audit@example.com") {
+		t.Errorf("Bcc recipient written to the message:\n%s", data)
+	}
+
+	// The recording is a copy the transport's caller cannot change
+	sent.To[0] = "changed@example.com"
+	if transport.Messages()[0].To[0] != "jane@example.com" {
+		t.Error("changing a returned message changed the recording")
+	}
+
+	transport.Reset()
+	if n := len(transport.Messages()); n != 0 {
+		t.Errorf("recorded %d messages after Reset, want 0", n)
+	}
+}
+
+func TestFileTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	transport, err := NewTransport(TransportConfig{Kind: TransportFile, Dir: dir}, transportTestConfig)
+	if err != nil {
+		t.Fatalf("NewTransport: %v", err)
+	}
+	client, err := NewClientWithTransport(transportTestConfig, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messageID, err := client.Send(transportTestEmail())
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	second := transportTestEmail()
+	second.Subject = "Quarterly report, corrected"
+	if _, err := client.Send(second); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("wrote %d .eml files, want 2", len(files))
+	}
+
+	var first string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "Message-ID: "+messageID+"\r\n") {
+			first = string(data)
+		}
+	}
+	if first == "" {
+		t.Fatalf("no file holds Message-ID %s", messageID)
+	}
+
+	envelope := "X-Envelope-From: reports@example.com\r\n" +
+		"X-Envelope-To: jane@example.com, bob@example.com, audit@example.com\r\n"
+	if !strings.HasPrefix(first, envelope) {
+		t.Errorf("file does not start with the envelope headers:\n%s", first)
+	}
+	for _, want := range []string{
+		"To: \"Jane Doe\" <jane@example.com>\r\n",
+		"Subject: Quarterly report\r\n",
+		"The report is ready.",
+	} {
+		if !strings.Contains(first, want) {
+			t.Errorf("file lacks %q:\n%s", want, first)
+		}
+	}
+}
+
+func TestTransportCanceledContext(t *testing.T) {
+	fileTransport, err := NewFileTransport(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for name, transport := range map[string]Transport{"memory": &MemoryTransport{}, "file": fileTransport} {
+		client, err := NewClientWithTransport(transportTestConfig, transport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.SendContext(ctx, transportTestEmail()); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: SendContext = %v, want context.Canceled", name, err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(fileTransport.Dir, "*"))
+	if len(files) != 0 {
+		t.Errorf("file transport wrote %d files after cancellation", len(files))
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	if _, err := NewTransport(TransportConfig{Kind: TransportFile}, transportTestConfig); err == nil {
+		t.Error("file transport without a directory was accepted")
+	}
+	if _, err := NewTransport(TransportConfig{Kind: "carrier-pigeon"}, transportTestConfig); err == nil {
+		t.Error("unknown transport kind was accepted")
+	}
+	if transport, err := NewTransport(TransportConfig{Kind: TransportMemory}, transportTestConfig); err != nil {
+		t.Errorf("memory transport: %v", err)
+	} else if _, ok := transport.(*MemoryTransport); !ok {
+		t.Errorf("memory transport is a %T", transport)
+	}
+	if _, err := NewClientWithTransport(SMTPConfig{}, &MemoryTransport{}); err == nil {
+		t.Error("client without a sender address was accepted")
+	}
+}
@@ -0,0 +1,57 @@
+package otp
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"unicode/utf8"
+)
+
+// Alphabets for generated codes
+const (
+	Digits = "0123456789"
+	// Alphanumeric leaves out characters that are easily confused: 0, O, 1, I and L
+	Alphanumeric = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+)
+
+// Generate returns a cryptographically random code of length characters
+// drawn uniformly from alphabet
+func Generate(length int, alphabet string) (string, error) {
+	if err := validateFormat(length, alphabet); err != nil {
+		return "", err
+	}
+
+	symbols := []rune(alphabet)
+	max := big.NewInt(int64(len(symbols)))
+	code := make([]rune, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate code: %w", err)
+		}
+		code[i] = symbols[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// validateFormat checks a code length and alphabet
+func validateFormat(length int, alphabet string) error {
+	if length < 4 || length > 64 {
+		return fmt.Errorf("code length must be between 4 and 64, got %d", length)
+	}
+	if !utf8.ValidString(alphabet) {
+		return fmt.Errorf("code alphabet is not valid UTF-8")
+	}
+
+	seen := map[rune]bool{}
+	for _, r := range alphabet {
+		if seen[r] {
+			return fmt.Errorf("code alphabet repeats %q", r)
+		}
+		seen[r] = true
+	}
+	if len(seen) < 2 {
+		return fmt.Errorf("code alphabet needs at least 2 characters")
+	}
+	return nil
+}
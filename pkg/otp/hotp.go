@@ -0,0 +1,189 @@
+package otp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"rsc.io/qr"
+)
+
+// Algorithm is the HMAC hash of an authenticator key
+type Algorithm string
+
+const (
+	SHA1   Algorithm = "SHA1" // the only algorithm every authenticator app supports
+	SHA256 Algorithm = "SHA256"
+	SHA512 Algorithm = "SHA512"
+)
+
+func (a Algorithm) hash() (func() hash.Hash, error) {
+	switch a {
+	case SHA1:
+		return sha1.New, nil
+	case SHA256:
+		return sha256.New, nil
+	case SHA512:
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %q", a)
+}
+
+// KeyType is the kind of an authenticator key
+type KeyType string
+
+const (
+	TOTP KeyType = "totp" // time-based, RFC 6238
+	HOTP KeyType = "hotp" // counter-based, RFC 4226
+)
+
+// HOTPCode returns the RFC 4226 code of secret for counter
+func HOTPCode(secret []byte, counter uint64, digits int, algorithm Algorithm) (string, error) {
+	if digits < 6 || digits > 8 {
+		return "", fmt.Errorf("digits must be between 6 and 8, got %d", digits)
+	}
+	newHash, err := algorithm.hash()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(newHash, secret)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation (RFC 4226 5.3)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for range digits {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulo), nil
+}
+
+// TOTPCode returns the RFC 6238 code of secret at t
+func TOTPCode(secret []byte, t time.Time, period time.Duration, digits int, algorithm Algorithm) (string, error) {
+	if period < time.Second {
+		return "", fmt.Errorf("period must be at least 1s, got %s", period)
+	}
+	return HOTPCode(secret, timeStep(t, period), digits, algorithm)
+}
+
+// timeStep returns the TOTP time step of t, counted from the Unix epoch
+func timeStep(t time.Time, period time.Duration) uint64 {
+	return uint64(t.Unix() / int64(period/time.Second))
+}
+
+// Key is an authenticator key, as shared with an authenticator app
+type Key struct {
+	Type      KeyType
+	Secret    []byte
+	Issuer    string // the service name shown in the app
+	Account   string // the account name shown in the app
+	Algorithm Algorithm
+	Digits    int
+	Period    time.Duration // TOTP only
+	Counter   uint64        // HOTP only, the next counter value
+}
+
+// GenerateKey returns a key with a random 160-bit secret, as RFC 4226
+// recommends
+func GenerateKey(keyType KeyType, issuer, account string) (Key, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	key := Key{
+		Type:      keyType,
+		Secret:    secret,
+		Issuer:    issuer,
+		Account:   account,
+		Algorithm: SHA1,
+		Digits:    6,
+	}
+	if keyType == TOTP {
+		key.Period = 30 * time.Second
+	}
+	return key, key.Validate()
+}
+
+// Validate checks that the key can be used and shared
+func (k Key) Validate() error {
+	switch k.Type {
+	case TOTP:
+		if k.Period < time.Second || k.Period%time.Second != 0 {
+			return fmt.Errorf("period must be a whole number of seconds, got %s", k.Period)
+		}
+	case HOTP:
+	default:
+		return fmt.Errorf("unsupported key type %q", k.Type)
+	}
+	if _, err := k.Algorithm.hash(); err != nil {
+		return err
+	}
+	switch {
+	case len(k.Secret) < 16:
+		return fmt.Errorf("secret must be at least 128 bits")
+	case k.Digits < 6 || k.Digits > 8:
+		return fmt.Errorf("digits must be between 6 and 8, got %d", k.Digits)
+	case strings.TrimSpace(k.Account) == "":
+		return fmt.Errorf("account is required")
+	case strings.Contains(k.Issuer, ":") || strings.Contains(k.Account, ":"):
+		// The label separates the issuer from the account with a colon
+		return fmt.Errorf("issuer and account must not contain a colon")
+	}
+	return nil
+}
+
+// EncodedSecret returns the secret in unpadded base32, the form users type
+// into authenticator apps
+func (k Key) EncodedSecret() string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(k.Secret)
+}
+
+// URI returns the otpauth:// URI of the key, the Key Uri Format understood
+// by Google Authenticator and most other apps
+func (k Key) URI() string {
+	label := url.PathEscape(k.Account)
+	if k.Issuer != "" {
+		label = url.PathEscape(k.Issuer) + ":" + label
+	}
+
+	params := url.Values{}
+	params.Set("secret", k.EncodedSecret())
+	if k.Issuer != "" {
+		params.Set("issuer", k.Issuer)
+	}
+	params.Set("algorithm", string(k.Algorithm))
+	params.Set("digits", strconv.Itoa(k.Digits))
+	if k.Type == TOTP {
+		params.Set("period", strconv.Itoa(int(k.Period/time.Second)))
+	} else {
+		params.Set("counter", strconv.FormatUint(k.Counter, 10))
+	}
+
+	// Some apps show a + in the query as is, so spaces are sent as %20
+	query := strings.ReplaceAll(params.Encode(), "+", "%20")
+	return "otpauth://" + string(k.Type) + "/" + label + "?" + query
+}
+
+// QRCode returns the URI of the key as a PNG QR code, for scanning into an
+// authenticator app
+func (k Key) QRCode() ([]byte, error) {
+	code, err := qr.Encode(k.URI(), qr.M)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %w", err)
+	}
+	return code.PNG(), nil
+}
@@ -0,0 +1,95 @@
+package otp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHOTPCode checks the test values of RFC 4226 Appendix D
+func TestHOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		got, err := HOTPCode(secret, uint64(counter), 6, SHA1)
+		if err != nil {
+			t.Fatalf("HOTPCode(%d): %v", counter, err)
+		}
+		if got != code {
+			t.Errorf("HOTPCode(%d) = %s, want %s", counter, got, code)
+		}
+	}
+
+	for _, digits := range []int{5, 9} {
+		if _, err := HOTPCode(secret, 0, digits, SHA1); err == nil {
+			t.Errorf("HOTPCode accepted %d digits", digits)
+		}
+	}
+	if _, err := HOTPCode(secret, 0, 6, "MD5"); err == nil {
+		t.Error("HOTPCode accepted MD5")
+	}
+}
+
+// TestTOTPCode checks the test values of RFC 6238 Appendix B
+func TestTOTPCode(t *testing.T) {
+	secrets := map[Algorithm][]byte{
+		SHA1:   []byte("12345678901234567890"),
+		SHA256: []byte("12345678901234567890123456789012"),
+		SHA512: []byte("1234567890123456789012345678901234567890123456789012345678901234"),
+	}
+	tests := []struct {
+		unix int64
+		want map[Algorithm]string
+	}{
+		{59, map[Algorithm]string{SHA1: "94287082", SHA256: "46119246", SHA512: "90693936"}},
+		{1111111109, map[Algorithm]string{SHA1: "07081804", SHA256: "68084774", SHA512: "25091201"}},
+		{1111111111, map[Algorithm]string{SHA1: "14050471", SHA256: "67062674", SHA512: "99943326"}},
+		{1234567890, map[Algorithm]string{SHA1: "89005924", SHA256: "91819424", SHA512: "93441116"}},
+		{2000000000, map[Algorithm]string{SHA1: "69279037", SHA256: "90698825", SHA512: "38618901"}},
+		{20000000000, map[Algorithm]string{SHA1: "65353130", SHA256: "77737706", SHA512: "47863826"}},
+	}
+	for _, tt := range tests {
+		for algorithm, want := range tt.want {
+			got, err := TOTPCode(secrets[algorithm], time.Unix(tt.unix, 0), 30*time.Second, 8, algorithm)
+			if err != nil {
+				t.Fatalf("TOTPCode(%d, %s): %v", tt.unix, algorithm, err)
+			}
+			if got != want {
+				t.Errorf("TOTPCode(%d, %s) = %s, want %s", tt.unix, algorithm, got, want)
+			}
+		}
+	}
+
+	if _, err := TOTPCode(secrets[SHA1], time.Unix(59, 0), 500*time.Millisecond, 6, SHA1); err == nil {
+		t.Error("TOTPCode accepted a period under 1s")
+	}
+}
+
+func TestKeyURI(t *testing.T) {
+	key := Key{
+		Type:      TOTP,
+		Secret:    []byte("12345678901234567890"),
+		Issuer:    "Acme Corp",
+		Account:   "jane@example.com",
+		Algorithm: SHA1,
+		Digits:    6,
+		Period:    30 * time.Second,
+	}
+	if err := key.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	want := "otpauth://totp/Acme%20Corp:jane@example.com?algorithm=SHA1&digits=6&issuer=Acme%20Corp&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	if got := key.URI(); got != want {
+		t.Errorf("URI() = %s, want %s", got, want)
+	}
+
+	key.Type, key.Period, key.Counter = HOTP, 0, 7
+	if got := key.URI(); !strings.HasPrefix(got, "otpauth://hotp/") || !strings.Contains(got, "counter=7") {
+		t.Errorf("HOTP URI() = %s", got)
+	}
+
+	key.Account = "jane:doe"
+	if err := key.Validate(); err == nil {
+		t.Error("Validate accepted an account with a colon")
+	}
+}
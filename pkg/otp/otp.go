@@ -0,0 +1,502 @@
+// Package otp issues and verifies one-time passwords. Codes are stored in
+// SQLite as HMAC-SHA256 hashes, one active code per recipient and purpose,
+// with attempt limits, resend cooldowns and single-use verification.
+// TwoFactor adds TOTP and HOTP second factors for authenticator apps.
+package otp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var (
+	// ErrNoCode means no code is active for the recipient and purpose: none
+	// was issued, it was used, or it was invalidated
+	ErrNoCode      = errors.New("no active code")
+	ErrExpired     = errors.New("code has expired")
+	ErrInvalidCode = errors.New("invalid code")
+	ErrLocked      = errors.New("too many failed attempts")
+	ErrCooldown    = errors.New("a code was sent too recently")
+)
+
+// Error is returned when a request or verification is refused. It wraps
+// one of the Err variables.
+type Error struct {
+	Err          error
+	RetryAfter   time.Duration // for ErrLocked and ErrCooldown
+	AttemptsLeft int           // for ErrInvalidCode
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.RetryAfter > 0:
+		return fmt.Sprintf("%v, retry in %s", e.Err, e.RetryAfter.Round(time.Second))
+	case errors.Is(e.Err, ErrInvalidCode):
+		return fmt.Sprintf("%v, %d attempts left", e.Err, e.AttemptsLeft)
+	}
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Config configures a Service. Zero values use the defaults.
+type Config struct {
+	Length         int                                // code length, 6 by default
+	Alphabet       string                             // Digits by default
+	TTL            func(purpose string) time.Duration // code lifetime, 10 minutes by default
+	MaxAttempts    int                                // failed verifications before the lockout, 5 by default
+	Lockout        time.Duration                      // 15 minutes by default
+	ResendCooldown time.Duration                      // minimum time between codes, 1 minute by default
+
+	// Secret keys the code hashes. When empty a random key is generated
+	// and stored in the database.
+	Secret []byte
+
+	// Policies override Length and ResendCooldown for the codes of a purpose
+	Policies map[string]Policy
+}
+
+// Policy overrides the Config of the codes of one purpose. Zero values use
+// the Config values.
+type Policy struct {
+	Length         int
+	ResendCooldown time.Duration
+}
+
+// Code is an issued code
+type Code struct {
+	Value     string
+	ExpiresAt time.Time
+}
+
+// Service issues and verifies codes
+type Service struct {
+	db     *sql.DB
+	config Config
+	key    []byte
+	mu     sync.Mutex // serializes read-modify-write of code rows
+
+	// maxCooldown is the longest resend cooldown of any purpose, for which
+	// rows of expired codes are kept
+	maxCooldown time.Duration
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS otp_codes (
+	recipient    TEXT    NOT NULL,
+	purpose      TEXT    NOT NULL,
+	code_hash    BLOB,
+	attempts     INTEGER NOT NULL DEFAULT 0,
+	created_at   INTEGER NOT NULL,
+	expires_at   INTEGER NOT NULL,
+	locked_until INTEGER NOT NULL DEFAULT 0,
+	channel      TEXT    NOT NULL DEFAULT '',
+	PRIMARY KEY (recipient, purpose)
+);
+CREATE TABLE IF NOT EXISTS otp_settings (
+	name  TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+);`
+
+// Open opens or creates the SQLite database at path and returns a Service
+// using it
+func Open(ctx context.Context, path string, config Config) (*Service, error) {
+	db, err := OpenDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := New(ctx, db, config)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return service, nil
+}
+
+// OpenDB opens or creates the SQLite database at path, for sharing between
+// a Service and a TwoFactor
+func OpenDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OTP database: %w", err)
+	}
+	return db, nil
+}
+
+// New returns a Service storing codes in db, creating its tables if needed
+func New(ctx context.Context, db *sql.DB, config Config) (*Service, error) {
+	if config.Length == 0 {
+		config.Length = 6
+	}
+	if config.Alphabet == "" {
+		config.Alphabet = Digits
+	}
+	if err := validateFormat(config.Length, config.Alphabet); err != nil {
+		return nil, err
+	}
+	if config.TTL == nil {
+		config.TTL = func(string) time.Duration { return 10 * time.Minute }
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.Lockout <= 0 {
+		config.Lockout = 15 * time.Minute
+	}
+	if config.ResendCooldown < 0 {
+		return nil, fmt.Errorf("resend cooldown must not be negative")
+	}
+	if config.ResendCooldown == 0 {
+		config.ResendCooldown = time.Minute
+	}
+	maxCooldown := config.ResendCooldown
+	for purpose, policy := range config.Policies {
+		if policy.Length != 0 {
+			if err := validateFormat(policy.Length, config.Alphabet); err != nil {
+				return nil, fmt.Errorf("purpose %s: %w", purpose, err)
+			}
+		}
+		if policy.ResendCooldown < 0 {
+			return nil, fmt.Errorf("purpose %s: resend cooldown must not be negative", purpose)
+		}
+		maxCooldown = max(maxCooldown, policy.ResendCooldown)
+	}
+
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		return nil, fmt.Errorf("failed to create OTP tables: %w", err)
+	}
+	if err := addColumn(ctx, db, "otp_codes", "channel", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+
+	service := &Service{db: db, config: config, key: config.Secret, maxCooldown: maxCooldown}
+	if len(service.key) == 0 {
+		key, err := storedKey(ctx, db, "hmac_key")
+		if err != nil {
+			return nil, err
+		}
+		service.key = key
+	}
+	return service, nil
+}
+
+// Close closes the database
+func (s *Service) Close() error {
+	return s.db.Close()
+}
+
+// Issue generates a code for recipient and purpose, replacing the active
+// one. It fails with ErrCooldown when the previous code was issued less than
+// ResendCooldown ago and with ErrLocked during a lockout.
+func (s *Service) Issue(ctx context.Context, recipient, purpose string) (Code, error) {
+	value, err := Generate(s.length(purpose), s.config.Alphabet)
+	if err != nil {
+		return Code{}, err
+	}
+	return s.issue(ctx, recipient, purpose, value)
+}
+
+// issue stores value as the active code of recipient and purpose
+func (s *Service) issue(ctx context.Context, recipient, purpose, value string) (Code, error) {
+	recipient, err := normalize(recipient, purpose)
+	if err != nil {
+		return Code{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	// Rows of expired codes are only kept for cooldowns and lockouts
+	if _, err := s.db.ExecContext(ctx,
+		`DELETE FROM otp_codes WHERE expires_at < ? AND locked_until < ? AND created_at < ?`,
+		now.UnixMilli(), now.UnixMilli(), now.Add(-s.maxCooldown).UnixMilli(),
+	); err != nil {
+		return Code{}, fmt.Errorf("failed to delete expired codes: %w", err)
+	}
+
+	row, err := s.load(ctx, recipient, purpose)
+	if err != nil {
+		return Code{}, err
+	}
+	if row != nil {
+		if wait := row.lockedUntil.Sub(now); wait > 0 {
+			return Code{}, &Error{Err: ErrLocked, RetryAfter: wait}
+		}
+		if wait := row.createdAt.Add(s.resendCooldown(purpose)).Sub(now); wait > 0 {
+			return Code{}, &Error{Err: ErrCooldown, RetryAfter: wait}
+		}
+	}
+
+	code := Code{Value: value, ExpiresAt: now.Add(s.config.TTL(purpose))}
+
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO otp_codes (recipient, purpose, code_hash, attempts, created_at, expires_at, locked_until)
+		VALUES (?, ?, ?, 0, ?, ?, 0)
+		ON CONFLICT (recipient, purpose) DO UPDATE SET
+			code_hash = excluded.code_hash,
+			attempts = 0,
+			created_at = excluded.created_at,
+			expires_at = excluded.expires_at,
+			locked_until = 0,
+			channel = ''`,
+		recipient, purpose, s.hash(recipient, purpose, value), now.UnixMilli(), code.ExpiresAt.UnixMilli(),
+	); err != nil {
+		return Code{}, fmt.Errorf("failed to store code: %w", err)
+	}
+
+	return code, nil
+}
+
+// Verify checks code against the active code of recipient and purpose. A
+// matching code is used up. After MaxAttempts failures the code is
+// invalidated and the recipient locked out of the purpose for Lockout.
+func (s *Service) Verify(ctx context.Context, recipient, purpose, code string) error {
+	recipient, err := normalize(recipient, purpose)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	row, err := s.load(ctx, recipient, purpose)
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return &Error{Err: ErrNoCode}
+	}
+	if wait := row.lockedUntil.Sub(now); wait > 0 {
+		return &Error{Err: ErrLocked, RetryAfter: wait}
+	}
+	if row.codeHash == nil {
+		return &Error{Err: ErrNoCode}
+	}
+	if now.After(row.expiresAt) {
+		if err := s.invalidate(ctx, recipient, purpose); err != nil {
+			return err
+		}
+		return &Error{Err: ErrExpired}
+	}
+
+	if hmac.Equal(row.codeHash, s.hash(recipient, purpose, s.canonical(code))) {
+		if err := s.invalidate(ctx, recipient, purpose); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	attempts := row.attempts + 1
+	if attempts >= s.config.MaxAttempts {
+		if _, err := s.db.ExecContext(ctx,
+			`UPDATE otp_codes SET code_hash = NULL, attempts = ?, locked_until = ? WHERE recipient = ? AND purpose = ?`,
+			attempts, now.Add(s.config.Lockout).UnixMilli(), recipient, purpose,
+		); err != nil {
+			return fmt.Errorf("failed to lock code: %w", err)
+		}
+		return &Error{Err: ErrLocked, RetryAfter: s.config.Lockout}
+	}
+
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE otp_codes SET attempts = ? WHERE recipient = ? AND purpose = ?`,
+		attempts, recipient, purpose,
+	); err != nil {
+		return fmt.Errorf("failed to count attempt: %w", err)
+	}
+	return &Error{Err: ErrInvalidCode, AttemptsLeft: s.config.MaxAttempts - attempts}
+}
+
+// Invalidate discards the active code of recipient and purpose, e.g. when it
+// could not be delivered, and lifts the resend cooldown so a new code can be
+// requested right away. Lockouts stay in effect.
+func (s *Service) Invalidate(ctx context.Context, recipient, purpose string) error {
+	recipient, err := normalize(recipient, purpose)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE otp_codes SET code_hash = NULL, created_at = 0 WHERE recipient = ? AND purpose = ?`,
+		recipient, purpose,
+	); err != nil {
+		return fmt.Errorf("failed to invalidate code: %w", err)
+	}
+	return nil
+}
+
+// Delivered records the channel that delivered the active code of recipient
+// and purpose, e.g. "email" or "whatsapp"
+func (s *Service) Delivered(ctx context.Context, recipient, purpose, channel string) error {
+	recipient, err := normalize(recipient, purpose)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE otp_codes SET channel = ? WHERE recipient = ? AND purpose = ?`,
+		channel, recipient, purpose,
+	); err != nil {
+		return fmt.Errorf("failed to record delivery: %w", err)
+	}
+	return nil
+}
+
+// Channel returns the channel that delivered the last code of recipient and
+// purpose, empty when it is unknown
+func (s *Service) Channel(ctx context.Context, recipient, purpose string) (string, error) {
+	recipient, err := normalize(recipient, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	row, err := s.load(ctx, recipient, purpose)
+	if err != nil || row == nil {
+		return "", err
+	}
+	return row.channel, nil
+}
+
+// length returns the code length of purpose
+func (s *Service) length(purpose string) int {
+	if policy := s.config.Policies[purpose]; policy.Length != 0 {
+		return policy.Length
+	}
+	return s.config.Length
+}
+
+// resendCooldown returns the resend cooldown of purpose
+func (s *Service) resendCooldown(purpose string) time.Duration {
+	if policy := s.config.Policies[purpose]; policy.ResendCooldown != 0 {
+		return policy.ResendCooldown
+	}
+	return s.config.ResendCooldown
+}
+
+// invalidate clears the code hash, keeping the row for the cooldown.
+// Callers must hold s.mu.
+func (s *Service) invalidate(ctx context.Context, recipient, purpose string) error {
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE otp_codes SET code_hash = NULL WHERE recipient = ? AND purpose = ?`,
+		recipient, purpose,
+	); err != nil {
+		return fmt.Errorf("failed to invalidate code: %w", err)
+	}
+	return nil
+}
+
+// codeRow is a row of otp_codes
+type codeRow struct {
+	codeHash    []byte
+	attempts    int
+	createdAt   time.Time
+	expiresAt   time.Time
+	lockedUntil time.Time
+	channel     string
+}
+
+// load returns the row of recipient and purpose, or nil
+func (s *Service) load(ctx context.Context, recipient, purpose string) (*codeRow, error) {
+	var row codeRow
+	var createdAt, expiresAt, lockedUntil int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT code_hash, attempts, created_at, expires_at, locked_until, channel FROM otp_codes WHERE recipient = ? AND purpose = ?`,
+		recipient, purpose,
+	).Scan(&row.codeHash, &row.attempts, &createdAt, &expiresAt, &lockedUntil, &row.channel)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load code: %w", err)
+	}
+
+	row.createdAt = time.UnixMilli(createdAt)
+	row.expiresAt = time.UnixMilli(expiresAt)
+	row.lockedUntil = time.UnixMilli(lockedUntil)
+	return &row, nil
+}
+
+// hash keys a code to its recipient and purpose, so a hash cannot be
+// replayed for another row
+func (s *Service) hash(recipient, purpose, code string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(recipient + "\x00" + purpose + "\x00" + code))
+	return mac.Sum(nil)
+}
+
+// storedKey returns the 256-bit key of that name stored in otp_settings,
+// creating it first
+func storedKey(ctx context.Context, db *sql.DB, name string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate OTP key: %w", err)
+	}
+	if _, err := db.ExecContext(ctx,
+		`INSERT INTO otp_settings (name, value) VALUES (?, ?) ON CONFLICT (name) DO NOTHING`, name, key,
+	); err != nil {
+		return nil, fmt.Errorf("failed to store OTP key: %w", err)
+	}
+	if err := db.QueryRowContext(ctx, `SELECT value FROM otp_settings WHERE name = ?`, name).Scan(&key); err != nil {
+		return nil, fmt.Errorf("failed to load OTP key: %w", err)
+	}
+	return key, nil
+}
+
+// canonical trims a code entered by a user, and uppercases it when the
+// alphabet has no lowercase letters
+func (s *Service) canonical(code string) string {
+	code = strings.TrimSpace(code)
+	if strings.ToUpper(s.config.Alphabet) == s.config.Alphabet {
+		code = strings.ToUpper(code)
+	}
+	return code
+}
+
+// addColumn adds a column to a table created by an earlier version
+func addColumn(ctx context.Context, db *sql.DB, table, column, definition string) error {
+	var exists bool
+	if err := db.QueryRowContext(ctx,
+		`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, table, column,
+	).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	if exists {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// normalize lowercases and trims recipient and checks the purpose
+func normalize(recipient, purpose string) (string, error) {
+	recipient = strings.ToLower(strings.TrimSpace(recipient))
+	if recipient == "" {
+		return "", fmt.Errorf("recipient is required")
+	}
+	if strings.TrimSpace(purpose) == "" {
+		return "", fmt.Errorf("purpose is required")
+	}
+	return recipient, nil
+}
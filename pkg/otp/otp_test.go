@@ -0,0 +1,194 @@
+package otp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testDB opens an in-memory database. A single connection keeps every query
+// on the same database, each connection to :memory: having its own.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func testService(t *testing.T, config Config) *Service {
+	t.Helper()
+	service, err := New(context.Background(), testDB(t), config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return service
+}
+
+// wantError checks that err wraps target and returns it as an *Error
+func wantError(t *testing.T, err, target error) *Error {
+	t.Helper()
+	if !errors.Is(err, target) {
+		t.Fatalf("error = %v, want %v", err, target)
+	}
+	var otpErr *Error
+	if !errors.As(err, &otpErr) {
+		t.Fatalf("error %v is not an *Error", err)
+	}
+	return otpErr
+}
+
+func TestIssueVerify(t *testing.T) {
+	ctx := context.Background()
+	service := testService(t, Config{})
+
+	code, err := service.Issue(ctx, " Jane@Example.com ", "login")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if len(code.Value) != 6 {
+		t.Errorf("code %q has %d digits, want 6", code.Value, len(code.Value))
+	}
+	if ttl := time.Until(code.ExpiresAt); ttl < 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("code expires in %s, want 10m", ttl)
+	}
+
+	// Codes are bound to their purpose
+	wantError(t, service.Verify(ctx, "jane@example.com", "password_reset", code.Value), ErrNoCode)
+
+	if err := service.Verify(ctx, "jane@example.com", "login", " "+code.Value+" "); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	// and used up by a successful verification
+	wantError(t, service.Verify(ctx, "jane@example.com", "login", code.Value), ErrNoCode)
+}
+
+func TestVerifyLockout(t *testing.T) {
+	ctx := context.Background()
+	service := testService(t, Config{MaxAttempts: 3, Lockout: time.Hour})
+
+	code, err := service.Issue(ctx, "jane@example.com", "login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if code.Value == wrong {
+		wrong = "111111"
+	}
+
+	for left := 2; left > 0; left-- {
+		otpErr := wantError(t, service.Verify(ctx, "jane@example.com", "login", wrong), ErrInvalidCode)
+		if otpErr.AttemptsLeft != left {
+			t.Errorf("AttemptsLeft = %d, want %d", otpErr.AttemptsLeft, left)
+		}
+	}
+	otpErr := wantError(t, service.Verify(ctx, "jane@example.com", "login", wrong), ErrLocked)
+	if otpErr.RetryAfter != time.Hour {
+		t.Errorf("RetryAfter = %s, want 1h", otpErr.RetryAfter)
+	}
+
+	// The lockout holds for the right code, for new codes and over Invalidate
+	wantError(t, service.Verify(ctx, "jane@example.com", "login", code.Value), ErrLocked)
+	_, err = service.Issue(ctx, "jane@example.com", "login")
+	wantError(t, err, ErrLocked)
+	if err := service.Invalidate(ctx, "jane@example.com", "login"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.Issue(ctx, "jane@example.com", "login")
+	wantError(t, err, ErrLocked)
+
+	// Other purposes are not locked
+	if _, err := service.Issue(ctx, "jane@example.com", "verification"); err != nil {
+		t.Errorf("Issue for another purpose: %v", err)
+	}
+}
+
+func TestIssueCooldown(t *testing.T) {
+	ctx := context.Background()
+	service := testService(t, Config{
+		ResendCooldown: time.Minute,
+		Policies:       map[string]Policy{"password_reset": {Length: 8, ResendCooldown: 5 * time.Minute}},
+	})
+
+	first, err := service.Issue(ctx, "jane@example.com", "login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.Issue(ctx, "jane@example.com", "login")
+	otpErr := wantError(t, err, ErrCooldown)
+	if otpErr.RetryAfter <= 0 || otpErr.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter = %s, want at most 1m", otpErr.RetryAfter)
+	}
+	// The refused request leaves the first code active
+	if err := service.Verify(ctx, "jane@example.com", "login", first.Value); err != nil {
+		t.Errorf("Verify after a refused resend: %v", err)
+	}
+
+	code, err := service.Issue(ctx, "jane@example.com", "password_reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code.Value) != 8 {
+		t.Errorf("password_reset code %q, want the policy length 8", code.Value)
+	}
+	_, err = service.Issue(ctx, "jane@example.com", "password_reset")
+	if otpErr := wantError(t, err, ErrCooldown); otpErr.RetryAfter <= time.Minute {
+		t.Errorf("RetryAfter = %s, want the policy cooldown of 5m", otpErr.RetryAfter)
+	}
+
+	// Invalidating an undelivered code lifts the cooldown
+	if err := service.Invalidate(ctx, "jane@example.com", "password_reset"); err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, service.Verify(ctx, "jane@example.com", "password_reset", code.Value), ErrNoCode)
+	if _, err := service.Issue(ctx, "jane@example.com", "password_reset"); err != nil {
+		t.Errorf("Issue after Invalidate: %v", err)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	ctx := context.Background()
+	service := testService(t, Config{
+		TTL: func(purpose string) time.Duration {
+			if purpose == "expired" {
+				return -time.Second
+			}
+			return time.Minute
+		},
+	})
+
+	code, err := service.Issue(ctx, "jane@example.com", "expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, service.Verify(ctx, "jane@example.com", "expired", code.Value), ErrExpired)
+	// An expired code is discarded
+	wantError(t, service.Verify(ctx, "jane@example.com", "expired", code.Value), ErrNoCode)
+}
+
+func TestNewSharesStoredKey(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	first, err := New(ctx, db, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := first.Issue(ctx, "jane@example.com", "login")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted service reads the generated key back
+	second, err := New(ctx, db, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Verify(ctx, "jane@example.com", "login", code.Value); err != nil {
+		t.Errorf("Verify after restart: %v", err)
+	}
+}
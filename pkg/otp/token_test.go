@@ -0,0 +1,116 @@
+package otp
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssueVerifyToken(t *testing.T) {
+	ctx := context.Background()
+	service := testService(t, Config{})
+
+	token, err := service.IssueToken(ctx, "Jane@Example.com", "magic_link")
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	identity, err := service.VerifyToken(ctx, "magic_link", token.Value)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	if identity != (Identity{Recipient: "jane@example.com", Purpose: "magic_link"}) {
+		t.Errorf("VerifyToken = %+v", identity)
+	}
+
+	// A used token cannot sign in again
+	_, err = service.VerifyToken(ctx, "magic_link", token.Value)
+	wantError(t, err, ErrNoCode)
+}
+
+func TestVerifyTokenTampered(t *testing.T) {
+	ctx := context.Background()
+	service := testService(t, Config{})
+
+	token, err := service.IssueToken(ctx, "jane@example.com", "magic_link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, signature, _ := strings.Cut(token.Value, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(payload), "jane@", "mallory@", 1)))
+
+	other := testService(t, Config{})
+	foreign, err := other.IssueToken(ctx, "jane@example.com", "magic_link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"changed recipient":    forged + "." + signature,
+		"truncated signature":  encoded + "." + signature[:len(signature)-4],
+		"no signature":         encoded,
+		"signature not base64": encoded + ".!!!",
+		"other service key":    foreign.Value,
+	}
+	for name, value := range tests {
+		_, err := service.VerifyToken(ctx, "magic_link", value)
+		if err == nil {
+			t.Errorf("%s: VerifyToken accepted the token", name)
+			continue
+		}
+		wantError(t, err, ErrInvalidToken)
+	}
+
+	// A token is bound to its purpose
+	_, err = service.VerifyToken(ctx, "password_reset", token.Value)
+	wantError(t, err, ErrInvalidToken)
+
+	// Rejected tokens leave the real one usable
+	if _, err := service.VerifyToken(ctx, "magic_link", token.Value); err != nil {
+		t.Errorf("VerifyToken after tampered attempts: %v", err)
+	}
+}
+
+func TestVerifyTokenExpired(t *testing.T) {
+	ctx := context.Background()
+	service := testService(t, Config{TTL: func(string) time.Duration { return -time.Minute }})
+
+	token, err := service.IssueToken(ctx, "jane@example.com", "magic_link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.VerifyToken(ctx, "magic_link", token.Value)
+	wantError(t, err, ErrExpired)
+}
+
+func TestVerifyTokenReplaced(t *testing.T) {
+	ctx := context.Background()
+	service := testService(t, Config{})
+
+	first, err := service.IssueToken(ctx, "jane@example.com", "magic_link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.IssueToken(ctx, "jane@example.com", "magic_link")
+	wantError(t, err, ErrCooldown)
+
+	if err := service.Invalidate(ctx, "jane@example.com", "magic_link"); err != nil {
+		t.Fatal(err)
+	}
+	second, err := service.IssueToken(ctx, "jane@example.com", "magic_link")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the newest token of a recipient and purpose is valid
+	_, err = service.VerifyToken(ctx, "magic_link", first.Value)
+	wantError(t, err, ErrNoCode)
+	if _, err := service.VerifyToken(ctx, "magic_link", second.Value); err != nil {
+		t.Errorf("VerifyToken of the newest token: %v", err)
+	}
+}
@@ -0,0 +1,587 @@
+package otp
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotEnrolled     = errors.New("two-factor authentication is not enabled")
+	ErrAlreadyEnrolled = errors.New("two-factor authentication is already enabled")
+	ErrReplayed        = errors.New("code was already used")
+)
+
+// recoveryAlphabet is used for recovery codes, which users type in lowercase
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// TwoFactorConfig configures a TwoFactor. Zero values use the defaults.
+type TwoFactorConfig struct {
+	Issuer        string        // the service name shown in authenticator apps
+	Window        int           // TOTP steps accepted before and after the current one, 1 by default
+	LookAhead     int           // HOTP counter values accepted past the expected one, 10 by default
+	RecoveryCodes int           // recovery codes per user, 10 by default
+	MaxAttempts   int           // failed verifications before the lockout, 5 by default
+	Lockout       time.Duration // 15 minutes by default
+
+	// EncryptionKey encrypts the stored secrets. When empty a random key is
+	// generated and stored in the database. Secrets encrypted with another
+	// key cannot be read.
+	EncryptionKey []byte
+}
+
+// TwoFactor enrolls users in authenticator app second factors and verifies
+// their TOTP or HOTP codes and recovery codes. Secrets are stored encrypted
+// with AES-256-GCM, recovery codes as HMAC-SHA256 hashes.
+type TwoFactor struct {
+	db     *sql.DB
+	config TwoFactorConfig
+	aead   cipher.AEAD
+	macKey []byte
+	mu     sync.Mutex // serializes read-modify-write of key rows
+}
+
+// TwoFactorStatus describes the second factor of a user
+type TwoFactorStatus struct {
+	Enabled           bool // a key was enrolled and confirmed
+	Pending           bool // a key was enrolled but not confirmed yet
+	Type              KeyType
+	RecoveryCodesLeft int
+	EnabledAt         time.Time
+}
+
+const twoFactorSchema = `
+CREATE TABLE IF NOT EXISTS twofactor_keys (
+	user_id      TEXT    PRIMARY KEY,
+	type         TEXT    NOT NULL,
+	secret       BLOB    NOT NULL,
+	algorithm    TEXT    NOT NULL,
+	digits       INTEGER NOT NULL,
+	period       INTEGER NOT NULL DEFAULT 0,
+	counter      INTEGER NOT NULL DEFAULT 0,
+	last_step    INTEGER NOT NULL DEFAULT 0,
+	attempts     INTEGER NOT NULL DEFAULT 0,
+	locked_until INTEGER NOT NULL DEFAULT 0,
+	created_at   INTEGER NOT NULL,
+	confirmed_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS twofactor_recovery_codes (
+	user_id   TEXT    NOT NULL,
+	code_hash BLOB    NOT NULL,
+	used_at   INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (user_id, code_hash)
+);
+CREATE TABLE IF NOT EXISTS otp_settings (
+	name  TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+);`
+
+// NewTwoFactor returns a TwoFactor storing keys in db, creating its tables
+// if needed
+func NewTwoFactor(ctx context.Context, db *sql.DB, config TwoFactorConfig) (*TwoFactor, error) {
+	if config.Window <= 0 {
+		config.Window = 1
+	}
+	if config.LookAhead <= 0 {
+		config.LookAhead = 10
+	}
+	if config.RecoveryCodes <= 0 {
+		config.RecoveryCodes = 10
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.Lockout <= 0 {
+		config.Lockout = 15 * time.Minute
+	}
+	if strings.Contains(config.Issuer, ":") {
+		return nil, fmt.Errorf("issuer must not contain a colon")
+	}
+
+	if _, err := db.ExecContext(ctx, twoFactorSchema); err != nil {
+		return nil, fmt.Errorf("failed to create two-factor tables: %w", err)
+	}
+
+	var key []byte
+	if len(config.EncryptionKey) > 0 {
+		sum := sha256.Sum256(config.EncryptionKey)
+		key = sum[:]
+	} else {
+		stored, err := storedKey(ctx, db, "twofactor_key")
+		if err != nil {
+			return nil, err
+		}
+		key = stored
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("recovery codes"))
+
+	return &TwoFactor{db: db, config: config, aead: aead, macKey: mac.Sum(nil)}, nil
+}
+
+// Enroll generates a key for user, replacing an enrollment that was not
+// confirmed. The key is only used once Confirm has seen a code from it.
+// account is the name shown in authenticator apps, user when empty.
+func (t *TwoFactor) Enroll(ctx context.Context, user string, keyType KeyType, account string) (Key, error) {
+	user, err := normalizeUser(user)
+	if err != nil {
+		return Key{}, err
+	}
+	if account == "" {
+		account = user
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	row, err := t.load(ctx, user)
+	if err != nil {
+		return Key{}, err
+	}
+	if row != nil && !row.confirmedAt.IsZero() {
+		return Key{}, &Error{Err: ErrAlreadyEnrolled}
+	}
+
+	key, err := GenerateKey(keyType, t.config.Issuer, account)
+	if err != nil {
+		return Key{}, err
+	}
+	sealed, err := t.seal(user, key.Secret)
+	if err != nil {
+		return Key{}, err
+	}
+
+	if _, err := t.db.ExecContext(ctx, `
+		INSERT INTO twofactor_keys (user_id, type, secret, algorithm, digits, period, counter, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			type = excluded.type,
+			secret = excluded.secret,
+			algorithm = excluded.algorithm,
+			digits = excluded.digits,
+			period = excluded.period,
+			counter = excluded.counter,
+			last_step = 0,
+			attempts = 0,
+			locked_until = 0,
+			created_at = excluded.created_at,
+			confirmed_at = 0`,
+		user, string(key.Type), sealed, string(key.Algorithm), key.Digits,
+		int64(key.Period/time.Second), int64(key.Counter), time.Now().UnixMilli(),
+	); err != nil {
+		return Key{}, fmt.Errorf("failed to store key: %w", err)
+	}
+	return key, nil
+}
+
+// Confirm enables the enrolled key of user once it produced a valid code,
+// and returns the recovery codes of user. They are only stored hashed, so
+// this is the one time they can be shown.
+func (t *TwoFactor) Confirm(ctx context.Context, user, code string) ([]string, error) {
+	user, err := normalizeUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	row, err := t.load(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return nil, &Error{Err: ErrNotEnrolled}
+	}
+	if !row.confirmedAt.IsZero() {
+		return nil, &Error{Err: ErrAlreadyEnrolled}
+	}
+	if err := t.check(ctx, user, row, code); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.db.ExecContext(ctx,
+		`UPDATE twofactor_keys SET confirmed_at = ? WHERE user_id = ?`, time.Now().UnixMilli(), user,
+	); err != nil {
+		return nil, fmt.Errorf("failed to confirm key: %w", err)
+	}
+	return t.replaceRecoveryCodes(ctx, user)
+}
+
+// Verify checks a code from the authenticator app of user. TOTP codes are
+// accepted Window steps around the current time, each at most once. HOTP
+// codes are accepted up to LookAhead counter values ahead, which
+// resynchronizes the counter. After MaxAttempts failures in a row, including
+// recovery codes, user is locked out for Lockout.
+func (t *TwoFactor) Verify(ctx context.Context, user, code string) error {
+	user, err := normalizeUser(user)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	row, err := t.load(ctx, user)
+	if err != nil {
+		return err
+	}
+	if row == nil || row.confirmedAt.IsZero() {
+		return &Error{Err: ErrNotEnrolled}
+	}
+	return t.check(ctx, user, row, code)
+}
+
+// UseRecoveryCode checks and uses up a recovery code of user, for when the
+// authenticator app is lost, and returns the number of codes left
+func (t *TwoFactor) UseRecoveryCode(ctx context.Context, user, code string) (int, error) {
+	user, err := normalizeUser(user)
+	if err != nil {
+		return 0, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	row, err := t.load(ctx, user)
+	if err != nil {
+		return 0, err
+	}
+	if row == nil || row.confirmedAt.IsZero() {
+		return 0, &Error{Err: ErrNotEnrolled}
+	}
+	if wait := row.lockedUntil.Sub(now); wait > 0 {
+		return 0, &Error{Err: ErrLocked, RetryAfter: wait}
+	}
+
+	result, err := t.db.ExecContext(ctx,
+		`UPDATE twofactor_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at = 0`,
+		now.UnixMilli(), user, t.recoveryHash(user, code),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	if used, err := result.RowsAffected(); err != nil || used == 0 {
+		return 0, t.fail(ctx, user, row)
+	}
+	if err := t.resetAttempts(ctx, user); err != nil {
+		return 0, err
+	}
+	return t.recoveryCodesLeft(ctx, user)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of user
+func (t *TwoFactor) RegenerateRecoveryCodes(ctx context.Context, user string) ([]string, error) {
+	user, err := normalizeUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	row, err := t.load(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil || row.confirmedAt.IsZero() {
+		return nil, &Error{Err: ErrNotEnrolled}
+	}
+	return t.replaceRecoveryCodes(ctx, user)
+}
+
+// Disable removes the key and recovery codes of user
+func (t *TwoFactor) Disable(ctx context.Context, user string) error {
+	user, err := normalizeUser(user)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to disable two-factor authentication: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM twofactor_keys WHERE user_id = ?`, user)
+	if err != nil {
+		return fmt.Errorf("failed to delete key: %w", err)
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		return &Error{Err: ErrNotEnrolled}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM twofactor_recovery_codes WHERE user_id = ?`, user); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to disable two-factor authentication: %w", err)
+	}
+	return nil
+}
+
+// Status returns the second factor of user
+func (t *TwoFactor) Status(ctx context.Context, user string) (TwoFactorStatus, error) {
+	user, err := normalizeUser(user)
+	if err != nil {
+		return TwoFactorStatus{}, err
+	}
+
+	row, err := t.load(ctx, user)
+	if err != nil || row == nil {
+		return TwoFactorStatus{}, err
+	}
+	status := TwoFactorStatus{
+		Enabled:   !row.confirmedAt.IsZero(),
+		Pending:   row.confirmedAt.IsZero(),
+		Type:      row.keyType,
+		EnabledAt: row.confirmedAt,
+	}
+	if status.Enabled {
+		if status.RecoveryCodesLeft, err = t.recoveryCodesLeft(ctx, user); err != nil {
+			return TwoFactorStatus{}, err
+		}
+	}
+	return status, nil
+}
+
+// check verifies code against the key of row, counting failed attempts.
+// Callers must hold t.mu.
+func (t *TwoFactor) check(ctx context.Context, user string, row *keyRow, code string) error {
+	now := time.Now()
+	if wait := row.lockedUntil.Sub(now); wait > 0 {
+		return &Error{Err: ErrLocked, RetryAfter: wait}
+	}
+
+	secret, err := t.open(user, row.secret)
+	if err != nil {
+		return err
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+
+	switch row.keyType {
+	case TOTP:
+		current := int64(timeStep(now, row.period))
+		replayed := false
+		for step := current - int64(t.config.Window); step <= current+int64(t.config.Window); step++ {
+			if step < 0 || !t.matches(secret, uint64(step), row, code) {
+				continue
+			}
+			if step <= row.lastStep {
+				replayed = true
+				continue
+			}
+			if _, err := t.db.ExecContext(ctx,
+				`UPDATE twofactor_keys SET last_step = ?, attempts = 0 WHERE user_id = ?`, step, user,
+			); err != nil {
+				return fmt.Errorf("failed to record code: %w", err)
+			}
+			return nil
+		}
+		if replayed {
+			return &Error{Err: ErrReplayed}
+		}
+
+	case HOTP:
+		for counter := row.counter; counter <= row.counter+int64(t.config.LookAhead); counter++ {
+			if !t.matches(secret, uint64(counter), row, code) {
+				continue
+			}
+			if _, err := t.db.ExecContext(ctx,
+				`UPDATE twofactor_keys SET counter = ?, attempts = 0 WHERE user_id = ?`, counter+1, user,
+			); err != nil {
+				return fmt.Errorf("failed to record code: %w", err)
+			}
+			return nil
+		}
+	}
+
+	return t.fail(ctx, user, row)
+}
+
+// matches reports whether code is the code of secret for counter
+func (t *TwoFactor) matches(secret []byte, counter uint64, row *keyRow, code string) bool {
+	expected, err := HOTPCode(secret, counter, row.digits, row.algorithm)
+	return err == nil && hmac.Equal([]byte(expected), []byte(code))
+}
+
+// fail counts a failed attempt, locking user out after MaxAttempts.
+// Callers must hold t.mu.
+func (t *TwoFactor) fail(ctx context.Context, user string, row *keyRow) error {
+	attempts := row.attempts + 1
+	if attempts >= t.config.MaxAttempts {
+		if _, err := t.db.ExecContext(ctx,
+			`UPDATE twofactor_keys SET attempts = 0, locked_until = ? WHERE user_id = ?`,
+			time.Now().Add(t.config.Lockout).UnixMilli(), user,
+		); err != nil {
+			return fmt.Errorf("failed to lock key: %w", err)
+		}
+		return &Error{Err: ErrLocked, RetryAfter: t.config.Lockout}
+	}
+
+	if _, err := t.db.ExecContext(ctx,
+		`UPDATE twofactor_keys SET attempts = ? WHERE user_id = ?`, attempts, user,
+	); err != nil {
+		return fmt.Errorf("failed to count attempt: %w", err)
+	}
+	return &Error{Err: ErrInvalidCode, AttemptsLeft: t.config.MaxAttempts - attempts}
+}
+
+func (t *TwoFactor) resetAttempts(ctx context.Context, user string) error {
+	if _, err := t.db.ExecContext(ctx, `UPDATE twofactor_keys SET attempts = 0 WHERE user_id = ?`, user); err != nil {
+		return fmt.Errorf("failed to reset attempts: %w", err)
+	}
+	return nil
+}
+
+// replaceRecoveryCodes generates new recovery codes for user, formatted as
+// xxxxx-xxxxx. Callers must hold t.mu.
+func (t *TwoFactor) replaceRecoveryCodes(ctx context.Context, user string) ([]string, error) {
+	codes := make([]string, t.config.RecoveryCodes)
+	for i := range codes {
+		code, err := Generate(10, recoveryAlphabet)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM twofactor_recovery_codes WHERE user_id = ?`, user); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	for _, code := range codes {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO twofactor_recovery_codes (user_id, code_hash) VALUES (?, ?)`, user, t.recoveryHash(user, code),
+		); err != nil {
+			return nil, fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+func (t *TwoFactor) recoveryCodesLeft(ctx context.Context, user string) (int, error) {
+	var left int
+	if err := t.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM twofactor_recovery_codes WHERE user_id = ? AND used_at = 0`, user,
+	).Scan(&left); err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+	return left, nil
+}
+
+// recoveryHash hashes a recovery code as typed by the user, ignoring case,
+// spaces and dashes
+func (t *TwoFactor) recoveryHash(user, code string) []byte {
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+
+	mac := hmac.New(sha256.New, t.macKey)
+	mac.Write([]byte(user + "\x00" + code))
+	return mac.Sum(nil)
+}
+
+// seal encrypts the secret of user, bound to the user so a sealed secret
+// cannot be moved to another row
+func (t *TwoFactor) seal(user string, secret []byte) ([]byte, error) {
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return t.aead.Seal(nonce, nonce, secret, []byte(user)), nil
+}
+
+func (t *TwoFactor) open(user string, sealed []byte) ([]byte, error) {
+	size := t.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, fmt.Errorf("failed to decrypt secret: too short")
+	}
+	secret, err := t.aead.Open(nil, sealed[:size], sealed[size:], []byte(user))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return secret, nil
+}
+
+// keyRow is a row of twofactor_keys
+type keyRow struct {
+	keyType     KeyType
+	secret      []byte
+	algorithm   Algorithm
+	digits      int
+	period      time.Duration
+	counter     int64
+	lastStep    int64
+	attempts    int
+	lockedUntil time.Time
+	confirmedAt time.Time
+}
+
+// load returns the key row of user, or nil
+func (t *TwoFactor) load(ctx context.Context, user string) (*keyRow, error) {
+	var row keyRow
+	var keyType, algorithm string
+	var period, lockedUntil, confirmedAt int64
+	err := t.db.QueryRowContext(ctx, `
+		SELECT type, secret, algorithm, digits, period, counter, last_step, attempts, locked_until, confirmed_at
+		FROM twofactor_keys WHERE user_id = ?`, user,
+	).Scan(&keyType, &row.secret, &algorithm, &row.digits, &period, &row.counter, &row.lastStep,
+		&row.attempts, &lockedUntil, &confirmedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key: %w", err)
+	}
+
+	row.keyType = KeyType(keyType)
+	row.algorithm = Algorithm(algorithm)
+	row.period = time.Duration(period) * time.Second
+	row.lockedUntil = time.UnixMilli(lockedUntil)
+	if confirmedAt > 0 {
+		row.confirmedAt = time.UnixMilli(confirmedAt)
+	}
+	return &row, nil
+}
+
+// normalizeUser trims and checks a user ID. IDs are kept case-sensitive.
+func normalizeUser(user string) (string, error) {
+	user = strings.TrimSpace(user)
+	if user == "" {
+		return "", fmt.Errorf("user is required")
+	}
+	return user, nil
+}
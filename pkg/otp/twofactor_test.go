@@ -0,0 +1,162 @@
+package otp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTwoFactor(t *testing.T, config TwoFactorConfig) *TwoFactor {
+	t.Helper()
+	twoFactor, err := NewTwoFactor(context.Background(), testDB(t), config)
+	if err != nil {
+		t.Fatalf("NewTwoFactor: %v", err)
+	}
+	return twoFactor
+}
+
+// totpAt returns the code of key for the time step at offset steps from now
+func totpAt(t *testing.T, key Key, offset int) string {
+	t.Helper()
+	code, err := TOTPCode(key.Secret, time.Now().Add(time.Duration(offset)*key.Period), key.Period, key.Digits, key.Algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func hotpAt(t *testing.T, key Key, counter uint64) string {
+	t.Helper()
+	code, err := HOTPCode(key.Secret, counter, key.Digits, key.Algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTwoFactorTOTPReplay(t *testing.T) {
+	ctx := context.Background()
+	twoFactor := testTwoFactor(t, TwoFactorConfig{Issuer: "Acme"})
+
+	key, err := twoFactor.Enroll(ctx, "user-1", TOTP, "jane@example.com")
+	if err != nil {
+		t.Fatalf("Enroll: %v", err)
+	}
+	wantError(t, twoFactor.Verify(ctx, "user-1", totpAt(t, key, 0)), ErrNotEnrolled)
+
+	codes, err := twoFactor.Confirm(ctx, "user-1", totpAt(t, key, 0))
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if len(codes) != 10 {
+		t.Errorf("Confirm returned %d recovery codes, want 10", len(codes))
+	}
+
+	// The code that confirmed the key, and any older one, cannot be used again
+	wantError(t, twoFactor.Verify(ctx, "user-1", totpAt(t, key, 0)), ErrReplayed)
+	wantError(t, twoFactor.Verify(ctx, "user-1", totpAt(t, key, -1)), ErrReplayed)
+
+	// The next step is within the window, and moves last_step past the current one
+	if err := twoFactor.Verify(ctx, "user-1", totpAt(t, key, 1)); err != nil {
+		t.Fatalf("Verify of the next step: %v", err)
+	}
+	wantError(t, twoFactor.Verify(ctx, "user-1", totpAt(t, key, 1)), ErrReplayed)
+	wantError(t, twoFactor.Verify(ctx, "user-1", totpAt(t, key, 0)), ErrReplayed)
+
+	// Steps outside the window are wrong codes
+	wantError(t, twoFactor.Verify(ctx, "user-1", totpAt(t, key, 3)), ErrInvalidCode)
+}
+
+func TestTwoFactorHOTPLookAhead(t *testing.T) {
+	ctx := context.Background()
+	twoFactor := testTwoFactor(t, TwoFactorConfig{LookAhead: 10, MaxAttempts: 10})
+
+	key, err := twoFactor.Enroll(ctx, "user-1", HOTP, "")
+	if err != nil {
+		t.Fatalf("Enroll: %v", err)
+	}
+	if _, err := twoFactor.Confirm(ctx, "user-1", hotpAt(t, key, key.Counter)); err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	next := key.Counter + 1
+
+	// Codes generated but not used in between are skipped over
+	if err := twoFactor.Verify(ctx, "user-1", hotpAt(t, key, next+5)); err != nil {
+		t.Fatalf("Verify 5 counter values ahead: %v", err)
+	}
+	next += 6
+
+	// Skipped and used codes are behind the counter now
+	wantError(t, twoFactor.Verify(ctx, "user-1", hotpAt(t, key, next-3)), ErrInvalidCode)
+	wantError(t, twoFactor.Verify(ctx, "user-1", hotpAt(t, key, next-1)), ErrInvalidCode)
+
+	// The look-ahead covers the expected counter value and 10 more
+	wantError(t, twoFactor.Verify(ctx, "user-1", hotpAt(t, key, next+11)), ErrInvalidCode)
+	if err := twoFactor.Verify(ctx, "user-1", hotpAt(t, key, next+10)); err != nil {
+		t.Errorf("Verify at the end of the look-ahead: %v", err)
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	ctx := context.Background()
+	twoFactor := testTwoFactor(t, TwoFactorConfig{MaxAttempts: 3, Lockout: time.Hour})
+
+	key, err := twoFactor.Enroll(ctx, "user-1", TOTP, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := twoFactor.Confirm(ctx, "user-1", totpAt(t, key, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrong recovery codes count towards the lockout too
+	wantError(t, twoFactor.Verify(ctx, "user-1", totpAt(t, key, 5)), ErrInvalidCode)
+	_, err = twoFactor.UseRecoveryCode(ctx, "user-1", "aaaaa-aaaaa")
+	wantError(t, err, ErrInvalidCode)
+	wantError(t, twoFactor.Verify(ctx, "user-1", totpAt(t, key, 5)), ErrLocked)
+
+	wantError(t, twoFactor.Verify(ctx, "user-1", totpAt(t, key, 1)), ErrLocked)
+	_, err = twoFactor.UseRecoveryCode(ctx, "user-1", codes[0])
+	wantError(t, err, ErrLocked)
+}
+
+func TestTwoFactorRecoveryCodes(t *testing.T) {
+	ctx := context.Background()
+	twoFactor := testTwoFactor(t, TwoFactorConfig{RecoveryCodes: 3})
+
+	key, err := twoFactor.Enroll(ctx, "user-1", TOTP, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := twoFactor.Confirm(ctx, "user-1", totpAt(t, key, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Codes are accepted without the dash and in uppercase, once
+	left, err := twoFactor.UseRecoveryCode(ctx, "user-1", " "+strings.ToUpper(codes[1][:5]+codes[1][6:])+" ")
+	if err != nil {
+		t.Fatalf("UseRecoveryCode: %v", err)
+	}
+	if left != 2 {
+		t.Errorf("%d recovery codes left, want 2", left)
+	}
+	_, err = twoFactor.UseRecoveryCode(ctx, "user-1", codes[1])
+	wantError(t, err, ErrInvalidCode)
+
+	status, err := twoFactor.Status(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Enabled || status.Type != TOTP || status.RecoveryCodesLeft != 2 {
+		t.Errorf("Status = %+v", status)
+	}
+
+	if err := twoFactor.Disable(ctx, "user-1"); err != nil {
+		t.Fatalf("Disable: %v", err)
+	}
+	_, err = twoFactor.UseRecoveryCode(ctx, "user-1", codes[0])
+	wantError(t, err, ErrNotEnrolled)
+}
@@ -0,0 +1,282 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxPoll is the longest the delivery loop sleeps without being woken
+const maxPoll = time.Minute
+
+// queueSize is how many events Enqueue holds before dropping them
+const queueSize = 1024
+
+// queuedEvent is an event waiting in the queue of Enqueue
+type queuedEvent struct {
+	eventType string
+	data      any
+	createdAt time.Time
+}
+
+// publishQueued publishes the events of Enqueue until Close, then the ones
+// still queued
+func (d *Dispatcher) publishQueued() {
+	defer d.wg.Done()
+	for {
+		select {
+		case evt := <-d.queue:
+			d.publishEvent(evt)
+		case <-d.ctx.Done():
+			for {
+				select {
+				case evt := <-d.queue:
+					d.publishEvent(evt)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// publishEvent publishes a queued event, logging failures as there is no one
+// to return them to
+func (d *Dispatcher) publishEvent(evt queuedEvent) {
+	// Not canceled by Close, which waits for the queue to be drained
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := d.publish(ctx, evt.eventType, evt.data, evt.createdAt); err != nil {
+		slog.Error("Failed to queue webhook deliveries", "event", evt.eventType, "error", err)
+	}
+}
+
+// run delivers due deliveries until Close
+func (d *Dispatcher) run() {
+	defer close(d.done)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+		timer.Reset(d.deliverDue())
+	}
+}
+
+// deliverDue starts attempts for the due deliveries, as many as there are
+// free workers, and returns how long to wait for the next one
+func (d *Dispatcher) deliverDue() time.Duration {
+	d.prune()
+
+	d.mu.Lock()
+	free := d.config.Workers - len(d.inFlight)
+	d.mu.Unlock()
+	now := time.Now()
+
+	if free > 0 {
+		ids, err := d.due(now, free)
+		if err != nil {
+			slog.Error("Failed to load due webhook deliveries", "error", err)
+			return maxPoll
+		}
+		for _, id := range ids {
+			d.mu.Lock()
+			d.inFlight[id] = true
+			d.mu.Unlock()
+
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				d.attempt(id)
+
+				d.mu.Lock()
+				delete(d.inFlight, id)
+				d.mu.Unlock()
+				d.notify()
+			}()
+		}
+	}
+
+	var next *int64
+	if err := d.db.QueryRowContext(d.ctx,
+		`SELECT MIN(next_attempt_at) FROM webhook_deliveries WHERE status = ?`, StatusPending,
+	).Scan(&next); err != nil || next == nil {
+		return maxPoll
+	}
+	return min(max(time.Until(time.UnixMilli(*next)), 100*time.Millisecond), maxPoll)
+}
+
+// due returns up to limit due deliveries that are not in flight
+func (d *Dispatcher) due(now time.Time, limit int) ([]string, error) {
+	d.mu.Lock()
+	skip := len(d.inFlight)
+	d.mu.Unlock()
+
+	rows, err := d.db.QueryContext(d.ctx,
+		`SELECT id FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?`,
+		StatusPending, now.UnixMilli(), limit+skip,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() && len(ids) < limit {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		busy := d.inFlight[id]
+		d.mu.Unlock()
+		if !busy {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// attempt sends a delivery once and records the outcome
+func (d *Dispatcher) attempt(id string) {
+	var webhookID, eventType, rawURL, secret string
+	var payload []byte
+	var attempts int
+	err := d.db.QueryRowContext(d.ctx,
+		`SELECT d.webhook_id, d.event_type, d.payload, d.attempts, w.url, w.secret
+		 FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		 WHERE d.id = ? AND d.status = ?`, id, StatusPending,
+	).Scan(&webhookID, &eventType, &payload, &attempts, &rawURL, &secret)
+	if err != nil {
+		// Delivered, retried or deleted in the meantime
+		return
+	}
+
+	start := time.Now()
+	statusCode, sendErr := d.send(id, webhookID, eventType, rawURL, secret, payload)
+	if d.ctx.Err() != nil {
+		// Interrupted by Close, the attempt is made again after a restart
+		return
+	}
+	duration := time.Since(start)
+
+	attempts++
+	status := StatusDelivered
+	next := int64(0)
+	errText := ""
+	if sendErr != nil {
+		errText = sendErr.Error()
+		status = StatusPending
+		next = start.Add(d.backoff(attempts)).UnixMilli()
+		if attempts >= d.config.MaxAttempts {
+			status = StatusFailed
+		}
+	}
+
+	tx, err := d.db.BeginTx(d.ctx, nil)
+	if err != nil {
+		slog.Error("Failed to record webhook delivery", "delivery", id, "webhook", webhookID, "error", err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(d.ctx,
+		`INSERT OR REPLACE INTO webhook_attempts (delivery_id, number, status_code, error, duration_ms, attempted_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		id, attempts, statusCode, errText, duration.Milliseconds(), start.UnixMilli(),
+	); err != nil {
+		slog.Error("Failed to record webhook delivery", "delivery", id, "webhook", webhookID, "error", err)
+		return
+	}
+	if _, err := tx.ExecContext(d.ctx,
+		`UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_status_code = ?, last_error = ?, updated_at = ? WHERE id = ?`,
+		status, attempts, next, statusCode, errText, time.Now().UnixMilli(), id,
+	); err != nil {
+		slog.Error("Failed to record webhook delivery", "delivery", id, "webhook", webhookID, "error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("Failed to record webhook delivery", "delivery", id, "webhook", webhookID, "error", err)
+	}
+}
+
+// send posts a payload to a webhook, returning the response status code and
+// an error unless it is a 2xx. Redirects are not followed.
+func (d *Dispatcher) send(deliveryID, webhookID, eventType, rawURL, secret string, payload []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, d.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "whats-email-webhooks/"+strconv.Itoa(Version))
+	req.Header.Set("X-Webhook-ID", webhookID)
+	req.Header.Set("X-Webhook-Delivery", deliveryID)
+	req.Header.Set("X-Webhook-Event", eventType)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(secret, timestamp, payload))
+
+	resp, err := d.config.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain some of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 300 && resp.StatusCode <= 399 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %s to %q, redirects are not followed", resp.Status, resp.Header.Get("Location"))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the wait after the given number of failed attempts: the
+// initial backoff doubled for every attempt after the first, capped at the
+// maximum, with up to a quarter taken off at random so retries spread out
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.config.InitialBackoff
+	for i := 1; i < attempts && wait < d.config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, d.config.MaxBackoff)
+	return wait - rand.N(wait/4+1)
+}
+
+// prune deletes finished deliveries older than the retention, at most once
+// an hour
+func (d *Dispatcher) prune() {
+	now := time.Now()
+	if now.Sub(d.pruned) < time.Hour {
+		return
+	}
+	d.pruned = now
+
+	cutoff := now.Add(-d.config.Retention).UnixMilli()
+	if _, err := d.db.ExecContext(d.ctx,
+		`DELETE FROM webhook_attempts WHERE delivery_id IN (SELECT id FROM webhook_deliveries WHERE status != ? AND updated_at < ?)`,
+		StatusPending, cutoff,
+	); err != nil {
+		slog.Error("Failed to prune webhook attempts", "error", err)
+		return
+	}
+	if _, err := d.db.ExecContext(d.ctx,
+		`DELETE FROM webhook_deliveries WHERE status != ? AND updated_at < ?`, StatusPending, cutoff,
+	); err != nil {
+		slog.Error("Failed to prune webhook deliveries", "error", err)
+	}
+}
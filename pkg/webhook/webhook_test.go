@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testDispatcher returns a dispatcher on a new database that retries within
+// milliseconds
+func testDispatcher(t *testing.T, config Config) *Dispatcher {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "webhooks.db")
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if config.InitialBackoff == 0 {
+		config.InitialBackoff = 20 * time.Millisecond
+		config.MaxBackoff = 50 * time.Millisecond
+	}
+	d, err := New(context.Background(), db, config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(d.Close)
+	return d
+}
+
+// waitForDelivery waits until the only delivery of a webhook is no longer
+// pending and returns it with its attempts
+func waitForDelivery(t *testing.T, d *Dispatcher, webhookID string) (Delivery, []Attempt) {
+	t.Helper()
+	ctx := context.Background()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries, err := d.Deliveries(ctx, webhookID, "", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) == 1 && deliveries[0].Status != StatusPending {
+			delivery, attempts, err := d.Delivery(ctx, webhookID, deliveries[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return delivery, attempts
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("delivery still pending")
+	return Delivery{}, nil
+}
+
+func TestDeliverRetriesAndSigns(t *testing.T) {
+	ctx := context.Background()
+	var calls atomic.Int32
+	var badSignature atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+Sign("0123456789abcdef", timestamp, body) {
+			badSignature.Store(true)
+		}
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	d := testDispatcher(t, Config{MaxAttempts: 5})
+	hook, err := d.Create(ctx, server.URL, []string{"message.received"}, "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Filtered out by the webhook
+	if _, err := d.Publish(ctx, "presence.updated", map[string]any{"available": true}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := d.Publish(ctx, "message.received", map[string]any{"text": "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery, attempts := waitForDelivery(t, d, hook.ID)
+	if badSignature.Load() {
+		t.Error("a request was not signed with the webhook secret")
+	}
+	if delivery.Status != StatusDelivered || delivery.EventID != event.ID || delivery.Attempts != 3 {
+		t.Errorf("delivery = %+v, want delivered after 3 attempts", delivery)
+	}
+	if len(attempts) != 3 || attempts[0].StatusCode != http.StatusServiceUnavailable || attempts[2].StatusCode != http.StatusNoContent {
+		t.Errorf("attempts = %+v", attempts)
+	}
+	if !strings.Contains(string(delivery.Payload), `"text":"Hello"`) {
+		t.Errorf("payload = %s", delivery.Payload)
+	}
+}
+
+func TestDeliverDoesNotFollowRedirects(t *testing.T) {
+	ctx := context.Background()
+	var followed atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed.Store(true)
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+"/elsewhere", http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	// A client given in the configuration does not follow them either
+	d := testDispatcher(t, Config{MaxAttempts: 2, Client: &http.Client{}})
+	hook, err := d.Create(ctx, server.URL, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Publish(ctx, "message.received", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+
+	delivery, attempts := waitForDelivery(t, d, hook.ID)
+	if followed.Load() {
+		t.Error("the redirect was followed")
+	}
+	if delivery.Status != StatusFailed || len(attempts) != 2 {
+		t.Fatalf("delivery = %+v with %d attempts, want failed after 2", delivery, len(attempts))
+	}
+	if attempts[0].StatusCode != http.StatusTemporaryRedirect || !strings.Contains(attempts[0].Error, "redirects are not followed") {
+		t.Errorf("attempt = %+v", attempts[0])
+	}
+}
+
+func TestEnqueueDrainedOnClose(t *testing.T) {
+	ctx := context.Background()
+	d := testDispatcher(t, Config{})
+	// Never answers, the deliveries stay pending
+	hook, err := d.Create(ctx, "http://127.0.0.1:1/", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if !d.Enqueue("message.received", map[string]any{"text": "Hello"}) {
+			t.Fatal("Enqueue dropped an event")
+		}
+	}
+	d.Close()
+
+	deliveries, err := d.Deliveries(ctx, hook.ID, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 {
+		t.Errorf("%d deliveries after Close, want the 3 enqueued events", len(deliveries))
+	}
+}
+
+func TestSign(t *testing.T) {
+	// HMAC-SHA256 of "1700000000.{}" keyed with "secret"
+	got := Sign("secret", 1700000000, []byte("{}"))
+	if len(got) != 64 || got != Sign("secret", 1700000000, []byte("{}")) {
+		t.Fatalf("Sign = %q", got)
+	}
+	if got == Sign("secret", 1700000001, []byte("{}")) || got == Sign("other", 1700000000, []byte("{}")) {
+		t.Error("signature does not depend on the timestamp and secret")
+	}
+}
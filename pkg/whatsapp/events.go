@@ -0,0 +1,156 @@
+package whatsapp
+
+import (
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Event types passed to the handlers added with Manager.AddEventHandler
+const (
+	EventMessage   = "message.received"
+	EventReceipt   = "message.receipt"
+	EventPresence  = "presence.updated"
+	EventLoggedOut = "session.logged_out"
+)
+
+// EventTypes lists the event types, in the order of the constants
+var EventTypes = []string{EventMessage, EventReceipt, EventPresence, EventLoggedOut}
+
+// Event is a WhatsApp event of a session, in a form that encodes to JSON.
+// Data is a MessageEvent, ReceiptEvent, PresenceEvent or LoggedOutEvent.
+type Event struct {
+	Type string
+	Data any
+}
+
+// EventHandler is called with the events of every session
+type EventHandler func(Event)
+
+// MessageEvent is a message received in a chat, or sent from another device
+// of the account when FromMe is set
+type MessageEvent struct {
+	Session   string    `json:"session"`
+	ID        string    `json:"id"`
+	Chat      string    `json:"chat"`
+	Sender    string    `json:"sender"`
+	PushName  string    `json:"push_name,omitempty"`
+	FromMe    bool      `json:"from_me"`
+	Group     bool      `json:"group"`
+	Type      string    `json:"type"`
+	Text      string    `json:"text,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ReceiptEvent is a delivery or read receipt for messages. Type is
+// delivered, read, read-self, played and so on.
+type ReceiptEvent struct {
+	Session    string    `json:"session"`
+	Type       string    `json:"type"`
+	MessageIDs []string  `json:"message_ids"`
+	Chat       string    `json:"chat"`
+	Sender     string    `json:"sender"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// PresenceEvent is a contact coming online or going offline
+type PresenceEvent struct {
+	Session   string    `json:"session"`
+	From      string    `json:"from"`
+	Available bool      `json:"available"`
+	LastSeen  time.Time `json:"last_seen,omitzero"`
+}
+
+// LoggedOutEvent is a session unlinked from the phone. It pairs again before
+// it can send.
+type LoggedOutEvent struct {
+	Session   string `json:"session"`
+	Reason    string `json:"reason,omitempty"`
+	OnConnect bool   `json:"on_connect"`
+}
+
+// ConvertEvent converts a whatsmeow event of a session, reporting false for
+// events without an Event type
+func ConvertEvent(session string, evt any) (Event, bool) {
+	switch v := evt.(type) {
+	case *events.Message:
+		kind, text := messageContent(v.Message)
+		return Event{Type: EventMessage, Data: MessageEvent{
+			Session:   session,
+			ID:        v.Info.ID,
+			Chat:      v.Info.Chat.String(),
+			Sender:    v.Info.Sender.ToNonAD().String(),
+			PushName:  v.Info.PushName,
+			FromMe:    v.Info.IsFromMe,
+			Group:     v.Info.IsGroup,
+			Type:      kind,
+			Text:      text,
+			Timestamp: v.Info.Timestamp.UTC(),
+		}}, true
+
+	case *events.Receipt:
+		receiptType := string(v.Type)
+		if v.Type == types.ReceiptTypeDelivered {
+			receiptType = "delivered"
+		}
+		return Event{Type: EventReceipt, Data: ReceiptEvent{
+			Session:    session,
+			Type:       receiptType,
+			MessageIDs: v.MessageIDs,
+			Chat:       v.Chat.String(),
+			Sender:     v.Sender.ToNonAD().String(),
+			Timestamp:  v.Timestamp.UTC(),
+		}}, true
+
+	case *events.Presence:
+		data := PresenceEvent{
+			Session:   session,
+			From:      v.From.ToNonAD().String(),
+			Available: !v.Unavailable,
+		}
+		if !v.LastSeen.IsZero() {
+			data.LastSeen = v.LastSeen.UTC()
+		}
+		return Event{Type: EventPresence, Data: data}, true
+
+	case *events.LoggedOut:
+		data := LoggedOutEvent{Session: session, OnConnect: v.OnConnect}
+		if v.OnConnect {
+			data.Reason = v.Reason.String()
+		}
+		return Event{Type: EventLoggedOut, Data: data}, true
+	}
+	return Event{}, false
+}
+
+// messageContent returns the type of a message, e.g. text, image or
+// document, and its text or caption
+func messageContent(msg *waE2E.Message) (kind, text string) {
+	switch {
+	case msg == nil:
+		return "unknown", ""
+	case msg.Conversation != nil:
+		return "text", msg.GetConversation()
+	case msg.ExtendedTextMessage != nil:
+		return "text", msg.GetExtendedTextMessage().GetText()
+	case msg.ImageMessage != nil:
+		return "image", msg.GetImageMessage().GetCaption()
+	case msg.VideoMessage != nil:
+		return "video", msg.GetVideoMessage().GetCaption()
+	case msg.AudioMessage != nil:
+		return "audio", ""
+	case msg.DocumentMessage != nil:
+		return "document", msg.GetDocumentMessage().GetCaption()
+	case msg.StickerMessage != nil:
+		return "sticker", ""
+	case msg.LocationMessage != nil:
+		return "location", msg.GetLocationMessage().GetName()
+	case msg.ContactMessage != nil:
+		return "contact", msg.GetContactMessage().GetDisplayName()
+	case msg.ReactionMessage != nil:
+		return "reaction", msg.GetReactionMessage().GetText()
+	}
+	return "unknown", ""
+}
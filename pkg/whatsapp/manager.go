@@ -0,0 +1,464 @@
+package whatsapp
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExists   = errors.New("session already exists")
+	ErrNoSession       = errors.New("no whatsapp session")
+
+	ErrInvalidSessionID  = errors.New("session ID must be 1 to 64 letters, digits, dashes or underscores")
+	ErrReservedSessionID = errors.New("session IDs chats, send and sessions are reserved")
+)
+
+// sessionIDPattern matches session IDs, which are used in URLs
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// reservedSessionIDs are the session IDs that collide with the routes under
+// /api/v1/whatsapp, e.g. /whatsapp/chats with /whatsapp/{session}/chats
+var reservedSessionIDs = map[string]bool{"chats": true, "send": true, "sessions": true}
+
+// Manager runs one client per WhatsApp account. Every device in the
+// sqlstore container is a session, addressed by an ID: the name it was added
+// with, or the phone number for devices paired before sessions had names.
+type Manager struct {
+	db        *sql.DB
+	container *sqlstore.Container
+
+	mu        sync.RWMutex
+	sessions  map[string]*Session
+	defaultID string
+
+	// printQR prints pairing QR codes to the terminal
+	printQR atomic.Bool
+
+	handlersMu sync.RWMutex
+	handlers   []EventHandler
+}
+
+// Session is one WhatsApp account
+type Session struct {
+	ID        string
+	Client    *whatsmeow.Client
+	CreatedAt time.Time
+
+	manager *Manager
+	pairing pairing
+
+	// jid is the device of the session, empty until it is paired. whatsmeow
+	// sets Client.Store.ID from its own goroutine while pairing, so it is
+	// read from here instead, as recorded by handleEvent.
+	jidMu sync.Mutex
+	jid   types.JID
+}
+
+// SessionInfo describes a session
+type SessionInfo struct {
+	ID        string       `json:"id"`
+	JID       string       `json:"jid,omitempty"`
+	PushName  string       `json:"push_name,omitempty"`
+	Paired    bool         `json:"paired"`
+	Connected bool         `json:"connected"`
+	LoggedIn  bool         `json:"logged_in"`
+	Pairing   PairingState `json:"pairing"`
+	Default   bool         `json:"default"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+const sessionSchema = `
+CREATE TABLE IF NOT EXISTS whatsapp_sessions (
+	id         TEXT    PRIMARY KEY,
+	jid        TEXT    NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);`
+
+// Open opens or creates the session database at path, loads every session
+// and connects the paired ones. Sessions that fail to connect are kept and
+// can be retried with Login.
+func Open(ctx context.Context, path string) (*Manager, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)", path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open whatsapp database: %w", err)
+	}
+
+	container := sqlstore.NewWithDB(db, "sqlite", waLog.Stdout("Database", "INFO", true))
+	if err := container.Upgrade(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade whatsapp database: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, sessionSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create sessions table: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, messageSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create messages table: %w", err)
+	}
+
+	m := &Manager{db: db, container: container, sessions: map[string]*Session{}}
+	if err := m.load(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, session := range m.List() {
+		if session.Client.Store.ID == nil {
+			continue
+		}
+		if err := session.Client.Connect(); err != nil {
+			slog.Error("Failed to connect WhatsApp session", "session", session.ID, "error", err)
+			continue
+		}
+		slog.Info("WhatsApp session connected", "session", session.ID, "phone", session.Client.Store.ID.User)
+	}
+	return m, nil
+}
+
+// load creates a session for every named session and every device
+func (m *Manager) load(ctx context.Context) error {
+	devices, err := m.container.GetAllDevices(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load devices: %w", err)
+	}
+	byJID := map[string]*store.Device{}
+	for _, device := range devices {
+		byJID[device.ID.String()] = device
+	}
+
+	rows, err := m.db.QueryContext(ctx, `SELECT id, jid, created_at FROM whatsapp_sessions`)
+	if err != nil {
+		return fmt.Errorf("failed to load sessions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, jid string
+		var createdAt int64
+		if err := rows.Scan(&id, &jid, &createdAt); err != nil {
+			return fmt.Errorf("failed to load sessions: %w", err)
+		}
+		// A session whose device is gone, e.g. after a logout, pairs again
+		// with a new device
+		device, ok := byJID[jid]
+		if ok {
+			delete(byJID, jid)
+		} else {
+			device = m.container.NewDevice()
+		}
+		m.sessions[id] = m.newSession(id, device, time.UnixMilli(createdAt))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load sessions: %w", err)
+	}
+
+	// Devices paired before sessions had names are named after their number
+	for jid, device := range byJID {
+		id := device.ID.User
+		if _, exists := m.sessions[id]; exists {
+			id = device.ID.User + "-" + fmt.Sprint(device.ID.Device)
+		}
+		now := time.Now()
+		if _, err := m.db.ExecContext(ctx,
+			`INSERT INTO whatsapp_sessions (id, jid, created_at) VALUES (?, ?, ?)`, id, jid, now.UnixMilli(),
+		); err != nil {
+			return fmt.Errorf("failed to store session %s: %w", id, err)
+		}
+		m.sessions[id] = m.newSession(id, device, now)
+	}
+	return nil
+}
+
+// newSession creates the client of a session
+func (m *Manager) newSession(id string, device *store.Device, createdAt time.Time) *Session {
+	session := &Session{
+		ID:        id,
+		Client:    whatsmeow.NewClient(device, waLog.Stdout("Client/"+id, "INFO", true)),
+		CreatedAt: createdAt,
+		manager:   m,
+	}
+	if device.ID != nil {
+		session.jid = *device.ID
+	}
+	// Registered before any pairing, so the JID is recorded before the
+	// pairing reports its success
+	session.Client.AddEventHandler(func(evt any) {
+		m.handleEvent(session, evt)
+	})
+	return session
+}
+
+// handleEvent keeps the session and message tables up to date and passes the
+// event on
+func (m *Manager) handleEvent(session *Session, evt any) {
+	var jid *string
+	switch v := evt.(type) {
+	case *events.PairSuccess:
+		session.setJID(v.ID)
+		paired := v.ID.String()
+		jid = &paired
+	case *events.LoggedOut:
+		// whatsmeow deleted the device, the session pairs again on next start
+		session.setJID(types.EmptyJID)
+		unpaired := ""
+		jid = &unpaired
+	case *events.Message:
+		session.storeReceived(context.Background(), v)
+	}
+	if jid != nil {
+		if _, err := m.db.Exec(`UPDATE whatsapp_sessions SET jid = ? WHERE id = ?`, *jid, session.ID); err != nil {
+			slog.Error("Failed to record pairing of WhatsApp session", "session", session.ID, "error", err)
+		}
+	}
+	eventHandler(session.ID, evt)
+
+	m.handlersMu.RLock()
+	handlers := m.handlers
+	m.handlersMu.RUnlock()
+	if len(handlers) == 0 {
+		return
+	}
+	if event, ok := ConvertEvent(session.ID, evt); ok {
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+// AddEventHandler adds a handler for the messages, receipts, presence
+// updates and logouts of every session, present and future. Handlers run on
+// the event loop of the session and should return quickly.
+func (m *Manager) AddEventHandler(handler EventHandler) {
+	m.handlersMu.Lock()
+	defer m.handlersMu.Unlock()
+	m.handlers = append(m.handlers, handler)
+}
+
+// Add creates an unpaired session. Pair it with Login.
+func (m *Manager) Add(ctx context.Context, id string) (*Session, error) {
+	if !sessionIDPattern.MatchString(id) {
+		return nil, ErrInvalidSessionID
+	}
+	if reservedSessionIDs[strings.ToLower(id)] {
+		return nil, ErrReservedSessionID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.sessions[id]; exists {
+		return nil, ErrSessionExists
+	}
+	now := time.Now()
+	if _, err := m.db.ExecContext(ctx,
+		`INSERT INTO whatsapp_sessions (id, created_at) VALUES (?, ?)`, id, now.UnixMilli(),
+	); err != nil {
+		return nil, fmt.Errorf("failed to store session %s: %w", id, err)
+	}
+
+	session := m.newSession(id, m.container.NewDevice(), now)
+	m.sessions[id] = session
+	return session, nil
+}
+
+// Remove logs a session out, deletes its device and messages and forgets it.
+// When it was the default session the oldest remaining one becomes the
+// default.
+func (m *Manager) Remove(ctx context.Context, id string) error {
+	m.mu.Lock()
+	session, ok := m.sessions[id]
+	if ok {
+		delete(m.sessions, id)
+		// The oldest session left takes over
+		if m.defaultID == id {
+			m.defaultID = ""
+		}
+	}
+	m.mu.Unlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	client := session.Client
+	if client.IsLoggedIn() {
+		// Logout unlinks the device on the phone and deletes it from the store
+		if err := client.Logout(ctx); err != nil {
+			slog.Error("Failed to log out WhatsApp session", "session", id, "error", err)
+		}
+	}
+	client.Disconnect()
+	if client.Store.ID != nil {
+		if err := client.Store.Delete(ctx); err != nil {
+			return fmt.Errorf("failed to delete device of session %s: %w", id, err)
+		}
+	}
+
+	if _, err := m.db.ExecContext(ctx, `DELETE FROM whatsapp_sessions WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete session %s: %w", id, err)
+	}
+	if _, err := m.db.ExecContext(ctx, `DELETE FROM whatsapp_messages WHERE session = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete messages of session %s: %w", id, err)
+	}
+	return nil
+}
+
+// Get returns the session with the given ID
+func (m *Manager) Get(id string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// SetDefault sets the session used when none is named. By default it is the
+// oldest session.
+func (m *Manager) SetDefault(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaultID = id
+}
+
+// SetPrintQR prints pairing QR codes to the terminal, for command line
+// tools. They are not printed by default, as they log a phone in to whoever
+// reads the logs of a server.
+func (m *Manager) SetPrintQR(enabled bool) {
+	m.printQR.Store(enabled)
+}
+
+// Default returns the session used when none is named
+func (m *Manager) Default() (*Session, error) {
+	m.mu.RLock()
+	id := m.defaultID
+	m.mu.RUnlock()
+	if id != "" {
+		return m.Get(id)
+	}
+
+	sessions := m.List()
+	if len(sessions) == 0 {
+		return nil, ErrNoSession
+	}
+	return sessions[0], nil
+}
+
+// List returns the sessions, oldest first
+func (m *Manager) List() []*Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return sessions
+}
+
+// Close disconnects every session and closes the database
+func (m *Manager) Close() error {
+	for _, session := range m.List() {
+		session.Client.Disconnect()
+	}
+	return m.db.Close()
+}
+
+// Info describes the session
+func (s *Session) Info() SessionInfo {
+	jid, paired := s.deviceJID()
+	info := SessionInfo{
+		ID:        s.ID,
+		Paired:    paired,
+		Connected: s.Client.IsConnected(),
+		LoggedIn:  s.Client.IsLoggedIn(),
+		Pairing:   s.PairingStatus().State,
+		CreatedAt: s.CreatedAt,
+	}
+	if paired {
+		info.JID = jid.ToNonAD().String()
+		info.PushName = s.Client.Store.PushName
+	}
+	if def, err := s.manager.Default(); err == nil && def == s {
+		info.Default = true
+	}
+	return info
+}
+
+// deviceJID returns the device of the session and whether it is paired
+func (s *Session) deviceJID() (types.JID, bool) {
+	s.jidMu.Lock()
+	defer s.jidMu.Unlock()
+	return s.jid, !s.jid.IsEmpty()
+}
+
+func (s *Session) setJID(jid types.JID) {
+	s.jidMu.Lock()
+	defer s.jidMu.Unlock()
+	s.jid = jid
+}
+
+// IsConnected checks if the session is connected
+func (s *Session) IsConnected() bool {
+	return s.Client.IsConnected()
+}
+
+// Login connects the session, pairing it first when it has no device, and
+// waits until the pairing succeeds or fails. The QR codes to scan are printed
+// to the terminal after SetPrintQR(true).
+func (s *Session) Login(ctx context.Context) error {
+	client := s.Client
+	if _, paired := s.deviceJID(); paired {
+		if client.IsConnected() {
+			return nil
+		}
+		return client.Connect()
+	}
+
+	events, stop := s.SubscribePairing()
+	defer stop()
+	if err := s.StartPairing(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case evt := <-events:
+			switch evt.Event {
+			case PairingEventCode:
+				continue
+			case PairingEventSuccess:
+				return nil
+			case PairingEventTimeout:
+				return fmt.Errorf("pairing timed out")
+			default:
+				return fmt.Errorf("pairing failed: %s", evt.Error)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package whatsapp
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// testManager opens a manager on a new database. Its sessions are not
+// paired, so nothing connects to WhatsApp.
+func testManager(t *testing.T) *Manager {
+	t.Helper()
+	m, err := Open(context.Background(), filepath.Join(t.TempDir(), "whatsapp.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestManagerSessions(t *testing.T) {
+	ctx := context.Background()
+	m := testManager(t)
+
+	if _, err := m.Default(); !errors.Is(err, ErrNoSession) {
+		t.Fatalf("Default without sessions = %v, want ErrNoSession", err)
+	}
+	if _, err := m.Add(ctx, "sales team"); !errors.Is(err, ErrInvalidSessionID) {
+		t.Errorf("Add with a space = %v, want ErrInvalidSessionID", err)
+	}
+	for _, id := range []string{"chats", "send", "Sessions"} {
+		if _, err := m.Add(ctx, id); !errors.Is(err, ErrReservedSessionID) {
+			t.Errorf("Add(%q) = %v, want ErrReservedSessionID", id, err)
+		}
+	}
+	sales, err := m.Add(ctx, "sales")
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := m.Add(ctx, "support"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := m.Add(ctx, "sales"); !errors.Is(err, ErrSessionExists) {
+		t.Errorf("Add of an existing session = %v, want ErrSessionExists", err)
+	}
+
+	// The oldest session is the default
+	if def, err := m.Default(); err != nil || def != sales {
+		t.Errorf("Default = %v, %v, want sales", def, err)
+	}
+	if info := sales.Info(); !info.Default || info.Paired {
+		t.Errorf("Info = %+v", info)
+	}
+}
+
+func TestManagerRemoveDefault(t *testing.T) {
+	ctx := context.Background()
+	m := testManager(t)
+	// Sessions added within the same millisecond are ordered by ID
+	for _, id := range []string{"first", "second", "third"} {
+		if _, err := m.Add(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.SetDefault("second")
+	if def, err := m.Default(); err != nil || def.ID != "second" {
+		t.Fatalf("Default = %v, %v, want second", def, err)
+	}
+
+	if err := m.Remove(ctx, "second"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := m.Remove(ctx, "second"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Remove again = %v, want ErrSessionNotFound", err)
+	}
+	// The oldest remaining session takes over from the removed default
+	if def, err := m.Default(); err != nil || def.ID != "first" {
+		t.Errorf("Default after removing it = %v, %v, want first", def, err)
+	}
+
+	// Removing another session keeps the configured default
+	m.SetDefault("third")
+	if err := m.Remove(ctx, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if def, err := m.Default(); err != nil || def.ID != "third" {
+		t.Errorf("Default = %v, %v, want third", def, err)
+	}
+}
+
+func TestSessionPairedByEvent(t *testing.T) {
+	ctx := context.Background()
+	m := testManager(t)
+	s, err := m.Add(ctx, "support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := s.PairingStatus(); status.State != PairingIdle {
+		t.Fatalf("PairingStatus = %+v, want idle", status)
+	}
+
+	// Polled while whatsmeow reports the pairing from its own goroutine
+	jid := types.JID{User: "254712345678", Device: 12, Server: types.DefaultUserServer}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.handleEvent(s, &events.PairSuccess{ID: jid})
+	}()
+	for range 100 {
+		s.PairingStatus()
+		s.Info()
+	}
+	<-done
+
+	if status := s.PairingStatus(); status.State != PairingPaired || status.JID != "254712345678@s.whatsapp.net" {
+		t.Errorf("PairingStatus = %+v, want paired", status)
+	}
+	if info := s.Info(); !info.Paired || info.JID != "254712345678@s.whatsapp.net" {
+		t.Errorf("Info = %+v, want paired", info)
+	}
+	if err := s.StartPairing(); !errors.Is(err, ErrAlreadyPaired) {
+		t.Errorf("StartPairing = %v, want ErrAlreadyPaired", err)
+	}
+
+	m.handleEvent(s, &events.LoggedOut{})
+	if info := s.Info(); info.Paired || info.JID != "" {
+		t.Errorf("Info after logging out = %+v", info)
+	}
+}
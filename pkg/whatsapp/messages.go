@@ -0,0 +1,349 @@
+package whatsapp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// ErrInvalidCursor means a page cursor was not returned by Chats or Messages
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// Message is a message sent or received by a session. Timestamp is when it
+// was sent, StoredAt when it was recorded.
+type Message struct {
+	Session   string    `json:"session"`
+	ID        string    `json:"id"`
+	Chat      string    `json:"chat"`
+	Sender    string    `json:"sender"`
+	PushName  string    `json:"push_name,omitempty"`
+	FromMe    bool      `json:"from_me"`
+	Type      string    `json:"type"`
+	Text      string    `json:"text,omitempty"`
+	Media     *Media    `json:"media,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	StoredAt  time.Time `json:"stored_at"`
+}
+
+// Media refers to the attachment of a message on the WhatsApp servers. The
+// file itself is not stored.
+type Media struct {
+	DirectPath string `json:"direct_path"`
+	Mimetype   string `json:"mimetype,omitempty"`
+	FileName   string `json:"file_name,omitempty"`
+	Size       uint64 `json:"size,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+}
+
+// Chat is a conversation of a session with its latest message
+type Chat struct {
+	JID           string    `json:"jid"`
+	Messages      int       `json:"messages"`
+	LastMessageAt time.Time `json:"last_message_at"`
+	LastMessage   Message   `json:"last_message"`
+}
+
+const messageSchema = `
+CREATE TABLE IF NOT EXISTS whatsapp_messages (
+	session         TEXT    NOT NULL,
+	id              TEXT    NOT NULL,
+	chat            TEXT    NOT NULL,
+	sender          TEXT    NOT NULL,
+	push_name       TEXT    NOT NULL DEFAULT '',
+	from_me         INTEGER NOT NULL,
+	type            TEXT    NOT NULL,
+	text            TEXT    NOT NULL DEFAULT '',
+	media_path      TEXT    NOT NULL DEFAULT '',
+	media_mimetype  TEXT    NOT NULL DEFAULT '',
+	media_file_name TEXT    NOT NULL DEFAULT '',
+	media_size      INTEGER NOT NULL DEFAULT 0,
+	media_sha256    TEXT    NOT NULL DEFAULT '',
+	timestamp       INTEGER NOT NULL,
+	stored_at       INTEGER NOT NULL,
+	PRIMARY KEY (session, chat, id)
+);
+CREATE INDEX IF NOT EXISTS whatsapp_messages_chat_time ON whatsapp_messages (session, chat, timestamp);`
+
+const messageColumns = `session, id, chat, sender, push_name, from_me, type, text,
+	media_path, media_mimetype, media_file_name, media_size, media_sha256, timestamp, stored_at`
+
+// newMessage records the content of a WhatsApp message
+func newMessage(session, id string, chat, sender types.JID, fromMe bool, timestamp time.Time, msg *waE2E.Message) Message {
+	kind, text := messageContent(msg)
+	return Message{
+		Session:   session,
+		ID:        id,
+		Chat:      chat.ToNonAD().String(),
+		Sender:    sender.ToNonAD().String(),
+		FromMe:    fromMe,
+		Type:      kind,
+		Text:      text,
+		Media:     messageMedia(msg),
+		Timestamp: timestamp.UTC(),
+	}
+}
+
+// messageMedia returns the attachment of a message, nil when it has none
+func messageMedia(msg *waE2E.Message) *Media {
+	var file whatsmeow.DownloadableMessage
+	var mimetype, fileName string
+	var size uint64
+	switch {
+	case msg == nil:
+		return nil
+	case msg.ImageMessage != nil:
+		m := msg.GetImageMessage()
+		file, mimetype, size = m, m.GetMimetype(), m.GetFileLength()
+	case msg.VideoMessage != nil:
+		m := msg.GetVideoMessage()
+		file, mimetype, size = m, m.GetMimetype(), m.GetFileLength()
+	case msg.AudioMessage != nil:
+		m := msg.GetAudioMessage()
+		file, mimetype, size = m, m.GetMimetype(), m.GetFileLength()
+	case msg.DocumentMessage != nil:
+		m := msg.GetDocumentMessage()
+		file, mimetype, size, fileName = m, m.GetMimetype(), m.GetFileLength(), m.GetFileName()
+	case msg.StickerMessage != nil:
+		m := msg.GetStickerMessage()
+		file, mimetype, size = m, m.GetMimetype(), m.GetFileLength()
+	default:
+		return nil
+	}
+	return &Media{
+		DirectPath: file.GetDirectPath(),
+		Mimetype:   mimetype,
+		FileName:   fileName,
+		Size:       size,
+		SHA256:     hex.EncodeToString(file.GetFileSHA256()),
+	}
+}
+
+// storeMessage records a message. A message stored again, e.g. when it is
+// redelivered, keeps its first record.
+func (m *Manager) storeMessage(ctx context.Context, msg Message) {
+	media := msg.Media
+	if media == nil {
+		media = &Media{}
+	}
+	if _, err := m.db.ExecContext(ctx,
+		`INSERT OR IGNORE INTO whatsapp_messages (`+messageColumns+`)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.Session, msg.ID, msg.Chat, msg.Sender, msg.PushName, msg.FromMe, msg.Type, msg.Text,
+		media.DirectPath, media.Mimetype, media.FileName, media.Size, media.SHA256,
+		msg.Timestamp.UnixMilli(), time.Now().UnixMilli(),
+	); err != nil {
+		slog.Error("Failed to store WhatsApp message", "session", msg.Session, "id", msg.ID, "error", err)
+	}
+}
+
+// storeSent records a message the session sent to chat
+func (s *Session) storeSent(ctx context.Context, chat types.JID, msg *waE2E.Message, resp whatsmeow.SendResponse) {
+	sender, _ := s.deviceJID()
+	// The message is out even if the request that sent it is canceled now
+	ctx = context.WithoutCancel(ctx)
+	s.manager.storeMessage(ctx, newMessage(s.ID, resp.ID, s.phoneJID(ctx, chat), sender, true, resp.Timestamp, msg))
+}
+
+// storeReceived records a message the session received, or sent from
+// another device. An edit replaces the text of the message it edits, while
+// reactions and other protocol messages are not recorded.
+func (s *Session) storeReceived(ctx context.Context, evt *events.Message) {
+	info := evt.Info
+	chat := s.phoneJID(ctx, info.Chat)
+	if protocol := evt.Message.GetProtocolMessage(); protocol != nil {
+		if protocol.GetType() == waE2E.ProtocolMessage_MESSAGE_EDIT {
+			_, text := messageContent(protocol.GetEditedMessage())
+			s.manager.editMessage(ctx, s.ID, chat, protocol.GetKey().GetID(), text)
+		}
+		return
+	}
+	if evt.Message.GetReactionMessage() != nil {
+		return
+	}
+
+	msg := newMessage(s.ID, info.ID, chat, s.phoneJID(ctx, info.Sender), info.IsFromMe, info.Timestamp, evt.Message)
+	msg.PushName = info.PushName
+	s.manager.storeMessage(ctx, msg)
+}
+
+// editMessage replaces the text or caption of a stored message
+func (m *Manager) editMessage(ctx context.Context, session string, chat types.JID, id, text string) {
+	if _, err := m.db.ExecContext(ctx,
+		`UPDATE whatsapp_messages SET text = ? WHERE session = ? AND chat = ? AND id = ?`,
+		text, session, chat.ToNonAD().String(), id,
+	); err != nil {
+		slog.Error("Failed to edit WhatsApp message", "session", session, "id", id, "error", err)
+	}
+}
+
+// phoneJID returns the phone number JID of a LID, the hidden user ID
+// WhatsApp may address a contact with instead of its number, so that a
+// contact has a single chat whichever way its messages come. Other JIDs, and
+// LIDs whose number is not known yet, are returned as is, as are all JIDs
+// before the session is paired.
+func (s *Session) phoneJID(ctx context.Context, jid types.JID) types.JID {
+	if jid.Server != types.HiddenUserServer || s.Client.Store.LIDs == nil {
+		return jid
+	}
+	pn, err := s.Client.Store.LIDs.GetPNForLID(ctx, jid)
+	if err != nil {
+		slog.Warn("Failed to look up the phone number of a WhatsApp LID", "session", s.ID, "lid", jid, "error", err)
+		return jid
+	}
+	if pn.IsEmpty() {
+		return jid
+	}
+	return pn
+}
+
+// Chats returns the chats of the session, the latest active first. limit
+// caps them, and cursor continues from the page it was returned with. The
+// returned cursor is empty on the last page.
+func (s *Session) Chats(ctx context.Context, limit int, cursor string) ([]Chat, string, error) {
+	// SQLite fills the bare columns of a MAX() aggregate from the row holding
+	// the maximum, here the latest message of each chat
+	query := `SELECT COUNT(*), MAX(timestamp) AS last, ` + messageColumns + `
+		FROM whatsapp_messages WHERE session = ? GROUP BY chat`
+	args := []any{s.ID}
+	if cursor != "" {
+		before, key, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query += ` HAVING last < ? OR (last = ? AND chat < ?)`
+		args = append(args, before, before, key)
+	}
+	query += ` ORDER BY last DESC, chat DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := s.manager.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load chats: %w", err)
+	}
+	defer rows.Close()
+
+	chats := []Chat{}
+	for rows.Next() {
+		var chat Chat
+		var last int64
+		msg, err := scanMessage(rows, &chat.Messages, &last)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load chats: %w", err)
+		}
+		chat.JID = msg.Chat
+		chat.LastMessageAt = msg.Timestamp
+		chat.LastMessage = msg
+		chats = append(chats, chat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to load chats: %w", err)
+	}
+
+	next := ""
+	if len(chats) > limit {
+		chats = chats[:limit]
+		last := chats[limit-1]
+		next = encodeCursor(last.LastMessageAt.UnixMilli(), last.JID)
+	}
+	return chats, next, nil
+}
+
+// Messages returns the messages of a chat of the session, newest first. A
+// chat with a LID is the chat with its phone number when it is known. limit
+// caps them, and cursor continues from the page it was returned with. The
+// returned cursor is empty on the last page.
+func (s *Session) Messages(ctx context.Context, chat types.JID, limit int, cursor string) ([]Message, string, error) {
+	query := `SELECT ` + messageColumns + ` FROM whatsapp_messages WHERE session = ? AND chat = ?`
+	args := []any{s.ID, s.phoneJID(ctx, chat).ToNonAD().String()}
+	if cursor != "" {
+		before, key, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query += ` AND (timestamp < ? OR (timestamp = ? AND id < ?))`
+		args = append(args, before, before, key)
+	}
+	query += ` ORDER BY timestamp DESC, id DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := s.manager.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load messages: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to load messages: %w", err)
+	}
+
+	next := ""
+	if len(messages) > limit {
+		messages = messages[:limit]
+		last := messages[limit-1]
+		next = encodeCursor(last.Timestamp.UnixMilli(), last.ID)
+	}
+	return messages, next, nil
+}
+
+// scanMessage scans the message columns of a row, after the given leading
+// columns
+func scanMessage(rows *sql.Rows, leading ...any) (Message, error) {
+	var msg Message
+	var media Media
+	var timestamp, storedAt int64
+	dest := append(leading,
+		&msg.Session, &msg.ID, &msg.Chat, &msg.Sender, &msg.PushName, &msg.FromMe, &msg.Type, &msg.Text,
+		&media.DirectPath, &media.Mimetype, &media.FileName, &media.Size, &media.SHA256, &timestamp, &storedAt,
+	)
+	if err := rows.Scan(dest...); err != nil {
+		return Message{}, err
+	}
+	if media.DirectPath != "" {
+		msg.Media = &media
+	}
+	msg.Timestamp = time.UnixMilli(timestamp).UTC()
+	msg.StoredAt = time.UnixMilli(storedAt).UTC()
+	return msg, nil
+}
+
+// encodeCursor returns an opaque cursor for the rows after a timestamp and
+// key in descending order
+func encodeCursor(timestamp int64, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(timestamp, 10) + ":" + key))
+}
+
+func decodeCursor(cursor string) (int64, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	timestamp, key, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return 0, "", ErrInvalidCursor
+	}
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return ms, key, nil
+}
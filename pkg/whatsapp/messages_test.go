@@ -0,0 +1,240 @@
+package whatsapp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// receive passes a message to the session as if WhatsApp delivered it
+func receive(m *Manager, s *Session, id string, chat, sender types.JID, timestamp time.Time, msg *waE2E.Message) {
+	m.handleEvent(s, &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsGroup: chat.Server == types.GroupServer},
+			ID:            id,
+			Timestamp:     timestamp,
+		},
+		Message: msg,
+	})
+}
+
+func text(s string) *waE2E.Message {
+	return &waE2E.Message{Conversation: proto.String(s)}
+}
+
+func TestCursor(t *testing.T) {
+	for _, key := range []string{"254712345678@s.whatsapp.net", "3EB0C767D71A5B1A0F2C", "", "a:b"} {
+		ms, got, err := decodeCursor(encodeCursor(1760630300000, key))
+		if err != nil || ms != 1760630300000 || got != key {
+			t.Errorf("decodeCursor(encodeCursor(%q)) = %d, %q, %v", key, ms, got, err)
+		}
+	}
+
+	for _, cursor := range []string{"!!", "MTc2MDYzMDMwMDAwMA", "YWJjOmtleQ"} {
+		if _, _, err := decodeCursor(cursor); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("decodeCursor(%q) = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
+
+func TestMessagesPagination(t *testing.T) {
+	ctx := context.Background()
+	m := testManager(t)
+	s, err := m.Add(ctx, "support")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Five messages sent within the same second, ordered by ID on equal
+	// timestamps
+	chat := types.NewJID("254712345678", types.DefaultUserServer)
+	at := time.Date(2026, 10, 16, 15, 58, 20, 0, time.UTC)
+	for _, id := range []string{"A", "B", "C", "D", "E"} {
+		receive(m, s, id, chat, chat, at, text("Hello "+id))
+	}
+	receive(m, s, "LATER", chat, chat, at.Add(time.Second), text("Bye"))
+
+	var ids []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		messages, next, err := s.Messages(ctx, chat, 2, cursor)
+		if err != nil {
+			t.Fatalf("Messages: %v", err)
+		}
+		if pages > 3 || len(messages) > 2 {
+			t.Fatalf("got %d messages on page %d", len(messages), pages+1)
+		}
+		for _, msg := range messages {
+			ids = append(ids, msg.ID)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if got := fmt.Sprint(ids); got != "[LATER E D C B A]" {
+		t.Errorf("messages = %s, want [LATER E D C B A]", got)
+	}
+
+	if _, _, err := s.Messages(ctx, chat, 2, "!!"); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Messages with a bad cursor = %v, want ErrInvalidCursor", err)
+	}
+}
+
+func TestChatsPagination(t *testing.T) {
+	ctx := context.Background()
+	m := testManager(t)
+	s, err := m.Add(ctx, "support")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Three chats last active at the same time, ordered by JID, and a
+	// group with an image
+	at := time.Date(2026, 10, 16, 15, 58, 20, 0, time.UTC)
+	for _, phone := range []string{"254700000001", "254700000002", "254700000003"} {
+		chat := types.NewJID(phone, types.DefaultUserServer)
+		receive(m, s, "OLD"+phone, chat, chat, at.Add(-time.Hour), text("Hi"))
+		receive(m, s, "NEW"+phone, chat, chat, at, text("Hello"))
+	}
+	group := types.NewJID("120363025246125486", types.GroupServer)
+	receive(m, s, "IMG", group, types.NewJID("254700000001", types.DefaultUserServer), at.Add(-time.Minute), &waE2E.Message{
+		ImageMessage: &waE2E.ImageMessage{
+			DirectPath: proto.String("/v/t62.7118-24/image"),
+			Mimetype:   proto.String("image/jpeg"),
+			FileLength: proto.Uint64(2048),
+			Caption:    proto.String("Photo"),
+		},
+	})
+
+	var chats []Chat
+	cursor := ""
+	for pages := 0; ; pages++ {
+		page, next, err := s.Chats(ctx, 2, cursor)
+		if err != nil {
+			t.Fatalf("Chats: %v", err)
+		}
+		if pages > 2 {
+			t.Fatal("too many pages")
+		}
+		chats = append(chats, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	want := []string{
+		"254700000003@s.whatsapp.net",
+		"254700000002@s.whatsapp.net",
+		"254700000001@s.whatsapp.net",
+		"120363025246125486@g.us",
+	}
+	if len(chats) != len(want) {
+		t.Fatalf("got %d chats, want %d", len(chats), len(want))
+	}
+	for i, chat := range chats {
+		if chat.JID != want[i] {
+			t.Errorf("chat %d = %s, want %s", i, chat.JID, want[i])
+		}
+	}
+	if last := chats[0]; last.Messages != 2 || last.LastMessage.ID != "NEW254700000003" || !last.LastMessageAt.Equal(at) {
+		t.Errorf("chat = %+v", last)
+	}
+	if media := chats[3].LastMessage.Media; media == nil || media.Mimetype != "image/jpeg" || chats[3].LastMessage.Text != "Photo" {
+		t.Errorf("image message = %+v", chats[3].LastMessage)
+	}
+}
+
+func TestLIDChat(t *testing.T) {
+	ctx := context.Background()
+	m := testManager(t)
+	s, err := m.Add(ctx, "support")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Paired devices share the LID map of the container
+	s.Client.Store.LIDs = m.container.LIDMap
+	pn := types.NewJID("254712345678", types.DefaultUserServer)
+	lid := types.NewJID("123456789012345", types.HiddenUserServer)
+	if err := s.Client.Store.LIDs.PutLIDMapping(ctx, lid, pn); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 10, 16, 15, 58, 20, 0, time.UTC)
+
+	// The reply comes from the LID of the contact messaged by number
+	s.storeSent(ctx, pn, text("Hello"), whatsmeow.SendResponse{ID: "SENT", Timestamp: at})
+	receive(m, s, "REPLY", lid, types.JID{User: lid.User, Device: 3, Server: types.HiddenUserServer}, at.Add(time.Second), text("Hi"))
+	// A LID without a known number keeps its own chat
+	unknown := types.NewJID("999999999999999", types.HiddenUserServer)
+	receive(m, s, "OTHER", unknown, unknown, at, text("Hey"))
+
+	chats, _, err := s.Chats(ctx, 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 2 || chats[0].JID != pn.String() || chats[0].Messages != 2 || chats[1].JID != unknown.String() {
+		t.Fatalf("chats = %+v", chats)
+	}
+	if sender := chats[0].LastMessage.Sender; sender != pn.String() {
+		t.Errorf("sender = %s, want %s", sender, pn)
+	}
+
+	for _, chat := range []types.JID{pn, lid} {
+		messages, _, err := s.Messages(ctx, chat, 10, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 2 || messages[0].ID != "REPLY" || messages[1].ID != "SENT" {
+			t.Errorf("Messages(%s) = %+v", chat, messages)
+		}
+	}
+}
+
+func TestEditsAndReactions(t *testing.T) {
+	ctx := context.Background()
+	m := testManager(t)
+	s, err := m.Add(ctx, "support")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chat := types.NewJID("254712345678", types.DefaultUserServer)
+	at := time.Date(2026, 10, 16, 15, 58, 20, 0, time.UTC)
+	key := &waCommon.MessageKey{RemoteJID: proto.String(chat.String()), ID: proto.String("ORIGINAL")}
+	receive(m, s, "ORIGINAL", chat, chat, at, text("Helo"))
+	receive(m, s, "EDIT", chat, chat, at.Add(time.Second), &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+		Type:          waE2E.ProtocolMessage_MESSAGE_EDIT.Enum(),
+		Key:           key,
+		EditedMessage: text("Hello"),
+	}})
+	receive(m, s, "REACTION", chat, chat, at.Add(2*time.Second), &waE2E.Message{ReactionMessage: &waE2E.ReactionMessage{
+		Key:  key,
+		Text: proto.String("👍"),
+	}})
+	receive(m, s, "REVOKE", chat, chat, at.Add(3*time.Second), &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+		Type: waE2E.ProtocolMessage_REVOKE.Enum(),
+		Key:  key,
+	}})
+
+	messages, _, err := s.Messages(ctx, chat, 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want only the edited one: %+v", len(messages), messages)
+	}
+	if msg := messages[0]; msg.ID != "ORIGINAL" || msg.Type != "text" || msg.Text != "Hello" || !msg.Timestamp.Equal(at) {
+		t.Errorf("message = %+v, want the original with the edited text", msg)
+	}
+}
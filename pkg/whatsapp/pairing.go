@@ -0,0 +1,308 @@
+package whatsapp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"rsc.io/qr"
+)
+
+// ErrAlreadyPaired means a session is already linked to a phone
+var ErrAlreadyPaired = errors.New("session is already paired")
+
+// PairingState is the progress of linking a session to a phone
+type PairingState string
+
+const (
+	PairingIdle    PairingState = "idle"
+	PairingWaiting PairingState = "waiting" // a QR code is waiting to be scanned
+	PairingPaired  PairingState = "paired"
+	PairingTimeout PairingState = "timeout"
+	PairingFailed  PairingState = "failed"
+)
+
+// Pairing events
+const (
+	PairingEventCode        = "code"
+	PairingEventPairingCode = "pairing_code"
+	PairingEventSuccess     = "success"
+	PairingEventTimeout     = "timeout"
+	PairingEventError       = "error"
+)
+
+// PairingEvent is a step in the pairing of a session: a new QR code, a
+// pairing code for a phone number, or the success, timeout or error that
+// ends it
+type PairingEvent struct {
+	Event       string    `json:"event"`
+	Code        string    `json:"code,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitzero"`
+	PairingCode string    `json:"pairing_code,omitempty"`
+	PhoneNumber string    `json:"phone_number,omitempty"`
+	JID         string    `json:"jid,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Done tells whether the event ends the pairing
+func (e PairingEvent) Done() bool {
+	return e.Event != PairingEventCode && e.Event != PairingEventPairingCode
+}
+
+// PairingStatus is where the pairing of a session stands. Code is the QR
+// code to scan while State is waiting, and PairingCode the code to type into
+// the phone of PhoneNumber once one was requested.
+type PairingStatus struct {
+	State       PairingState `json:"state"`
+	Code        string       `json:"code,omitempty"`
+	ExpiresAt   time.Time    `json:"expires_at,omitzero"`
+	PairingCode string       `json:"pairing_code,omitempty"`
+	PhoneNumber string       `json:"phone_number,omitempty"`
+	JID         string       `json:"jid,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	UpdatedAt   time.Time    `json:"updated_at,omitzero"`
+}
+
+// pairing tracks the pairing of a session and who is watching it
+type pairing struct {
+	mu          sync.Mutex
+	status      PairingStatus
+	subscribers map[chan PairingEvent]struct{}
+}
+
+// pairClientName is the linked device name shown on the phone for pairing
+// codes. WhatsApp only accepts common browsers and systems here.
+const pairClientName = "Chrome (Linux)"
+
+// StartPairing connects an unpaired session and starts emitting QR codes in
+// the background, until one is scanned or they run out. Follow it with
+// PairingStatus or SubscribePairing. Starting a pairing that is already
+// waiting does nothing.
+func (s *Session) StartPairing() error {
+	client := s.Client
+
+	s.pairing.mu.Lock()
+	if _, paired := s.deviceJID(); paired {
+		s.pairing.mu.Unlock()
+		return ErrAlreadyPaired
+	}
+	if s.pairing.status.State == PairingWaiting {
+		s.pairing.mu.Unlock()
+		return nil
+	}
+	// Waiting makes concurrent calls return right away while this one
+	// connects, which is done without holding the lock
+	s.pairing.status = PairingStatus{State: PairingWaiting, UpdatedAt: time.Now()}
+	s.pairing.mu.Unlock()
+
+	// A previous pairing that ran out of codes may have left the socket open
+	if client.IsConnected() {
+		client.Disconnect()
+	}
+
+	// Pairing outlives the request that started it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	qrChan, err := client.GetQRChannel(ctx)
+	if err != nil {
+		cancel()
+		s.publishPairing(PairingEvent{Event: PairingEventError, Error: err.Error()})
+		return fmt.Errorf("failed to start pairing: %w", err)
+	}
+	if err := client.Connect(); err != nil {
+		cancel()
+		s.publishPairing(PairingEvent{Event: PairingEventError, Error: err.Error()})
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+
+	printCodes := s.manager.printQR.Load()
+	if printCodes {
+		fmt.Printf("\n=== WhatsApp QR Code (session %s) ===\n", s.ID)
+		fmt.Println("Please scan this QR code with WhatsApp on your phone:")
+		fmt.Println("Settings → Linked Devices → Link a Device")
+	}
+
+	go func() {
+		defer cancel()
+		for evt := range qrChan {
+			switch evt.Event {
+			case whatsmeow.QRChannelEventCode:
+				if printCodes {
+					fmt.Println("\nWaiting for QR code scan...")
+					printQR(evt.Code)
+				}
+				s.publishPairing(PairingEvent{
+					Event:     PairingEventCode,
+					Code:      evt.Code,
+					ExpiresAt: time.Now().Add(evt.Timeout),
+				})
+			case whatsmeow.QRChannelSuccess.Event:
+				slog.Info("WhatsApp session paired", "session", s.ID)
+				event := PairingEvent{Event: PairingEventSuccess}
+				if jid, paired := s.deviceJID(); paired {
+					event.JID = jid.ToNonAD().String()
+				}
+				s.publishPairing(event)
+			case whatsmeow.QRChannelTimeout.Event:
+				slog.Warn("WhatsApp pairing timed out", "session", s.ID)
+				s.publishPairing(PairingEvent{Event: PairingEventTimeout})
+			default:
+				message := evt.Event
+				if evt.Error != nil {
+					message = evt.Error.Error()
+				}
+				slog.Error("WhatsApp pairing failed", "session", s.ID, "event", evt.Event, "error", message)
+				s.publishPairing(PairingEvent{Event: PairingEventError, Error: message})
+			}
+		}
+	}()
+	return nil
+}
+
+// publishPairing records a pairing event and passes it to the subscribers
+func (s *Session) publishPairing(event PairingEvent) {
+	s.pairing.mu.Lock()
+	defer s.pairing.mu.Unlock()
+
+	status := PairingStatus{UpdatedAt: time.Now()}
+	switch event.Event {
+	case PairingEventCode, PairingEventPairingCode:
+		// QR codes keep coming while a pairing code is waiting to be typed
+		status = s.pairing.status
+		status.State = PairingWaiting
+		status.UpdatedAt = time.Now()
+		if event.Event == PairingEventCode {
+			status.Code = event.Code
+			status.ExpiresAt = event.ExpiresAt
+		} else {
+			status.PairingCode = event.PairingCode
+			status.PhoneNumber = event.PhoneNumber
+		}
+	case PairingEventSuccess:
+		status.State = PairingPaired
+		status.JID = event.JID
+	case PairingEventTimeout:
+		status.State = PairingTimeout
+	default:
+		status.State = PairingFailed
+		status.Error = event.Error
+	}
+	s.pairing.status = status
+
+	for ch := range s.pairing.subscribers {
+		// A subscriber that falls behind misses codes, it can catch up
+		// with PairingStatus
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// PairingStatus returns where the pairing of the session stands. A paired
+// session reports paired, however it was paired.
+func (s *Session) PairingStatus() PairingStatus {
+	s.pairing.mu.Lock()
+	status := s.pairing.status
+	s.pairing.mu.Unlock()
+
+	if status.State == "" {
+		status.State = PairingIdle
+	}
+	if jid, paired := s.deviceJID(); paired && status.State != PairingPaired {
+		status = PairingStatus{State: PairingPaired, JID: jid.ToNonAD().String(), UpdatedAt: status.UpdatedAt}
+	}
+	return status
+}
+
+// SubscribePairing returns a channel of the pairing events of the session
+// and a function that stops them
+func (s *Session) SubscribePairing() (<-chan PairingEvent, func()) {
+	ch := make(chan PairingEvent, 16)
+
+	s.pairing.mu.Lock()
+	if s.pairing.subscribers == nil {
+		s.pairing.subscribers = map[chan PairingEvent]struct{}{}
+	}
+	s.pairing.subscribers[ch] = struct{}{}
+	s.pairing.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.pairing.mu.Lock()
+			delete(s.pairing.subscribers, ch)
+			s.pairing.mu.Unlock()
+		})
+	}
+}
+
+// PairPhone asks WhatsApp for a pairing code that links the session to the
+// phone of phoneNumber, in international format without the +. The phone
+// shows a notification, and the code is typed into it under Linked Devices →
+// Link with phone number instead. It starts pairing when needed and waits
+// for the login socket to be ready. The code is valid until the pairing
+// times out, about three minutes after it started.
+func (s *Session) PairPhone(ctx context.Context, phoneNumber string) (string, error) {
+	events, stop := s.SubscribePairing()
+	defer stop()
+
+	if err := s.StartPairing(); err != nil {
+		return "", err
+	}
+	// The socket is ready for pairing codes once it sent the first QR code
+	for s.PairingStatus().Code == "" {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case evt := <-events:
+			if evt.Done() {
+				return "", fmt.Errorf("pairing ended: %s", evt.Event)
+			}
+		}
+	}
+
+	code, err := s.Client.PairPhone(ctx, phoneNumber, true, whatsmeow.PairClientChrome, pairClientName)
+	if err != nil {
+		return "", fmt.Errorf("failed to request pairing code: %w", err)
+	}
+	s.publishPairing(PairingEvent{Event: PairingEventPairingCode, PairingCode: code, PhoneNumber: phoneNumber})
+	return code, nil
+}
+
+// QRCodePNG renders a pairing code as a PNG QR code
+func QRCodePNG(code string) ([]byte, error) {
+	c, err := qr.Encode(code, qr.L)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %w", err)
+	}
+	return c.PNG(), nil
+}
+
+// QRCodeSVG renders a pairing code as an SVG QR code, with a quiet zone of
+// four modules
+func QRCodeSVG(code string) ([]byte, error) {
+	c, err := qr.Encode(code, qr.L)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %w", err)
+	}
+
+	const quiet = 4
+	size := c.Size + 2*quiet
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Black(x, y) {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes(), nil
+}
@@ -3,140 +3,120 @@ package whatsapp
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"os"
 
 	"github.com/mdp/qrterminal/v3"
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/proto/waE2E"
-	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
-	waLog "go.mau.fi/whatsmeow/util/log"
 	"google.golang.org/protobuf/proto"
 	_ "modernc.org/sqlite"
 )
 
-var client *whatsmeow.Client
+var manager *Manager
 
-// Init initializes the WhatsApp client.
+// Init opens the WhatsApp sessions stored in dbName, whatsapp.db by default,
+// and connects them. When there are none yet, it adds a "default" session and
+// starts pairing it without waiting: its QR codes are served by the pairing
+// API.
 func Init(ctx context.Context, dbName *string) error {
-	// Setup logging
-	dbLog := waLog.Stdout("Database", "INFO", true)
-
-	// Setup database for session storage
-	var dbPath string
-	if dbName == nil {
-		dbPath = "file:whatsapp.db?_pragma=foreign_keys(1)"
-	} else {
-		dbPath = fmt.Sprintf("file:%s?_pragma=foreign_keys(1)", *dbName)
+	dbPath := "whatsapp.db"
+	if dbName != nil {
+		dbPath = *dbName
 	}
 
-	// Changed from "sqlite3" to "sqlite" for modernc.org/sqlite driver
-	container, err := sqlstore.New(ctx, "sqlite", dbPath, dbLog)
+	m, err := Open(ctx, dbPath)
 	if err != nil {
 		return err
 	}
+	manager = m
 
-	// Get first device (or create new one)
-	deviceStore, err := container.GetFirstDevice(ctx)
+	if len(m.List()) > 0 {
+		return nil
+	}
+	session, err := m.Add(ctx, "default")
 	if err != nil {
 		return err
 	}
+	return session.StartPairing()
+}
 
-	// Create WhatsApp client
-	clientLog := waLog.Stdout("Client", "INFO", true)
-	client = whatsmeow.NewClient(deviceStore, clientLog)
-
-	// Register event handler
-	client.AddEventHandler(eventHandler)
-
-	// Connect to WhatsApp
-	if client.Store.ID == nil {
-		// No ID stored, new login
-		qrChan, _ := client.GetQRChannel(ctx)
-		err = client.Connect()
-		if err != nil {
-			return err
-		}
-
-		// Print QR code for scanning
-		fmt.Println("\n=== WhatsApp QR Code ===")
-		fmt.Println("Please scan this QR code with WhatsApp on your phone:")
-		fmt.Println("Settings → Linked Devices → Link a Device")
-
-		for evt := range qrChan {
-			if evt.Event == "code" {
-				fmt.Println("\nWaiting for QR code scan...")
-				qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, os.Stdout)
-			} else if evt.Event == "success" {
-				fmt.Println("✓ Successfully logged in!")
-			} else {
-				fmt.Printf("Login event: %s\n", evt.Event)
-			}
-		}
-	} else {
-		// Already logged in, just connect
-		err = client.Connect()
-		if err != nil {
-			return err
-		}
-		fmt.Println("✓ WhatsApp client connected (existing session)")
-	}
-
-	return nil
+// GetManager returns the session manager, nil before Init
+func GetManager() *Manager {
+	return manager
 }
 
-// Disconnect closes the WhatsApp connection
+// Disconnect closes every WhatsApp connection
 func Disconnect() {
-	if client != nil {
-		client.Disconnect()
-		fmt.Println("WhatsApp client disconnected")
+	if manager != nil {
+		manager.Close()
+		slog.Info("WhatsApp client disconnected")
 	}
 }
 
-// Event handler for incoming messages and events
-func eventHandler(evt any) {
+// printQR prints a QR code to the terminal
+func printQR(code string) {
+	qrterminal.GenerateHalfBlock(code, qrterminal.L, os.Stdout)
+}
+
+// eventHandler logs the events of a session at debug level
+func eventHandler(session string, evt any) {
 	switch v := evt.(type) {
 	case *events.Message:
-		fmt.Printf("Received message from %s: %s\n", v.Info.Sender, v.Message.GetConversation())
+		slog.Debug("WhatsApp message received", "session", session, "id", v.Info.ID, "chat", v.Info.Chat, "sender", v.Info.Sender)
 
 		// Example: Auto-reply to messages
 		// SendMessage(context.Background(), v.Info.Sender.User, "Thanks for your message!")
 
 	case *events.Receipt:
-		if v.Type == types.ReceiptTypeRead || v.Type == types.ReceiptTypeReadSelf {
-			fmt.Printf("%s read the message\n", v.Sender)
-		} else if v.Type == types.ReceiptTypeDelivered {
-			fmt.Println("Message delivered to", v.Sender)
-		}
+		slog.Debug("WhatsApp receipt", "session", session, "type", v.Type, "chat", v.Chat, "sender", v.Sender, "messages", v.MessageIDs)
 
 	case *events.Presence:
-		if v.Unavailable {
-			fmt.Printf("%s is now offline\n", v.From)
-		} else {
-			fmt.Printf("%s is now online\n", v.From)
-		}
+		slog.Debug("WhatsApp presence", "session", session, "from", v.From, "available", !v.Unavailable)
 
 	case *events.LoggedOut:
-		fmt.Println("⚠️  Logged out from WhatsApp!")
+		slog.Warn("WhatsApp session logged out", "session", session, "reason", v.Reason)
 	}
 }
 
-// IsConnected checks if the client is connected
+// IsConnected checks if the default session is connected
 func IsConnected() bool {
-	return client != nil && client.IsConnected()
+	session, err := defaultSession()
+	return err == nil && session.IsConnected()
 }
 
-// GetClient returns the WhatsApp client (for advanced usage)
+// GetClient returns the WhatsApp client of the default session (for advanced
+// usage), nil when there is none
 func GetClient() *whatsmeow.Client {
-	return client
+	session, err := defaultSession()
+	if err != nil {
+		return nil
+	}
+	return session.Client
 }
 
-// SendMessage sends a text message
+// defaultSession returns the default session of the package manager
+func defaultSession() (*Session, error) {
+	if manager == nil {
+		return nil, fmt.Errorf("whatsapp client not initialized")
+	}
+	return manager.Default()
+}
+
+// SendMessage sends a text message from the default session
 func SendMessage(ctx context.Context, phoneNumber, message string) error {
-	if client == nil {
-		return fmt.Errorf("whatsapp client not initialized")
+	session, err := defaultSession()
+	if err != nil {
+		return err
 	}
+	return session.SendMessage(ctx, phoneNumber, message)
+}
+
+// SendMessage sends a text message
+func (s *Session) SendMessage(ctx context.Context, phoneNumber, message string) error {
+	client := s.Client
 
 	// Format: country code + phone number (without +)
 	// Example: "254712345678" for Kenya
@@ -150,16 +130,24 @@ func SendMessage(ctx context.Context, phoneNumber, message string) error {
 	if err != nil {
 		return fmt.Errorf("failed to send message: %v", err)
 	}
+	s.storeSent(ctx, jid, msg, resp)
 
-	fmt.Printf("Message sent! ID: %s, Timestamp: %v\n", resp.ID, resp.Timestamp)
+	slog.Debug("WhatsApp message sent", "session", s.ID, "id", resp.ID, "timestamp", resp.Timestamp)
 	return nil
 }
 
-// SendImage sends an image message
+// SendImage sends an image message from the default session
 func SendImage(ctx context.Context, phoneNumber, imagePath, caption string) error {
-	if client == nil {
-		return fmt.Errorf("whatsapp client not initialized")
+	session, err := defaultSession()
+	if err != nil {
+		return err
 	}
+	return session.SendImage(ctx, phoneNumber, imagePath, caption)
+}
+
+// SendImage sends an image message
+func (s *Session) SendImage(ctx context.Context, phoneNumber, imagePath, caption string) error {
+	client := s.Client
 
 	jid := types.NewJID(phoneNumber, types.DefaultUserServer)
 
@@ -193,16 +181,24 @@ func SendImage(ctx context.Context, phoneNumber, imagePath, caption string) erro
 	if err != nil {
 		return fmt.Errorf("failed to send image: %v", err)
 	}
+	s.storeSent(ctx, jid, msg, resp)
 
-	fmt.Printf("Image sent! ID: %s\n", resp.ID)
+	slog.Debug("WhatsApp image sent", "session", s.ID, "id", resp.ID)
 	return nil
 }
 
-// SendDocument sends a document/file
+// SendDocument sends a document/file from the default session
 func SendDocument(ctx context.Context, phoneNumber, filePath, fileName string) error {
-	if client == nil {
-		return fmt.Errorf("whatsapp client not initialized")
+	session, err := defaultSession()
+	if err != nil {
+		return err
 	}
+	return session.SendDocument(ctx, phoneNumber, filePath, fileName)
+}
+
+// SendDocument sends a document/file
+func (s *Session) SendDocument(ctx context.Context, phoneNumber, filePath, fileName string) error {
+	client := s.Client
 
 	jid := types.NewJID(phoneNumber, types.DefaultUserServer)
 
@@ -236,16 +232,24 @@ func SendDocument(ctx context.Context, phoneNumber, filePath, fileName string) e
 	if err != nil {
 		return fmt.Errorf("failed to send document: %v", err)
 	}
+	s.storeSent(ctx, jid, msg, resp)
 
-	fmt.Printf("Document sent! ID: %s\n", resp.ID)
+	slog.Debug("WhatsApp document sent", "session", s.ID, "id", resp.ID)
 	return nil
 }
 
-// GetUserInfo gets user information
+// GetUserInfo gets user information from the default session
 func GetUserInfo(ctx context.Context, phoneNumber string) error {
-	if client == nil {
-		return fmt.Errorf("whatsapp client not initialized")
+	session, err := defaultSession()
+	if err != nil {
+		return err
 	}
+	return session.GetUserInfo(ctx, phoneNumber)
+}
+
+// GetUserInfo gets user information
+func (s *Session) GetUserInfo(ctx context.Context, phoneNumber string) error {
+	client := s.Client
 
 	jid := types.NewJID(phoneNumber, types.DefaultUserServer)
 
@@ -255,16 +259,23 @@ func GetUserInfo(ctx context.Context, phoneNumber string) error {
 	}
 
 	for _, user := range info {
-		fmt.Printf("User: %v\n", user)
+		slog.Debug("WhatsApp user info", "session", s.ID, "user", user)
 	}
 	return nil
 }
 
-// SendLocation sends a location message
+// SendLocation sends a location message from the default session
 func SendLocation(ctx context.Context, phoneNumber string, latitude, longitude float64) error {
-	if client == nil {
-		return fmt.Errorf("whatsapp client not initialized")
+	session, err := defaultSession()
+	if err != nil {
+		return err
 	}
+	return session.SendLocation(ctx, phoneNumber, latitude, longitude)
+}
+
+// SendLocation sends a location message
+func (s *Session) SendLocation(ctx context.Context, phoneNumber string, latitude, longitude float64) error {
+	client := s.Client
 
 	jid := types.NewJID(phoneNumber, types.DefaultUserServer)
 
@@ -279,7 +290,8 @@ func SendLocation(ctx context.Context, phoneNumber string, latitude, longitude f
 	if err != nil {
 		return fmt.Errorf("failed to send location: %v", err)
 	}
+	s.storeSent(ctx, jid, msg, resp)
 
-	fmt.Printf("Location sent! ID: %s\n", resp.ID)
+	slog.Debug("WhatsApp location sent", "session", s.ID, "id", resp.ID)
 	return nil
 }